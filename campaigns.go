@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Time between messages of a campaign when no Interval is given, and the shortest allowed
+const defaultCampaignInterval = 5 * time.Second
+const minCampaignInterval = time.Second
+
+// How long a campaign waits before retrying when its session is not connected
+const campaignReconnectWait = 30 * time.Second
+
+// Message sent to a list of recipients, with {{name}} placeholders filled from each recipient Variables
+type campaign struct {
+	Id       int64
+	Name     string
+	Status   string // running, paused, cancelled or finished
+	Type     string
+	Content  json.RawMessage
+	Options  sendOptions
+	Interval float64 // seconds between messages
+	Created  time.Time
+	Finished *time.Time     `json:",omitempty"`
+	Counts   map[string]int `json:",omitempty"`
+}
+
+type campaignRecipient struct {
+	Id        int64
+	To        string
+	Variables map[string]string `json:",omitempty"`
+	Status    string            // queued, sending, sent, delivered, read, failed or cancelled
+	MessageId string            `json:",omitempty"`
+	Error     string            `json:",omitempty"`
+	Updated   time.Time
+}
+
+// Campaigns with a goroutine sending them, so resuming never starts a second one
+var campaignRunners = make(map[int64]bool)
+var campaignMutex sync.Mutex
+
+// Replaces {{name}} placeholders in every string of content with the recipient variables
+func substituteVariables(content json.RawMessage, vars map[string]string) (json.RawMessage, error) {
+	if len(vars) == 0 {
+		return content, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	pairs := []string{}
+	for name, v := range vars {
+		pairs = append(pairs, "{{"+name+"}}", v)
+	}
+	replacer := strings.NewReplacer(pairs...)
+	return json.Marshal(replaceStrings(value, replacer))
+}
+
+func replaceStrings(value interface{}, replacer *strings.Replacer) interface{} {
+	switch v := value.(type) {
+	case string:
+		return replacer.Replace(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = replaceStrings(item, replacer)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = replaceStrings(item, replacer)
+		}
+	}
+	return value
+}
+
+// Stores a campaign and its recipients, and starts sending it
+func createCampaign(db *sql.DB, userid int, c *campaign, recipients []campaignRecipient) error {
+	options, err := json.Marshal(c.Options)
+	if err != nil {
+		return err
+	}
+	c.Status = "running"
+	c.Created = time.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	sqlStmt := `INSERT INTO campaigns (user_id, name, status, type, content, options, interval_ms, created) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	res, err := tx.Exec(sqlStmt, userid, c.Name, c.Status, c.Type, string(c.Content), string(options), int64(c.Interval*1000), c.Created.Unix())
+	if err != nil {
+		return err
+	}
+	c.Id, _ = res.LastInsertId()
+	stmt, err := tx.Prepare(`INSERT INTO campaign_recipients (campaign_id, recipient, variables, status, updated) VALUES (?, ?, ?, 'queued', ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range recipients {
+		vars, err := json.Marshal(r.Variables)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.Exec(c.Id, r.To, string(vars), c.Created.Unix())
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	runCampaign(db, userid, c.Id)
+	return nil
+}
+
+const campaignColumns = `id, name, status, type, content, options, interval_ms, created, finished`
+
+func scanCampaign(row interface{ Scan(...interface{}) error }) (*campaign, error) {
+	var content, options string
+	var interval, created int64
+	var finished sql.NullInt64
+	c := &campaign{}
+	err := row.Scan(&c.Id, &c.Name, &c.Status, &c.Type, &content, &options, &interval, &created, &finished)
+	if err != nil {
+		return nil, err
+	}
+	c.Content = json.RawMessage(content)
+	json.Unmarshal([]byte(options), &c.Options)
+	c.Interval = float64(interval) / 1000
+	c.Created = time.Unix(created, 0)
+	if finished.Valid {
+		t := time.Unix(finished.Int64, 0)
+		c.Finished = &t
+	}
+	return c, nil
+}
+
+// Gets a campaign with the number of recipients in each state, returns sql.ErrNoRows if it does not exist
+func getCampaign(db *sql.DB, userid int, id int64) (*campaign, error) {
+	c, err := scanCampaign(db.QueryRow("SELECT "+campaignColumns+" FROM campaigns WHERE id=? AND user_id=?", id, userid))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT status, COUNT(*) FROM campaign_recipients WHERE campaign_id=? GROUP BY status", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	c.Counts = make(map[string]int)
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		c.Counts[status] = count
+	}
+	return c, rows.Err()
+}
+
+func listCampaigns(db *sql.DB, userid int) ([]*campaign, error) {
+	rows, err := db.Query("SELECT "+campaignColumns+" FROM campaigns WHERE user_id=? ORDER BY id DESC", userid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*campaign{}
+	for rows.Next() {
+		c, err := scanCampaign(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
+
+// Lists the recipients of a campaign, filtered by status if set
+func listCampaignRecipients(db *sql.DB, id int64, status string) ([]*campaignRecipient, error) {
+	query := "SELECT id, recipient, variables, status, message_id, error, updated FROM campaign_recipients WHERE campaign_id=?"
+	args := []interface{}{id}
+	if status != "" {
+		query += " AND status=?"
+		args = append(args, status)
+	}
+	rows, err := db.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*campaignRecipient{}
+	for rows.Next() {
+		var vars string
+		var updated int64
+		r := &campaignRecipient{}
+		if err := rows.Scan(&r.Id, &r.To, &vars, &r.Status, &r.MessageId, &r.Error, &updated); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(vars), &r.Variables)
+		r.Updated = time.Unix(updated, 0)
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+// Changes the status of a campaign if it currently has one of the from statuses, returns false otherwise
+func setCampaignStatus(db *sql.DB, userid int, id int64, status string, from ...string) (bool, error) {
+	query := "UPDATE campaigns SET status=? WHERE id=? AND user_id=? AND status IN (?" + strings.Repeat(", ?", len(from)-1) + ")"
+	args := []interface{}{status, id, userid}
+	for _, f := range from {
+		args = append(args, f)
+	}
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if affected == 0 || err != nil {
+		return false, err
+	}
+	switch status {
+	case "running":
+		runCampaign(db, userid, id)
+	case "cancelled":
+		_, err = db.Exec("UPDATE campaign_recipients SET status='cancelled', updated=? WHERE campaign_id=? AND status='queued'", time.Now().Unix(), id)
+	}
+	return true, err
+}
+
+// Moves the campaign recipients of sent messages forward on delivery and read receipts
+func updateCampaignReceipts(db *sql.DB, ids []string, status string) {
+	// Receipts can arrive before the send call returns, while the recipient is still sending
+	from := "'sending', 'sent'"
+	if status == "read" {
+		from = "'sending', 'sent', 'delivered'"
+	}
+	for _, id := range ids {
+		_, err := db.Exec("UPDATE campaign_recipients SET status=?, updated=? WHERE message_id=? AND status IN ("+from+")", status, time.Now().Unix(), id)
+		if err != nil {
+			log.Warn().Err(err).Str("id", id).Msg("Could not update campaign recipient")
+		}
+	}
+}
+
+// Resumes running campaigns after a restart
+func startCampaigns(db *sql.DB) {
+	// Messages being sent when the server stopped may or may not have reached WhatsApp
+	_, err := db.Exec("UPDATE campaign_recipients SET status='failed', error='Interrupted by server restart' WHERE status='sending'")
+	if err != nil {
+		log.Error().Err(err).Msg("Could not recover campaign recipients")
+	}
+	rows, err := db.Query("SELECT id, user_id FROM campaigns WHERE status='running'")
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load campaigns")
+		return
+	}
+	type running struct {
+		id     int64
+		userid int
+	}
+	list := []running{}
+	for rows.Next() {
+		var r running
+		if err := rows.Scan(&r.id, &r.userid); err == nil {
+			list = append(list, r)
+		}
+	}
+	rows.Close()
+	for _, r := range list {
+		runCampaign(db, r.userid, r.id)
+	}
+}
+
+// Starts sending a campaign in the background unless it is already being sent
+func runCampaign(db *sql.DB, userid int, id int64) {
+	campaignMutex.Lock()
+	defer campaignMutex.Unlock()
+	if campaignRunners[id] {
+		return
+	}
+	campaignRunners[id] = true
+	go sendCampaign(db, userid, id)
+}
+
+// Sends the queued recipients of a campaign one at a time, stopping when it is paused, cancelled or done
+func sendCampaign(db *sql.DB, userid int, id int64) {
+	defer func() {
+		campaignMutex.Lock()
+		delete(campaignRunners, id)
+		campaignMutex.Unlock()
+	}()
+	// Media without per recipient variables is downloaded and uploaded once for the whole campaign
+	media := newMediaCache()
+	for {
+		c, err := scanCampaign(db.QueryRow("SELECT "+campaignColumns+" FROM campaigns WHERE id=?", id))
+		if err != nil {
+			log.Error().Err(err).Int64("campaign", id).Msg("Could not load campaign")
+			return
+		}
+		if c.Status != "running" {
+			return
+		}
+		client := getClient(userid)
+		if client == nil || !client.IsConnected() || !client.IsLoggedIn() {
+			time.Sleep(campaignReconnectWait)
+			continue
+		}
+
+		var r campaignRecipient
+		var vars string
+		err = db.QueryRow("SELECT id, recipient, variables FROM campaign_recipients WHERE campaign_id=? AND status='queued' ORDER BY id LIMIT 1", id).Scan(&r.Id, &r.To, &vars)
+		if err == sql.ErrNoRows {
+			_, err = db.Exec("UPDATE campaigns SET status='finished', finished=? WHERE id=? AND status='running'", time.Now().Unix(), id)
+			if err != nil {
+				log.Error().Err(err).Int64("campaign", id).Msg("Could not finish campaign")
+			}
+			log.Info().Int64("campaign", id).Msg("Campaign finished")
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Int64("campaign", id).Msg("Could not load campaign recipient")
+			return
+		}
+		json.Unmarshal([]byte(vars), &r.Variables)
+
+		// The ID is stored before sending so receipts arriving right away find the recipient
+		r.MessageId = whatsmeow.GenerateMessageID()
+		_, err = db.Exec("UPDATE campaign_recipients SET status='sending', message_id=?, updated=? WHERE id=?", r.MessageId, time.Now().Unix(), r.Id)
+		if err != nil {
+			log.Error().Err(err).Int64("campaign", id).Msg("Could not claim campaign recipient")
+			return
+		}
+		r.Status = "sent"
+		err = sendCampaignMessage(db, userid, c, &r, media)
+		if err != nil {
+			r.Status = "failed"
+			r.Error = err.Error()
+			log.Warn().Err(err).Int64("campaign", id).Str("to", r.To).Msg("Campaign message failed")
+		}
+		// A receipt may already have moved the recipient forward
+		_, err = db.Exec("UPDATE campaign_recipients SET status=?, message_id=?, error=?, updated=? WHERE id=? AND status='sending'", r.Status, r.MessageId, r.Error, time.Now().Unix(), r.Id)
+		if err != nil {
+			log.Error().Err(err).Int64("campaign", id).Msg("Could not update campaign recipient")
+		}
+		time.Sleep(time.Duration(c.Interval * float64(time.Second)))
+	}
+}
+
+func sendCampaignMessage(db *sql.DB, userid int, c *campaign, r *campaignRecipient, media *mediaCache) error {
+	content, err := substituteVariables(c.Content, r.Variables)
+	if err != nil {
+		return fmt.Errorf("Could not substitute variables: %v", err)
+	}
+	options := c.Options
+	options.Id = r.MessageId
+	options.OnLimit = "wait"
+	result, err := sendMessage(db, userid, &sendRequest{Type: c.Type, To: r.To, Content: content, Options: options, media: media})
+	if err != nil {
+		return err
+	}
+	r.MessageId = result.Id
+	return nil
+}
+
+// Checks a campaign can be created, every recipient must be a valid phone number or JID
+func validateCampaign(c *campaign, recipients []campaignRecipient) error {
+	if len(recipients) == 0 {
+		return errors.New("Missing Recipients in Payload")
+	}
+	if c.Options.Id != "" {
+		return errors.New("Options.Id can not be set for campaigns, an ID is generated for each recipient")
+	}
+	if c.Interval == 0 {
+		c.Interval = defaultCampaignInterval.Seconds()
+	}
+	if c.Interval < minCampaignInterval.Seconds() {
+		return fmt.Errorf("Interval must be at least %v seconds", minCampaignInterval.Seconds())
+	}
+	for i, r := range recipients {
+		if _, ok := parseJID(r.To); !ok {
+			return fmt.Errorf("Could not parse To of recipient %d", i)
+		}
+	}
+	return validateSendRequest(&sendRequest{Type: c.Type, To: recipients[0].To, Content: c.Content, Options: c.Options})
+}
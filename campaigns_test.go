@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSubstituteVariables(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		vars    map[string]string
+		want    string
+	}{
+		{"no variables kept as is", `{"Body": "Hi {{name}}"}`, nil, `{"Body": "Hi {{name}}"}`},
+		{"string fields", `{"Body":"Hi {{name}}, code {{code}}"}`, map[string]string{"name": "Ana", "code": "ANA10"}, `{"Body":"Hi Ana, code ANA10"}`},
+		{"unknown placeholders kept", `{"Body":"Hi {{name}} {{other}}"}`, map[string]string{"name": "Ana"}, `{"Body":"Hi Ana {{other}}"}`},
+		{"nested objects and arrays", `{"Buttons":[{"Id":"{{id}}","Text":"Yes"}],"Footer":{"Text":"{{id}}"}}`, map[string]string{"id": "7"}, `{"Buttons":[{"Id":"7","Text":"Yes"}],"Footer":{"Text":"7"}}`},
+		{"numbers untouched", `{"Latitude":-34.603722123456789,"Name":"{{place}}"}`, map[string]string{"place": "Obelisco"}, `{"Latitude":-34.603722123456789,"Name":"Obelisco"}`},
+		{"values escaped", `{"Body":"{{quote}}"}`, map[string]string{"quote": `say "hi"`}, `{"Body":"say \"hi\""}`},
+		{"keys untouched", `{"{{name}}":"{{name}}"}`, map[string]string{"name": "Ana"}, `{"{{name}}":"Ana"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := substituteVariables(json.RawMessage(tt.content), tt.vars)
+			if err != nil {
+				t.Fatalf("substituteVariables: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("substituteVariables() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+	if _, err := substituteVariables(json.RawMessage(`{"Body":`), map[string]string{"name": "Ana"}); err == nil {
+		t.Error("invalid JSON accepted")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Number of delivery records kept per user
+const deliveryLogSize = 200
+
+// Maximum number of attempts for a webhook delivery
+const webhookAttempts = 3
+
+// Maximum length of webhook response bodies kept in records
+const deliveryBodySize = 2048
+
+// Outcome of a webhook delivery
+type deliveryRecord struct {
+	Time       time.Time
+	Type       string
+	Url        string
+	StatusCode int
+	Attempts   int
+	LatencyMs  int64
+	Success    bool
+	Error      string `json:",omitempty"`
+	Response   string `json:",omitempty"`
+}
+
+var deliveryLogs = make(map[int][]deliveryRecord)
+var deliveryLogsMutex sync.Mutex
+
+// Adds a delivery record to the user log, dropping the oldest when full
+func logDelivery(userid int, record deliveryRecord) {
+	deliveryLogsMutex.Lock()
+	defer deliveryLogsMutex.Unlock()
+	records := append(deliveryLogs[userid], record)
+	if len(records) > deliveryLogSize {
+		records = records[len(records)-deliveryLogSize:]
+	}
+	deliveryLogs[userid] = records
+}
+
+// Returns the most recent delivery records first, filtered by event type if set
+func getDeliveries(userid int, eventtype string, limit int) []deliveryRecord {
+	deliveryLogsMutex.Lock()
+	defer deliveryLogsMutex.Unlock()
+	records := deliveryLogs[userid]
+	result := []deliveryRecord{}
+	for i := len(records) - 1; i >= 0 && (limit <= 0 || len(result) < limit); i-- {
+		if eventtype != "" && records[i].Type != eventtype {
+			continue
+		}
+		result = append(result, records[i])
+	}
+	return result
+}
+
+// Builds a delivery record from a webhook response
+func newDeliveryRecord(eventtype string, webhookurl string, attempts int, resp *resty.Response, err error) deliveryRecord {
+	record := deliveryRecord{
+		Time:     time.Now(),
+		Type:     eventtype,
+		Url:      webhookurl,
+		Attempts: attempts,
+		Success:  err == nil,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if resp != nil {
+		record.StatusCode = resp.StatusCode()
+		record.LatencyMs = resp.Time().Milliseconds()
+		record.Response = resp.String()
+		if len(record.Response) > deliveryBodySize {
+			record.Response = record.Response[:deliveryBodySize]
+		}
+	}
+	return record
+}
+
+// Whether a failed delivery is worth retrying: network errors, server errors and rate limiting
+func retryableDelivery(resp *resty.Response) bool {
+	if resp == nil {
+		// request could not even be built, e.g. template errors
+		return false
+	}
+	if resp.StatusCode() == 0 {
+		return true
+	}
+	return resp.StatusCode() >= 500 || resp.StatusCode() == 429
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// Disappearing message timers accepted by WhatsApp
+var disappearingTimers = map[string]time.Duration{
+	"off": 0,
+	"24h": whatsmeow.DisappearingTimer24Hours,
+	"7d":  whatsmeow.DisappearingTimer7Days,
+	"90d": whatsmeow.DisappearingTimer90Days,
+}
+
+// Parses a disappearing timer given as off, 24h, 7d, 90d or the same durations in seconds,
+// WhatsApp clients don't show other values
+func parseDisappearingTimer(value string) (time.Duration, error) {
+	if timer, ok := disappearingTimers[value]; ok {
+		return timer, nil
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		for _, timer := range disappearingTimers {
+			if time.Duration(seconds)*time.Second == timer {
+				return timer, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("Invalid Timer %q, use off, 24h, 7d or 90d", value)
+}
+
+// Gets the known disappearing timer of a chat in seconds. Group timers are fetched the first time,
+// private chat timers are only known once set through the API or seen in a message
+func getDisappearingTimer(db *sql.DB, client *whatsmeow.Client, userid int, chat types.JID) uint32 {
+	var timer uint32
+	err := db.QueryRow("SELECT timer FROM disappearing_timers WHERE user_id=? AND chat=?", userid, chat.String()).Scan(&timer)
+	if err == nil {
+		return timer
+	}
+	if err != sql.ErrNoRows {
+		log.Warn().Err(err).Str("chat", chat.String()).Msg("Could not load disappearing timer")
+		return 0
+	}
+	if chat.Server != types.GroupServer {
+		return 0
+	}
+	info, err := client.GetGroupInfo(chat)
+	if err != nil {
+		log.Warn().Err(err).Str("chat", chat.String()).Msg("Could not get group disappearing timer")
+		return 0
+	}
+	timer = 0
+	if info.IsEphemeral {
+		timer = info.DisappearingTimer
+	}
+	setDisappearingTimer(db, userid, chat, timer)
+	return timer
+}
+
+// Stores the disappearing timer of a chat in seconds
+func setDisappearingTimer(db *sql.DB, userid int, chat types.JID, timer uint32) {
+	sqlStmt := `INSERT OR REPLACE INTO disappearing_timers (user_id, chat, timer, updated) VALUES (?, ?, ?, ?)`
+	_, err := db.Exec(sqlStmt, userid, chat.String(), timer, time.Now().Unix())
+	if err != nil {
+		log.Warn().Err(err).Str("chat", chat.String()).Msg(sqlStmt)
+	}
+}
+
+// Keeps track of the disappearing timer of a chat from its messages: timer changes,
+// and the expiration of disappearing messages
+func (mycli *MyClient) trackDisappearingTimer(evt *events.Message) {
+	protocol := evt.Message.GetProtocolMessage()
+	if protocol.GetType() == waProto.ProtocolMessage_EPHEMERAL_SETTING {
+		setDisappearingTimer(mycli.db, mycli.userID, evt.Info.Chat, protocol.GetEphemeralExpiration())
+		return
+	}
+	if evt.IsEphemeral {
+		if expiration := messageContextInfo(evt.Message).GetExpiration(); expiration > 0 {
+			setDisappearingTimer(mycli.db, mycli.userID, evt.Info.Chat, expiration)
+		}
+	}
+}
+
+// Sets the expiration of an outgoing message to the disappearing timer of its chat
+func applyDisappearingTimer(msg *waProto.Message, timer uint32) {
+	info := messageContextInfo(msg)
+	if info == nil {
+		info = &waProto.ContextInfo{}
+		if applyContextInfo(msg, info) != nil {
+			return
+		}
+	}
+	info.Expiration = proto.Uint32(timer)
+}
+
+// Wraps an image, video or voice note so it can only be viewed once
+func viewOnceMessage(msg *waProto.Message) (*waProto.Message, error) {
+	switch {
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.ViewOnce = proto.Bool(true)
+	case msg.VideoMessage != nil:
+		msg.VideoMessage.ViewOnce = proto.Bool(true)
+	case msg.AudioMessage != nil && msg.AudioMessage.GetPtt():
+		msg.AudioMessage.ViewOnce = proto.Bool(true)
+		return &waProto.Message{ViewOnceMessageV2Extension: &waProto.FutureProofMessage{Message: msg}}, nil
+	default:
+		return nil, badRequest("ViewOnce is only supported for images, videos and voice notes")
+	}
+	return &waProto.Message{ViewOnceMessage: &waProto.FutureProofMessage{Message: msg}}, nil
+}
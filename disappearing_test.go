@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDisappearingTimer(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"off", 0, true},
+		{"24h", 24 * time.Hour, true},
+		{"7d", 7 * 24 * time.Hour, true},
+		{"90d", 90 * 24 * time.Hour, true},
+		{"0", 0, true},
+		{"86400", 24 * time.Hour, true},
+		{"604800", 7 * 24 * time.Hour, true},
+		{"7776000", 90 * 24 * time.Hour, true},
+		{"3600", 0, false},
+		{"-86400", 0, false},
+		{"1h", 0, false},
+		{"OFF", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseDisappearingTimer(tt.value)
+			if (err == nil) != tt.ok {
+				t.Fatalf("parseDisappearingTimer(%q) error = %v, want ok %v", tt.value, err, tt.ok)
+			}
+			if got != tt.want {
+				t.Errorf("parseDisappearingTimer(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
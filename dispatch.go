@@ -0,0 +1,246 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Webhook dispatch settings, configured per user
+type dispatchSettings struct {
+	Concurrency int    // number of parallel deliveries, events of the same chat are always delivered in order
+	OnFull      string // wait (default) for room in a full queue, up to -webhookqueuetimeout, or drop right away
+}
+
+// Backpressure and delivery counters of a session dispatcher
+type dispatchStats struct {
+	Concurrency int
+	Capacity    int    // maximum number of pending deliveries
+	Pending     int64  // deliveries waiting in the queue
+	Enqueued    uint64 // total deliveries queued
+	Delivered   uint64 // deliveries accepted by the webhook
+	Failed      uint64 // deliveries that could not be delivered
+	Waited      uint64 // deliveries that waited for room in a full queue
+	Dropped     uint64 // deliveries dropped because the queue was full
+}
+
+// A single webhook call waiting in the dispatch queue
+type webhookDelivery struct {
+	mycli   *MyClient
+	postmap map[string]interface{}
+	key     string        // ordering key, deliveries with the same key are sent in order
+	path    string        // file attached to the webhook, if any
+	ready   chan struct{} // closed when the delivery can be sent, nil if ready right away
+}
+
+// Per session queue delivering webhooks with bounded concurrency
+type webhookDispatcher struct {
+	// counters first, they are updated atomically and must be 64-bit aligned
+	pending   int64
+	enqueued  uint64
+	delivered uint64
+	failed    uint64
+	waited    uint64
+	dropped   uint64
+
+	mu           sync.RWMutex
+	lanes        []chan *webhookDelivery
+	workers      *sync.WaitGroup
+	dropWhenFull bool
+}
+
+var dispatchers = make(map[int]*webhookDispatcher)
+var dispatchersMutex sync.Mutex
+
+// Gets the dispatch settings for a user, defaults to a single ordered lane
+func getDispatchSettings(db *sql.DB, userid int) dispatchSettings {
+	settings := dispatchSettings{Concurrency: 1}
+	err := getUserSetting(db, userid, "webhookdispatch", &settings)
+	if err != nil {
+		log.Warn().Err(err).Int("userid", userid).Msg("Could not load webhook dispatch settings, using default")
+	}
+	if settings.Concurrency < 1 {
+		settings.Concurrency = 1
+	}
+	return settings
+}
+
+// Returns the dispatcher for a user, starting it if needed
+func getDispatcher(db *sql.DB, userid int) *webhookDispatcher {
+	dispatchersMutex.Lock()
+	defer dispatchersMutex.Unlock()
+	d, ok := dispatchers[userid]
+	if !ok {
+		d = &webhookDispatcher{}
+		d.configure(getDispatchSettings(db, userid))
+		dispatchers[userid] = d
+	}
+	return d
+}
+
+// Applies dispatch settings to a running dispatcher
+func (d *webhookDispatcher) configure(settings dispatchSettings) {
+	d.mu.Lock()
+	d.dropWhenFull = settings.OnFull == "drop"
+	d.mu.Unlock()
+	d.resize(settings.Concurrency)
+}
+
+// Changes the number of lanes, new lanes start once deliveries pending on the old ones are done so ordering is kept
+func (d *webhookDispatcher) resize(concurrency int) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	capacity := *webhookQueue / concurrency
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.lanes) == concurrency {
+		return
+	}
+
+	previous := d.workers
+	for _, lane := range d.lanes {
+		close(lane)
+	}
+
+	d.workers = &sync.WaitGroup{}
+	d.lanes = make([]chan *webhookDelivery, concurrency)
+	for i := range d.lanes {
+		lane := make(chan *webhookDelivery, capacity)
+		d.lanes[i] = lane
+		d.workers.Add(1)
+		go func() {
+			defer d.workers.Done()
+			if previous != nil {
+				previous.Wait()
+			}
+			// While the webhook keeps failing deliveries are tried once, so an unreachable
+			// endpoint doesn't hold back every chat of the lane for the whole retry backoff
+			failing := false
+			for delivery := range lane {
+				failing = !d.deliver(delivery, !failing)
+			}
+		}()
+	}
+}
+
+// Queues a delivery. When its lane is full event processing waits for room, up to -webhookqueuetimeout,
+// so events are not lost during bursts. Deliveries still not queued, or right away with OnFull drop,
+// are dropped, counted and recorded in the delivery log
+func (d *webhookDispatcher) enqueue(delivery *webhookDelivery) {
+	// The read lock is held while sending, so resize can't close the lane meanwhile
+	d.mu.RLock()
+	lane := d.lanes[0]
+	if len(d.lanes) > 1 {
+		h := fnv.New32a()
+		h.Write([]byte(delivery.key))
+		lane = d.lanes[h.Sum32()%uint32(len(d.lanes))]
+	}
+	atomic.AddInt64(&d.pending, 1)
+	queued := false
+	select {
+	case lane <- delivery:
+		queued = true
+	default:
+		if !d.dropWhenFull {
+			atomic.AddUint64(&d.waited, 1)
+			timer := time.NewTimer(*webhookWait)
+			select {
+			case lane <- delivery:
+				queued = true
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+	}
+	d.mu.RUnlock()
+
+	if queued {
+		atomic.AddUint64(&d.enqueued, 1)
+		return
+	}
+	atomic.AddInt64(&d.pending, -1)
+	atomic.AddUint64(&d.dropped, 1)
+	eventtype := delivery.postmap["type"].(string)
+	log.Warn().Int("userid", delivery.mycli.userID).Str("type", eventtype).Msg("Webhook queue full, dropping delivery")
+	logDelivery(delivery.mycli.userID, deliveryRecord{Time: time.Now(), Type: eventtype, Error: "Webhook queue full, delivery dropped"})
+}
+
+// Sends a delivery once it is ready, retrying transient failures if retry is set. Returns false when the
+// webhook looks unreachable: network errors, server errors or rate limiting
+func (d *webhookDispatcher) deliver(delivery *webhookDelivery, retry bool) bool {
+	defer atomic.AddInt64(&d.pending, -1)
+	if delivery.ready != nil {
+		<-delivery.ready
+	}
+
+	maxAttempts := 1
+	if retry {
+		maxAttempts = webhookAttempts
+	}
+	var webhookurl string
+	var resp *resty.Response
+	var err error
+	attempts := 0
+	for attempts < maxAttempts {
+		attempts++
+		webhookurl, resp, err = delivery.mycli.sendWebhook(delivery.postmap, delivery.path)
+		if err == nil || !retryableDelivery(resp) {
+			break
+		}
+		if attempts < maxAttempts {
+			time.Sleep(time.Duration(attempts) * time.Second)
+		}
+	}
+	if webhookurl == "" {
+		return true
+	}
+
+	logDelivery(delivery.mycli.userID, newDeliveryRecord(delivery.postmap["type"].(string), webhookurl, attempts, resp, err))
+	if err != nil {
+		atomic.AddUint64(&d.failed, 1)
+		log.Warn().Err(err).Int("userid", delivery.mycli.userID).Int("attempts", attempts).Msg("Webhook delivery failed")
+		return !retryableDelivery(resp)
+	}
+	atomic.AddUint64(&d.delivered, 1)
+	return true
+}
+
+// Snapshot of the dispatcher counters
+func (d *webhookDispatcher) stats() dispatchStats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	capacity := 0
+	for _, lane := range d.lanes {
+		capacity += cap(lane)
+	}
+	return dispatchStats{
+		Concurrency: len(d.lanes),
+		Capacity:    capacity,
+		Pending:     atomic.LoadInt64(&d.pending),
+		Enqueued:    atomic.LoadUint64(&d.enqueued),
+		Delivered:   atomic.LoadUint64(&d.delivered),
+		Failed:      atomic.LoadUint64(&d.failed),
+		Waited:      atomic.LoadUint64(&d.waited),
+		Dropped:     atomic.LoadUint64(&d.dropped),
+	}
+}
+
+// Marshals an event into the form fields posted to webhooks
+func webhookFormData(postmap map[string]interface{}, token string) map[string]string {
+	values, _ := json.Marshal(postmap)
+	data := make(map[string]string)
+	data["data"] = string(values)
+	data["token"] = token
+	return data
+}
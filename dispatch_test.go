@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnqueueFullLane(t *testing.T) {
+	defer func(wait time.Duration) { *webhookWait = wait }(*webhookWait)
+	*webhookWait = 50 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		drop    bool
+		freed   bool // a delivery leaves the lane while waiting
+		waited  uint64
+		dropped uint64
+	}{
+		{"waits then drops", false, false, 1, 1},
+		{"waits for room", false, true, 1, 0},
+		{"drops right away", true, false, 0, 1},
+	}
+	for _, tt := range tests {
+		lane := make(chan *webhookDelivery, 1)
+		d := &webhookDispatcher{lanes: []chan *webhookDelivery{lane}, dropWhenFull: tt.drop}
+		delivery := func() *webhookDelivery {
+			return &webhookDelivery{mycli: &MyClient{userID: 1}, postmap: map[string]interface{}{"type": "Message"}}
+		}
+		d.enqueue(delivery())
+		if tt.freed {
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				<-lane
+			}()
+		}
+		d.enqueue(delivery())
+		stats := d.stats()
+		if stats.Waited != tt.waited || stats.Dropped != tt.dropped {
+			t.Errorf("%s: waited %d, dropped %d, want %d and %d", tt.name, stats.Waited, stats.Dropped, tt.waited, tt.dropped)
+		}
+		if want := 2 - tt.dropped; stats.Enqueued != want {
+			t.Errorf("%s: enqueued %d, want %d", tt.name, stats.Enqueued, want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maximum time an ffmpeg or ffprobe run may take
+const ffmpegTimeout = 60 * time.Second
+
+var errNoFFmpeg = errors.New("ffmpeg is not configured")
+
+// Writes media to a temporary file for external tools, which need to seek in mp4 files
+func withTempFile(data []byte, fn func(path string) error) error {
+	tmp, err := os.CreateTemp("", "wuzapi-media-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return fn(tmp.Name())
+}
+
+// Runs a tool returning its standard output, with its standard error as the error message
+func runTool(path string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ffmpegTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+// Runs ffmpeg on media, returning what it writes to its standard output
+func runFFmpeg(data []byte, args ...string) ([]byte, error) {
+	if *ffmpegPath == "" {
+		return nil, errNoFFmpeg
+	}
+	var out []byte
+	err := withTempFile(data, func(path string) error {
+		var err error
+		out, err = runTool(*ffmpegPath, append([]string{"-v", "error", "-i", path}, args...)...)
+		return err
+	})
+	return out, err
+}
+
+// Gets the duration and video dimensions of media with ffprobe
+func probeMedia(data []byte) (*mediaMetadata, error) {
+	if *ffprobePath == "" {
+		return nil, errors.New("ffprobe is not configured")
+	}
+	var out []byte
+	err := withTempFile(data, func(path string) error {
+		var err error
+		out, err = runTool(*ffprobePath, "-v", "error", "-print_format", "json", "-show_entries", "format=duration:stream=codec_type,width,height", path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var probe struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, err
+	}
+	meta := &mediaMetadata{}
+	if duration, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+		meta.Duration = time.Duration(duration * float64(time.Second))
+	}
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "video" && stream.Width > 0 {
+			meta.Width, meta.Height = stream.Width, stream.Height
+			break
+		}
+	}
+	return meta, nil
+}
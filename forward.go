@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Returns the ContextInfo of a message, nil if it has none
+func messageContextInfo(msg *waProto.Message) *waProto.ContextInfo {
+	switch {
+	case msg.ExtendedTextMessage != nil:
+		return msg.ExtendedTextMessage.ContextInfo
+	case msg.ImageMessage != nil:
+		return msg.ImageMessage.ContextInfo
+	case msg.AudioMessage != nil:
+		return msg.AudioMessage.ContextInfo
+	case msg.DocumentMessage != nil:
+		return msg.DocumentMessage.ContextInfo
+	case msg.VideoMessage != nil:
+		return msg.VideoMessage.ContextInfo
+	case msg.StickerMessage != nil:
+		return msg.StickerMessage.ContextInfo
+	case msg.LocationMessage != nil:
+		return msg.LocationMessage.ContextInfo
+	case msg.ContactMessage != nil:
+		return msg.ContactMessage.ContextInfo
+	case msg.ButtonsMessage != nil:
+		return msg.ButtonsMessage.ContextInfo
+	case msg.ListMessage != nil:
+		return msg.ListMessage.ContextInfo
+	case msg.PollCreationMessage != nil:
+		return msg.PollCreationMessage.ContextInfo
+	}
+	return nil
+}
+
+// Copy of a message to be forwarded, flagged as forwarded with its forwarding score increased.
+// Media keep their upload references so they are not downloaded and uploaded again
+func forwardedMessage(msg *waProto.Message) (*waProto.Message, error) {
+	if msg.ViewOnceMessage != nil || msg.ViewOnceMessageV2 != nil || msg.ViewOnceMessageV2Extension != nil {
+		return nil, badRequest("View once messages can not be forwarded")
+	}
+	forwarded := proto.Clone(msg).(*waProto.Message)
+	// Plain texts can't carry a ContextInfo
+	if forwarded.Conversation != nil {
+		forwarded.ExtendedTextMessage = &waProto.ExtendedTextMessage{Text: forwarded.Conversation}
+		forwarded.Conversation = nil
+	}
+	// The message secret belongs to the original message
+	forwarded.MessageContextInfo = nil
+
+	score := messageContextInfo(msg).GetForwardingScore() + 1
+	info := &waProto.ContextInfo{IsForwarded: proto.Bool(true), ForwardingScore: proto.Uint32(score)}
+	if err := applyContextInfo(forwarded, info); err != nil {
+		return nil, badRequest("This message type can not be forwarded")
+	}
+	return forwarded, nil
+}
+
+// Prepares a forward of msg to a destination, to be sent with send()
+func prepareForward(db *sql.DB, userid int, to string, msg *waProto.Message, options sendOptions) (*preparedMessage, error) {
+	client := getClient(userid)
+	if client == nil {
+		return nil, errors.New("No session")
+	}
+	recipient, ok := parseJID(to)
+	if !ok {
+		return nil, badRequest("Could not parse To")
+	}
+	forwarded, err := forwardedMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	if forwarded.PollCreationMessage != nil {
+		// Votes are encrypted with the poll secret, a forwarded poll needs its own
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		forwarded.MessageContextInfo = &waProto.MessageContextInfo{MessageSecret: secret}
+	}
+	if timer := getDisappearingTimer(db, client, userid, recipient); timer > 0 {
+		applyDisappearingTimer(forwarded, timer)
+	}
+	msgid := options.Id
+	if msgid == "" {
+		msgid = whatsmeow.GenerateMessageID()
+	} else if !validMessageID(msgid) {
+		return nil, badRequest("Invalid Id, must be up to 64 letters and digits")
+	}
+	req := &sendRequest{Type: "forward", To: to, Options: options}
+	return &preparedMessage{client: client, db: db, userid: userid, req: req, recipient: recipient, id: msgid, msg: forwarded}, nil
+}
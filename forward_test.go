@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestForwardedMessageViewOnce(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *waProto.Message
+		ok   bool
+	}{
+		{"text", &waProto.Message{Conversation: proto.String("hello")}, true},
+		{"view once", &waProto.Message{ViewOnceMessage: &waProto.FutureProofMessage{}}, false},
+		{"view once v2", &waProto.Message{ViewOnceMessageV2: &waProto.FutureProofMessage{}}, false},
+		{"view once v2 extension", &waProto.Message{ViewOnceMessageV2Extension: &waProto.FutureProofMessage{}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := forwardedMessage(tt.msg)
+			if (err == nil) != tt.ok {
+				t.Errorf("forwardedMessage() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -12,6 +12,8 @@ require (
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/vincent-petithory/dataurl v1.0.0
 	go.mau.fi/whatsmeow v0.0.0-20230621213630-12cd3cdb2257
+	golang.org/x/image v0.18.0
+	golang.org/x/net v0.10.0
 	google.golang.org/protobuf v1.31.0
 	modernc.org/sqlite v1.22.1
 )
@@ -29,7 +31,6 @@ require (
 	go.mau.fi/libsignal v0.1.0 // indirect
 	golang.org/x/crypto v0.10.0 // indirect
 	golang.org/x/mod v0.10.0 // indirect
-	golang.org/x/net v0.10.0 // indirect
 	golang.org/x/sys v0.9.0 // indirect
 	golang.org/x/tools v0.8.0 // indirect
 	lukechampine.com/uint128 v1.3.0 // indirect
@@ -6,12 +6,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/patrickmn/go-cache"
 	"github.com/vincent-petithory/dataurl"
 	"go.mau.fi/whatsmeow"
@@ -28,7 +33,7 @@ func (v Values) Get(key string) string {
 	return v.m[key]
 }
 
-var messageTypes = []string{"Message", "ReadReceipt", "Presence", "HistorySync", "ChatPresence", "All"}
+var messageTypes = []string{"Message", "MessageEdit", "MessageRevoke", "PollVote", "Status", "ScheduledMessage", "SendStatus", "ReadReceipt", "Presence", "HistorySync", "ChatPresence", "All"}
 
 func (s *server) authalice(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -171,7 +176,7 @@ func (s *server) Connect() http.HandlerFunc {
 			return
 		}
 
-		if clientPointer[userid] != nil {
+		if getClient(userid) != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("Already Connected"))
 			return
 		} else {
@@ -209,8 +214,8 @@ func (s *server) Connect() http.HandlerFunc {
 				log.Warn().Msg("Waiting 10 seconds")
 				time.Sleep(10000 * time.Millisecond)
 
-				if clientPointer[userid] != nil {
-					if !clientPointer[userid].IsConnected() {
+				if getClient(userid) != nil {
+					if !getClient(userid).IsConnected() {
 						s.Respond(w, r, http.StatusInternalServerError, errors.New("Failed to Connect"))
 						return
 					}
@@ -242,12 +247,12 @@ func (s *server) Disconnect() http.HandlerFunc {
 		token := r.Context().Value("userinfo").(Values).Get("Token")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		if getClient(userid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
-		if clientPointer[userid].IsConnected() == true {
-			if clientPointer[userid].IsLoggedIn() == true {
+		if getClient(userid).IsConnected() == true {
+			if getClient(userid).IsLoggedIn() == true {
 				log.Info().Str("jid", jid).Msg("Disconnection successfull")
 				killchannel[userid] <- true
 				_, err := s.db.Exec("UPDATE users SET events=? WHERE id=?", "", userid)
@@ -358,49 +363,16 @@ func (s *server) SetWebhook() http.HandlerFunc {
 	}
 }
 
-// Gets QR code encoded in Base64
-func (s *server) GetQR() http.HandlerFunc {
+// Gets media handling policy for incoming messages
+func (s *server) GetMediaPolicy() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
-		code := ""
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		} else {
-			if clientPointer[userid].IsConnected() == false {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New("Not connected"))
-				return
-			}
-			rows, err := s.db.Query("SELECT qrcode AS code FROM users WHERE id=? LIMIT 1", userid)
-			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, err)
-				return
-			}
-			defer rows.Close()
-			for rows.Next() {
-				err = rows.Scan(&code)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, err)
-					return
-				}
-			}
-			err = rows.Err()
-			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, err)
-				return
-			}
-			if clientPointer[userid].IsLoggedIn() == true {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New("Already Loggedin"))
-				return
-			}
-		}
+		policy := getMediaPolicy(s.db, userid)
 
-		log.Info().Str("userid", txtid).Str("qrcode", code).Msg("Get QR successful")
-		response := map[string]interface{}{"QRCode": fmt.Sprintf("%s", code)}
-		responseJson, err := json.Marshal(response)
+		responseJson, err := json.Marshal(policy)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
@@ -410,43 +382,37 @@ func (s *server) GetQR() http.HandlerFunc {
 	}
 }
 
-// Logs out device from Whatsapp (requires to scan QR next time)
-func (s *server) Logout() http.HandlerFunc {
+// Sets media handling policy for incoming messages
+func (s *server) SetMediaPolicy() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		jid := r.Context().Value("userinfo").(Values).Get("Jid")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		decoder := json.NewDecoder(r.Body)
+		var t mediaPolicy
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
-		} else {
-			if clientPointer[userid].IsLoggedIn() == true && clientPointer[userid].IsConnected() == true {
-				err := clientPointer[userid].Logout()
-				if err != nil {
-					log.Error().Str("jid", jid).Msg("Could not perform logout")
-					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not perform logout"))
-					return
-				} else {
-					log.Info().Str("jid", jid).Msg("Logged out")
-					killchannel[userid] <- true
-				}
-			} else {
-				if clientPointer[userid].IsConnected() == true {
-					log.Warn().Str("jid", jid).Msg("Ignoring logout as it was not logged in")
-					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not disconnect as it was not logged in"))
-					return
-				} else {
-					log.Warn().Str("jid", jid).Msg("Ignoring logout as it was not connected")
-					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not disconnect as it was not connected"))
-					return
-				}
-			}
 		}
 
-		response := map[string]interface{}{"Details": "Logged out"}
-		responseJson, err := json.Marshal(response)
+		if t.Mode == "" {
+			t.Mode = "eager"
+		}
+		err = t.validate()
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		err = setUserSetting(s.db, userid, "mediapolicy", t)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not set media policy: %v", err)))
+			return
+		}
+
+		responseJson, err := json.Marshal(t)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
@@ -456,24 +422,16 @@ func (s *server) Logout() http.HandlerFunc {
 	}
 }
 
-// Gets Connected and LoggedIn Status
-func (s *server) GetStatus() http.HandlerFunc {
-
+// Gets outbound rate limits
+func (s *server) GetRateLimits() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
-
-		isConnected := clientPointer[userid].IsConnected()
-		isLoggedIn := clientPointer[userid].IsLoggedIn()
+		limits := getRateLimits(s.db, userid)
 
-		response := map[string]interface{}{"Connected": isConnected, "LoggedIn": isLoggedIn}
-		responseJson, err := json.Marshal(response)
+		responseJson, err := json.Marshal(limits)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
@@ -483,113 +441,54 @@ func (s *server) GetStatus() http.HandlerFunc {
 	}
 }
 
-// Sends a document/attachment message
-func (s *server) SendDocument() http.HandlerFunc {
-
-	type documentStruct struct {
-		Phone       string
-		Document    string
-		FileName    string
-		Id          string
-		ContextInfo waProto.ContextInfo
-	}
-
+// Sets outbound rate limits, applied to every message sent by the session
+func (s *server) SetRateLimits() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t documentStruct
+		var t rateLimits
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
-		}
-
-		if t.Document == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Document in Payload"))
-			return
-		}
-
-		if t.FileName == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing FileName in Payload"))
-			return
-		}
-
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaId, t.ContextInfo.Participant)
+		err = t.validate()
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
 			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
+		err = setUserSetting(s.db, userid, "ratelimit", t)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not set rate limits: %v", err)))
+			return
 		}
 
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
-
-		if t.Document[0:29] == "data:application/octet-stream" {
-			dataURL, err := dataurl.DecodeString(t.Document)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaDocument)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
-			}
+		responseJson, err := json.Marshal(t)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Document data should start with \"data:application/octet-stream;base64,\""))
-			return
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+		return
+	}
+}
 
-		msg := &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
-			Url:           proto.String(uploaded.URL),
-			FileName:      &t.FileName,
-			DirectPath:    proto.String(uploaded.DirectPath),
-			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(filedata)),
-			FileEncSha256: uploaded.FileEncSHA256,
-			FileSha256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-		}}
+// Gets webhook dispatch settings and queue statistics
+func (s *server) GetWebhookDispatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-		if t.ContextInfo.StanzaId != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaId:      proto.String(*t.ContextInfo.StanzaId),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
-		}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
-		}
+		settings := getDispatchSettings(s.db, userid)
+		stats := getDispatcher(s.db, userid).stats()
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := map[string]interface{}{"Concurrency": settings.Concurrency, "OnFull": settings.OnFull, "Stats": stats}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -600,113 +499,58 @@ func (s *server) SendDocument() http.HandlerFunc {
 	}
 }
 
-// Sends an audio message
-func (s *server) SendAudio() http.HandlerFunc {
-
-	type audioStruct struct {
-		Phone       string
-		Audio       string
-		Caption     string
-		Id          string
-		ContextInfo waProto.ContextInfo
-	}
-
+// Sets webhook dispatch settings
+func (s *server) SetWebhookDispatch() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t audioStruct
+		var t dispatchSettings
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		if t.Concurrency < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Concurrency must be at least 1"))
 			return
 		}
 
-		if t.Audio == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Audio in Payload"))
+		if t.OnFull != "" && t.OnFull != "wait" && t.OnFull != "drop" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("OnFull must be wait or drop"))
 			return
 		}
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaId, t.ContextInfo.Participant)
+		err = setUserSetting(s.db, userid, "webhookdispatch", t)
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not set webhook dispatch: %v", err)))
 			return
 		}
+		getDispatcher(s.db, userid).configure(t)
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
-		}
-
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
-
-		if t.Audio[0:14] == "data:audio/ogg" {
-			dataURL, err := dataurl.DecodeString(t.Audio)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaAudio)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
-			}
+		responseJson, err := json.Marshal(t)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Audio data should start with \"data:audio/ogg;base64,\""))
-			return
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+		return
+	}
+}
 
-		ptt := true
-		mime := "audio/ogg; codecs=opus"
-
-		msg := &waProto.Message{AudioMessage: &waProto.AudioMessage{
-			Url:        proto.String(uploaded.URL),
-			DirectPath: proto.String(uploaded.DirectPath),
-			MediaKey:   uploaded.MediaKey,
-			//Mimetype:      proto.String(http.DetectContentType(filedata)),
-			Mimetype:      &mime,
-			FileEncSha256: uploaded.FileEncSHA256,
-			FileSha256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			Ptt:           &ptt,
-		}}
+// Gets webhook template
+func (s *server) GetWebhookTemplate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-		if t.ContextInfo.StanzaId != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaId:      proto.String(*t.ContextInfo.StanzaId),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
-		}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
-		}
+		tmpl := getWebhookTemplate(s.db, userid)
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
+		responseJson, err := json.Marshal(tmpl)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
@@ -716,109 +560,39 @@ func (s *server) SendAudio() http.HandlerFunc {
 	}
 }
 
-// Sends an Image message
-func (s *server) SendImage() http.HandlerFunc {
-
-	type imageStruct struct {
-		Phone       string
-		Image       string
-		Caption     string
-		Id          string
-		ContextInfo waProto.ContextInfo
-	}
-
+// Sets webhook template used to render custom webhook requests
+func (s *server) SetWebhookTemplate() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t imageStruct
+		var t webhookTemplate
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
-		}
-
-		if t.Image == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Image in Payload"))
+		if t.Enabled && t.Body == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
 			return
 		}
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaId, t.ContextInfo.Participant)
+		err = t.validate()
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
 			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
-		}
-
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
-
-		if t.Image[0:10] == "data:image" {
-			dataURL, err := dataurl.DecodeString(t.Image)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaImage)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
-			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Image data should start with \"data:image/png;base64,\""))
-			return
-		}
-
-		msg := &waProto.Message{ImageMessage: &waProto.ImageMessage{
-			Caption:       proto.String(t.Caption),
-			Url:           proto.String(uploaded.URL),
-			DirectPath:    proto.String(uploaded.DirectPath),
-			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(filedata)),
-			FileEncSha256: uploaded.FileEncSHA256,
-			FileSha256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-		}}
-
-		if t.ContextInfo.StanzaId != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaId:      proto.String(*t.ContextInfo.StanzaId),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
-		}
-
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg)
+		err = setUserSetting(s.db, userid, "webhooktemplate", t)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not set webhook template: %v", err)))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
+		responseJson, err := json.Marshal(t)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
@@ -828,109 +602,125 @@ func (s *server) SendImage() http.HandlerFunc {
 	}
 }
 
-// Sends Sticker message
-func (s *server) SendSticker() http.HandlerFunc {
+// Renders a webhook template against a sample or given event without sending it
+func (s *server) PreviewWebhook() http.HandlerFunc {
 
-	type stickerStruct struct {
-		Phone        string
-		Sticker      string
-		Id           string
-		PngThumbnail []byte
-		ContextInfo  waProto.ContextInfo
+	type previewStruct struct {
+		Template *webhookTemplate
+		Type     string
+		Event    json.RawMessage
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		webhook := r.Context().Value("userinfo").(Values).Get("Webhook")
+		token := r.Context().Value("userinfo").(Values).Get("Token")
 		userid, _ := strconv.Atoi(txtid)
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t stickerStruct
+		var t previewStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		var tmpl webhookTemplate
+		if t.Template != nil {
+			tmpl = *t.Template
+		} else {
+			tmpl = getWebhookTemplate(s.db, userid)
+		}
+
+		err = tmpl.validate()
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		if t.Sticker == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Sticker in Payload"))
+		event := []byte(t.Event)
+		if len(event) == 0 {
+			if t.Type == "" {
+				t.Type = "Message"
+			}
+			sample, ok := sampleWebhookEvents[t.Type]
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("No sample event for Type %s", t.Type)))
+				return
+			}
+			event = []byte(sample)
+		}
+
+		postmap := make(map[string]interface{})
+		err = json.Unmarshal(event, &postmap)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Event"))
 			return
 		}
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaId, t.ContextInfo.Participant)
+		rendered, err := tmpl.render(webhook, postmap, token)
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
 			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
+		responseJson, err := json.Marshal(rendered)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			msgid = t.Id
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+		return
+	}
+}
 
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
+// Sends a synthetic event to the webhook and reports the result
+func (s *server) TestWebhook() http.HandlerFunc {
+
+	type testStruct struct {
+		Type string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		webhook := r.Context().Value("userinfo").(Values).Get("Webhook")
+		token := r.Context().Value("userinfo").(Values).Get("Token")
+		userid, _ := strconv.Atoi(txtid)
 
-		if t.Sticker[0:4] == "data" {
-			dataURL, err := dataurl.DecodeString(t.Sticker)
+		var t testStruct
+		if r.ContentLength != 0 {
+			decoder := json.NewDecoder(r.Body)
+			err := decoder.Decode(&t)
 			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaImage)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
 			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Data should start with \"data:mime/type;base64,\""))
-			return
 		}
 
-		msg := &waProto.Message{StickerMessage: &waProto.StickerMessage{
-			Url:           proto.String(uploaded.URL),
-			DirectPath:    proto.String(uploaded.DirectPath),
-			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(filedata)),
-			FileEncSha256: uploaded.FileEncSHA256,
-			FileSha256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			PngThumbnail:  t.PngThumbnail,
-		}}
+		// Only the configured webhook is tested, so this can't be used to probe arbitrary addresses
+		if webhook == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("No webhook set"))
+			return
+		}
 
-		if t.ContextInfo.StanzaId != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaId:      proto.String(*t.ContextInfo.StanzaId),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+		postmap := map[string]interface{}{"type": "Test", "event": map[string]interface{}{"Details": "Test event sent from WuzAPI", "Timestamp": time.Now()}}
+		if t.Type != "" {
+			sample, ok := sampleWebhookEvents[t.Type]
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("No sample event for Type %s", t.Type)))
+				return
 			}
+			postmap = make(map[string]interface{})
+			json.Unmarshal([]byte(sample), &postmap)
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
-		}
+		resp, err := postWebhook(s.db, userid, token, webhook, postmap, "")
+		record := newDeliveryRecord("Test", webhook, 1, resp, err)
+		logDelivery(userid, record)
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
+		responseJson, err := json.Marshal(record)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
@@ -940,110 +730,175 @@ func (s *server) SendSticker() http.HandlerFunc {
 	}
 }
 
-// Sends Video message
-func (s *server) SendVideo() http.HandlerFunc {
+// Lists recent webhook delivery attempts
+func (s *server) GetWebhookDeliveries() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-	type imageStruct struct {
-		Phone         string
-		Video         string
-		Caption       string
-		Id            string
-		JpegThumbnail []byte
-		ContextInfo   waProto.ContextInfo
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		deliveries := getDeliveries(userid, r.URL.Query().Get("type"), limit)
+
+		response := map[string]interface{}{"Deliveries": deliveries}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
 	}
+}
 
+// Serves media from a received message using a signed link, downloading it on first access
+func (s *server) GetMedia() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
-		msgid := ""
-		var resp whatsmeow.SendResponse
+		msgid := mux.Vars(r)["messageId"]
+		userid, _ := strconv.Atoi(r.URL.Query().Get("user"))
+		expires, _ := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		if userid == 0 || !checkMediaLink(userid, msgid, expires, r.URL.Query().Get("sig")) {
+			s.Respond(w, r, http.StatusUnauthorized, errors.New("Invalid or expired link"))
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
-		var t imageStruct
-		err := decoder.Decode(&t)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+		stored, err := getStoredMessage(s.db, userid, msgid)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Message not found"))
+			return
+		} else if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		media := getMediaInfo(stored.Message)
+		if media == nil {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Message has no media"))
 			return
 		}
 
-		if t.Video == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Video in Payload"))
+		if getMediaPolicy(s.db, userid).modeFor(media) == "off" {
+			s.Respond(w, r, http.StatusForbidden, errors.New("Media download disabled by policy"))
 			return
 		}
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaId, t.ContextInfo.Participant)
+		path, err := downloadMedia(getClient(userid), s.exPath, userid, msgid, media)
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
+			log.Error().Err(err).Str("id", msgid).Msg("Failed to download media")
+			s.Respond(w, r, http.StatusBadGateway, err)
 			return
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
+		file, err := os.Open(path)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		defer file.Close()
+		stat, err := file.Stat()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
 		}
 
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
+		w.Header().Set("Content-Type", media.Mimetype)
+		if media.FileName != "" {
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": media.FileName}))
+		}
+		http.ServeContent(w, r, filepath.Base(path), stat.ModTime(), file)
+	}
+}
+
+// Gets QR code encoded in Base64
+func (s *server) GetQR() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		code := ""
 
-		if t.Video[0:4] == "data" {
-			dataURL, err := dataurl.DecodeString(t.Video)
+		if getClient(userid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		} else {
+			if getClient(userid).IsConnected() == false {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Not connected"))
+				return
+			}
+			rows, err := s.db.Query("SELECT qrcode AS code FROM users WHERE id=? LIMIT 1", userid)
 			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+				s.Respond(w, r, http.StatusInternalServerError, err)
 				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaVideo)
+			}
+			defer rows.Close()
+			for rows.Next() {
+				err = rows.Scan(&code)
 				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
+					s.Respond(w, r, http.StatusInternalServerError, err)
 					return
 				}
 			}
+			err = rows.Err()
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			if getClient(userid).IsLoggedIn() == true {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Already Loggedin"))
+				return
+			}
+		}
+
+		log.Info().Str("userid", txtid).Str("qrcode", code).Msg("Get QR successful")
+		response := map[string]interface{}{"QRCode": fmt.Sprintf("%s", code)}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Data should start with \"data:mime/type;base64,\""))
-			return
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+		return
+	}
+}
 
-		msg := &waProto.Message{VideoMessage: &waProto.VideoMessage{
-			Caption:       proto.String(t.Caption),
-			Url:           proto.String(uploaded.URL),
-			DirectPath:    proto.String(uploaded.DirectPath),
-			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(filedata)),
-			FileEncSha256: uploaded.FileEncSHA256,
-			FileSha256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			JpegThumbnail: t.JpegThumbnail,
-		}}
+// Logs out device from Whatsapp (requires to scan QR next time)
+func (s *server) Logout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-		if t.ContextInfo.StanzaId != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaId:      proto.String(*t.ContextInfo.StanzaId),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
-		}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		jid := r.Context().Value("userinfo").(Values).Get("Jid")
+		userid, _ := strconv.Atoi(txtid)
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+		if getClient(userid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
+		} else {
+			if getClient(userid).IsLoggedIn() == true && getClient(userid).IsConnected() == true {
+				err := getClient(userid).Logout()
+				if err != nil {
+					log.Error().Str("jid", jid).Msg("Could not perform logout")
+					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not perform logout"))
+					return
+				} else {
+					log.Info().Str("jid", jid).Msg("Logged out")
+					killchannel[userid] <- true
+				}
+			} else {
+				if getClient(userid).IsConnected() == true {
+					log.Warn().Str("jid", jid).Msg("Ignoring logout as it was not logged in")
+					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not disconnect as it was not logged in"))
+					return
+				} else {
+					log.Warn().Str("jid", jid).Msg("Ignoring logout as it was not connected")
+					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not disconnect as it was not connected"))
+					return
+				}
+			}
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := map[string]interface{}{"Details": "Logged out"}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1054,104 +909,76 @@ func (s *server) SendVideo() http.HandlerFunc {
 	}
 }
 
-// Sends Contact
-func (s *server) SendContact() http.HandlerFunc {
-
-	type contactStruct struct {
-		Phone       string
-		Id          string
-		Name        string
-		Vcard       string
-		ContextInfo waProto.ContextInfo
-	}
+// Gets Connected and LoggedIn Status
+func (s *server) GetStatus() http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		if getClient(userid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
+		isConnected := getClient(userid).IsConnected()
+		isLoggedIn := getClient(userid).IsLoggedIn()
 
-		decoder := json.NewDecoder(r.Body)
-		var t contactStruct
-		err := decoder.Decode(&t)
+		response := map[string]interface{}{"Connected": isConnected, "LoggedIn": isLoggedIn}
+		responseJson, err := json.Marshal(response)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
-			return
-		}
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
-		}
-		if t.Name == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
-			return
-		}
-		if t.Vcard == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Vcard in Payload"))
-			return
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+		return
+	}
+}
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaId, t.ContextInfo.Participant)
+// Sends any message type through the shared send pipeline
+func (s *server) SendChat() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		body, file, err := readSendPayload(r)
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
 			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
+		defer file.remove()
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
+		var t sendRequest
+		err = json.Unmarshal(body, &t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
 		}
+		t.file = file
 
-		msg := &waProto.Message{ContactMessage: &waProto.ContactMessage{
-			DisplayName: &t.Name,
-			Vcard:       &t.Vcard,
-		}}
-
-		if t.ContextInfo.StanzaId != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaId:      proto.String(*t.ContextInfo.StanzaId),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
+		if t.Type == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Type in Payload"))
+			return
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+		if t.To == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing To in Payload"))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
-		}
+		s.respondSend(w, r, userid, &t, body)
 		return
 	}
 }
 
-// Sends location
-func (s *server) SendLocation() http.HandlerFunc {
+// Adapter for the per type send endpoints, whose payload has the content fields next to Phone, Id and ContextInfo
+func (s *server) sendLegacy(msgtype string) http.HandlerFunc {
 
-	type locationStruct struct {
-		Phone       string
-		Id          string
-		Name        string
-		Latitude    float64
-		Longitude   float64
-		ContextInfo waProto.ContextInfo
+	type legacyStruct struct {
+		Phone string
+		sendOptions
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1159,92 +986,149 @@ func (s *server) SendLocation() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		body, file, err := readSendPayload(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
+		defer file.remove()
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
-		decoder := json.NewDecoder(r.Body)
-		var t locationStruct
-		err := decoder.Decode(&t)
+		var t legacyStruct
+		err = json.Unmarshal(body, &t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
+
 		if t.Phone == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
 			return
 		}
-		if t.Latitude == 0 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Latitude in Payload"))
-			return
-		}
-		if t.Longitude == 0 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Longitude in Payload"))
-			return
-		}
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaId, t.ContextInfo.Participant)
+		req := &sendRequest{Type: msgtype, To: t.Phone, Content: body, Options: t.sendOptions, file: file}
+		s.respondSend(w, r, userid, req, body)
+		return
+	}
+}
+
+// Reads a send request as JSON. Multipart requests are converted to the equivalent JSON payload
+func readSendPayload(r *http.Request) ([]byte, *uploadedFile, error) {
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediatype != "multipart/form-data" {
+		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
-			return
+			return nil, nil, errors.New("Could not decode Payload")
 		}
+		return body, nil, nil
+	}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
+	fields, file, err := readMultipart(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload := make(map[string]interface{})
+	for name, value := range fields {
+		if jsonFields[name] {
+			payload[name] = json.RawMessage(value)
 		} else {
-			msgid = t.Id
+			payload[name] = value
 		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, nil, errors.New("Could not decode Payload")
+	}
+	return body, file, nil
+}
 
-		msg := &waProto.Message{LocationMessage: &waProto.LocationMessage{
-			DegreesLatitude:  &t.Latitude,
-			DegreesLongitude: &t.Longitude,
-			Name:             &t.Name,
-		}}
+// Sends a message and writes the API response. Requests with an Idempotency-Key header
+// get the stored response of a previous successful send with the same key
+func (s *server) respondSend(w http.ResponseWriter, r *http.Request, userid int, req *sendRequest, payload []byte) {
+	key := r.Header.Get("Idempotency-Key")
+	hash := idempotencyHash(payload, req.file)
+	if key != "" {
+		if !lockIdempotencyKey(userid, key) {
+			s.Respond(w, r, http.StatusConflict, errors.New("A request with this Idempotency-Key is in progress"))
+			return
+		}
+		defer unlockIdempotencyKey(userid, key)
 
-		if t.ContextInfo.StanzaId != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaId:      proto.String(*t.ContextInfo.StanzaId),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+		storedhash, response, err := getIdempotentResponse(s.db, userid, key)
+		if err == nil {
+			if storedhash != hash {
+				s.Respond(w, r, http.StatusUnprocessableEntity, errors.New("Idempotency-Key was already used with a different payload"))
+				return
 			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			s.Respond(w, r, http.StatusOK, response)
+			return
+		} else if err != sql.ErrNoRows {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
 		}
+	}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg)
+	var response map[string]interface{}
+	status := http.StatusOK
+	if req.Options.Queue {
+		// Queued messages are sent by the queue once the session is connected
+		qm, err := queueMessage(s.db, userid, req)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.respondSendError(w, r, err)
 			return
 		}
-
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
+		response = map[string]interface{}{"Details": "Queued", "Id": qm.MessageId, "QueueId": qm.Id, "Expires": qm.Expires}
+		status = http.StatusAccepted
+	} else if req.Options.Simulate != nil && !req.Options.Simulate.Wait {
+		// Simulated sends take a while, the message is built now and sent in the background
+		p, err := prepareMessage(s.db, userid, req)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
+			s.respondSendError(w, r, err)
+			return
+		}
+		sendInBackground(p)
+		response = map[string]interface{}{"Details": "Queued", "Id": p.id}
+		status = http.StatusAccepted
+	} else {
+		result, err := sendMessage(s.db, userid, req)
+		if err != nil {
+			s.respondSendError(w, r, err)
+			return
 		}
+		response = map[string]interface{}{"Details": "Sent", "Timestamp": result.Timestamp, "Id": result.Id}
+	}
+
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		s.Respond(w, r, http.StatusInternalServerError, err)
 		return
 	}
+	if key != "" {
+		saveIdempotentResponse(s.db, userid, key, hash, string(responseJson))
+	}
+	s.Respond(w, r, status, string(responseJson))
 }
 
-// Sends Buttons (not implemented, does not work)
+// Answers with the status of a send error, 500 unless it is a sendError
+func (s *server) respondSendError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	var serr *sendError
+	if errors.As(err, &serr) {
+		status = serr.Status
+		if serr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(serr.RetryAfter.Seconds()))))
+		}
+	}
+	s.Respond(w, r, status, err)
+}
 
-func (s *server) SendButtons() http.HandlerFunc {
+// Schedules a message for later delivery, the payload is the same as /chat/send plus SendAt and Timezone
+func (s *server) ScheduleMessage() http.HandlerFunc {
 
-	type buttonStruct struct {
-		ButtonId   string
-		ButtonText string
-	}
-	type textStruct struct {
-		Phone   string
-		Title   string
-		Buttons []buttonStruct
-		Id      string
+	type scheduleStruct struct {
+		sendRequest
+		SendAt   string
+		Timezone string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1252,82 +1136,67 @@ func (s *server) SendButtons() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
-
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
 		decoder := json.NewDecoder(r.Body)
-		var t textStruct
+		var t scheduleStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		if t.SendAt == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing SendAt in Payload"))
 			return
 		}
 
-		if t.Title == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Title in Payload"))
+		sendAt, err := parseSendAt(t.SendAt, t.Timezone)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
-
-		if len(t.Buttons) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Buttons in Payload"))
+		if sendAt.Before(time.Now()) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("SendAt must be in the future"))
 			return
 		}
-		if len(t.Buttons) > 3 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("buttons cant more than 3"))
+
+		err = validateSendRequest(&t.sendRequest)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		recipient, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+		sm, err := scheduleMessage(s.db, userid, &t.sendRequest, sendAt, t.Timezone)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
+		log.Info().Int64("id", sm.Id).Str("sendAt", sm.SendAt.String()).Msg("Message scheduled")
+		response := map[string]interface{}{"Details": "Scheduled", "Id": sm.Id, "MessageId": sm.MessageId, "SendAt": sm.SendAt}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			msgid = t.Id
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+		return
+	}
+}
 
-		var buttons []*waProto.ButtonsMessage_Button
-
-		for _, item := range t.Buttons {
-			buttons = append(buttons, &waProto.ButtonsMessage_Button{
-				ButtonId:       proto.String(item.ButtonId),
-				ButtonText:     &waProto.ButtonsMessage_Button_ButtonText{DisplayText: proto.String(item.ButtonText)},
-				Type:           waProto.ButtonsMessage_Button_RESPONSE.Enum(),
-				NativeFlowInfo: &waProto.ButtonsMessage_Button_NativeFlowInfo{},
-			})
-		}
+// Lists scheduled messages, optionally filtered by status
+func (s *server) ListScheduledMessages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-		msg2 := &waProto.ButtonsMessage{
-			ContentText: proto.String(t.Title),
-			HeaderType:  waProto.ButtonsMessage_EMPTY.Enum(),
-			Buttons:     buttons,
-		}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, &waProto.Message{ViewOnceMessage: &waProto.FutureProofMessage{
-			Message: &waProto.Message{
-				ButtonsMessage: msg2,
-			},
-		}})
+		list, err := listScheduledMessages(s.db, userid, r.URL.Query().Get("status"))
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := map[string]interface{}{"Scheduled": list}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1338,29 +1207,35 @@ func (s *server) SendButtons() http.HandlerFunc {
 	}
 }
 
-// SendList
-// https://github.com/tulir/whatsmeow/issues/305
-func (s *server) SendList() http.HandlerFunc {
+// Lists the messages of the outbound queue, optionally filtered by status
+func (s *server) ListQueuedMessages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-	type rowsStruct struct {
-		RowId       string
-		Title       string
-		Description string
-	}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		list, err := listQueuedMessages(s.db, userid, r.URL.Query().Get("status"))
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
 
-	type sectionsStruct struct {
-		Title string
-		Rows  []rowsStruct
+		response := map[string]interface{}{"Queue": list}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
 	}
+}
 
-	type listStruct struct {
-		Phone       string
-		Title       string
-		Description string
-		ButtonText  string
-		FooterText  string
-		Sections    []sectionsStruct
-		Id          string
+// Cancels a message waiting in the outbound queue
+func (s *server) CancelQueuedMessage() http.HandlerFunc {
+
+	type cancelStruct struct {
+		Id int64
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1368,107 +1243,76 @@ func (s *server) SendList() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
-			return
-		}
-
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
 		decoder := json.NewDecoder(r.Body)
-		var t listStruct
+		var t cancelStruct
 		err := decoder.Decode(&t)
-		marshal, _ := json.Marshal(t)
-		fmt.Println(string(marshal))
 		if err != nil {
-			fmt.Println(err)
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
+		if t.Id == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
 			return
 		}
 
-		if t.Title == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Title in Payload"))
+		cancelled, err := cancelQueuedMessage(s.db, userid, t.Id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
-
-		if t.Description == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Description in Payload"))
+		if !cancelled {
+			s.Respond(w, r, http.StatusNotFound, errors.New("No queued message with this Id"))
 			return
 		}
 
-		if t.ButtonText == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing ButtonText in Payload"))
-			return
+		response := map[string]interface{}{"Details": "Cancelled", "Id": t.Id}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+		return
+	}
+}
 
-		if len(t.Sections) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Sections in Payload"))
-			return
-		}
-		recipient, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Phone"))
-			return
-		}
+// Cancels a pending scheduled message
+func (s *server) CancelScheduledMessage() http.HandlerFunc {
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
-		}
+	type cancelStruct struct {
+		Id int64
+	}
 
-		var sections []*waProto.ListMessage_Section
+	return func(w http.ResponseWriter, r *http.Request) {
 
-		for _, item := range t.Sections {
-			var rows []*waProto.ListMessage_Row
-			id := 1
-			for _, row := range item.Rows {
-				var idtext string
-				if row.RowId == "" {
-					idtext = strconv.Itoa(id)
-				} else {
-					idtext = row.RowId
-				}
-				rows = append(rows, &waProto.ListMessage_Row{
-					RowId:       proto.String(idtext),
-					Title:       proto.String(row.Title),
-					Description: proto.String(row.Description),
-				})
-			}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-			sections = append(sections, &waProto.ListMessage_Section{
-				Title: proto.String(item.Title),
-				Rows:  rows,
-			})
+		decoder := json.NewDecoder(r.Body)
+		var t cancelStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
 		}
-		msg1 := &waProto.ListMessage{
-			Title:       proto.String(t.Title),
-			Description: proto.String(t.Description),
-			ButtonText:  proto.String(t.ButtonText),
-			ListType:    waProto.ListMessage_SINGLE_SELECT.Enum(),
-			Sections:    sections,
-			FooterText:  proto.String(t.FooterText),
+
+		if t.Id == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
+			return
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, &waProto.Message{
-			ViewOnceMessage: &waProto.FutureProofMessage{
-				Message: &waProto.Message{
-					ListMessage: msg1,
-				},
-			}})
+		cancelled, err := cancelScheduledMessage(s.db, userid, t.Id)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if !cancelled {
+			s.Respond(w, r, http.StatusNotFound, errors.New("No pending scheduled message with this Id"))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := map[string]interface{}{"Details": "Cancelled", "Id": t.Id}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1479,14 +1323,16 @@ func (s *server) SendList() http.HandlerFunc {
 	}
 }
 
-// Sends a regular text message
-func (s *server) SendMessage() http.HandlerFunc {
+// Creates a campaign sending the same message to a list of recipients, with per recipient variables
+func (s *server) CreateCampaign() http.HandlerFunc {
 
-	type textStruct struct {
-		Phone       string
-		Body        string
-		Id          string
-		ContextInfo waProto.ContextInfo
+	type campaignStruct struct {
+		Name       string
+		Type       string
+		Content    json.RawMessage
+		Options    sendOptions
+		Interval   float64
+		Recipients []campaignRecipient
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1494,98 +1340,118 @@ func (s *server) SendMessage() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
-
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
 		decoder := json.NewDecoder(r.Body)
-		var t textStruct
+		var t campaignStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		c := &campaign{Name: t.Name, Type: t.Type, Content: t.Content, Options: t.Options, Interval: t.Interval}
+		err = validateCampaign(c, t.Recipients)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		if t.Body == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
+		err = createCampaign(s.db, userid, c, t.Recipients)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaId, t.ContextInfo.Participant)
+		log.Info().Int64("id", c.Id).Int("recipients", len(t.Recipients)).Msg("Campaign created")
+		response := map[string]interface{}{"Details": "Created", "Id": c.Id, "Recipients": len(t.Recipients)}
+		responseJson, err := json.Marshal(response)
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
-			return
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Lists campaigns, or gets one campaign with recipient counts per status if id is set
+func (s *server) GetCampaigns() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		var response map[string]interface{}
+		if r.URL.Query().Get("id") != "" {
+			id, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+			c, err := getCampaign(s.db, userid, id)
+			if err == sql.ErrNoRows {
+				s.Respond(w, r, http.StatusNotFound, errors.New("Campaign not found"))
+				return
+			}
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			response = map[string]interface{}{"Campaign": c}
+		} else {
+			list, err := listCampaigns(s.db, userid)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			response = map[string]interface{}{"Campaigns": list}
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			msgid = t.Id
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+		return
+	}
+}
 
-		//	msg := &waProto.Message{Conversation: &t.Body}
+// Lists the recipients of a campaign with their delivery state, optionally filtered by status
+func (s *server) GetCampaignRecipients() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-		msg := &waProto.Message{
-			ExtendedTextMessage: &waProto.ExtendedTextMessage{
-				Text: &t.Body,
-			},
-		}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-		if t.ContextInfo.StanzaId != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaId:      proto.String(*t.ContextInfo.StanzaId),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
+		id, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		_, err := getCampaign(s.db, userid, id)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Campaign not found"))
+			return
+		}
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg)
+		list, err := listCampaignRecipients(s.db, id, r.URL.Query().Get("status"))
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := map[string]interface{}{"Recipients": list}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
 		return
 	}
 }
 
-/*
-// Sends a Template message
-func (s *server) SendTemplate() http.HandlerFunc {
-
-	type buttonStruct struct {
-		DisplayText string
-		Id          string
-		Url         string
-		PhoneNumber string
-		Type        string
-	}
+// Pauses, resumes or cancels a campaign, status is the new status and from the statuses it can be changed from
+func (s *server) ChangeCampaign(status string, details string, from ...string) http.HandlerFunc {
 
-	type templateStruct struct {
-		Phone   string
-		Content string
-		Footer  string
-		Id      string
-		Buttons []buttonStruct
+	type changeStruct struct {
+		Id int64
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1593,130 +1459,137 @@ func (s *server) SendTemplate() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
-
-		msgid := ""
-		var resp whatsmeow.SendResponse
-//var ts time.Time
-
 		decoder := json.NewDecoder(r.Body)
-		var t templateStruct
+		var t changeStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		if t.Id == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
 			return
 		}
 
-		if t.Content == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Content in Payload"))
+		changed, err := setCampaignStatus(s.db, userid, t.Id, status, from...)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
-
-		if t.Footer == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Footer in Payload"))
+		if !changed {
+			s.Respond(w, r, http.StatusConflict, fmt.Errorf("No campaign with this Id is %s", strings.Join(from, " or ")))
 			return
 		}
 
-		if len(t.Buttons) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Buttons in Payload"))
-			return
+		log.Info().Int64("id", t.Id).Str("status", status).Msg("Campaign changed")
+		response := map[string]interface{}{"Details": details, "Id": t.Id}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+		return
+	}
+}
 
-		recipient, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
-			return
-		}
+// Sends a document/attachment message
+func (s *server) SendDocument() http.HandlerFunc {
+	return s.sendLegacy("document")
+}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
-		}
+// Sends an audio message
+func (s *server) SendAudio() http.HandlerFunc {
+	return s.sendLegacy("audio")
+}
 
-		var buttons []*waProto.HydratedTemplateButton
+// Sends an Image message
+func (s *server) SendImage() http.HandlerFunc {
+	return s.sendLegacy("image")
+}
 
-		id := 1
-		for _, item := range t.Buttons {
-			switch item.Type {
-			case "quickreply":
-				var idtext string
-				text := item.DisplayText
-				if item.Id == "" {
-					idtext = strconv.Itoa(id)
-				} else {
-					idtext = item.Id
-				}
-				buttons = append(buttons, &waProto.HydratedTemplateButton{
-					HydratedButton: &waProto.HydratedTemplateButton_QuickReplyButton{
-						QuickReplyButton: &waProto.HydratedQuickReplyButton{
-							DisplayText: &text,
-							Id:          proto.String(idtext),
-						},
-					},
-				})
-			case "url":
-				text := item.DisplayText
-				url := item.Url
-				buttons = append(buttons, &waProto.HydratedTemplateButton{
-					HydratedButton: &waProto.HydratedTemplateButton_UrlButton{
-						UrlButton: &waProto.HydratedURLButton{
-							DisplayText: &text,
-							Url:         &url,
-						},
-					},
-				})
-			case "call":
-				text := item.DisplayText
-				phonenumber := item.PhoneNumber
-				buttons = append(buttons, &waProto.HydratedTemplateButton{
-					HydratedButton: &waProto.HydratedTemplateButton_CallButton{
-						CallButton: &waProto.HydratedCallButton{
-							DisplayText: &text,
-							PhoneNumber: &phonenumber,
-						},
-					},
-				})
-			default:
-				text := item.DisplayText
-				buttons = append(buttons, &waProto.HydratedTemplateButton{
-					HydratedButton: &waProto.HydratedTemplateButton_QuickReplyButton{
-						QuickReplyButton: &waProto.HydratedQuickReplyButton{
-							DisplayText: &text,
-							Id:          proto.String(string(id)),
-						},
-					},
-				})
-			}
-			id++
+// Sends Sticker message
+func (s *server) SendSticker() http.HandlerFunc {
+	return s.sendLegacy("sticker")
+}
+
+// Sends Video message
+func (s *server) SendVideo() http.HandlerFunc {
+	return s.sendLegacy("video")
+}
+
+// Sends Contact
+func (s *server) SendContact() http.HandlerFunc {
+	return s.sendLegacy("contact")
+}
+
+// Sends location
+func (s *server) SendLocation() http.HandlerFunc {
+	return s.sendLegacy("location")
+}
+
+// Sends Buttons (not implemented, does not work)
+func (s *server) SendButtons() http.HandlerFunc {
+	return s.sendLegacy("buttons")
+}
+
+// SendList
+// https://github.com/tulir/whatsmeow/issues/305
+func (s *server) SendList() http.HandlerFunc {
+	return s.sendLegacy("list")
+}
+
+// Sends a regular text message
+func (s *server) SendMessage() http.HandlerFunc {
+	return s.sendLegacy("text")
+}
+
+// Sends a poll, votes are delivered as PollVote webhook events
+func (s *server) SendPoll() http.HandlerFunc {
+	return s.sendLegacy("poll")
+}
+
+// Creates or replaces a named message template, with {{name}} placeholders filled on send
+func (s *server) SaveTemplate() http.HandlerFunc {
+
+	type templateStruct struct {
+		Name    string
+		Type    string
+		Content json.RawMessage
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		decoder := json.NewDecoder(r.Body)
+		var t templateStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
 		}
 
-		msg := &waProto.Message{TemplateMessage: &waProto.TemplateMessage{
-			HydratedTemplate: &waProto.HydratedFourRowTemplate{
-				HydratedContentText: proto.String(t.Content),
-				HydratedFooterText:  proto.String(t.Footer),
-				HydratedButtons:     buttons,
-				TemplateId:          proto.String("1"),
-			},
-		},
+		tmpl := &messageTemplate{Name: t.Name, Type: t.Type, Content: t.Content}
+		err = validateTemplate(tmpl)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(),recipient, msg)
+		created, err := saveTemplate(s.db, userid, tmpl)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		details := "Updated"
+		if created {
+			details = "Created"
+		}
+		response := map[string]interface{}{"Details": details, "Template": tmpl}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1726,213 +1599,249 @@ func (s *server) SendTemplate() http.HandlerFunc {
 		return
 	}
 }
-*/
 
-func CreateAdminUser(db *sql.DB, token *string) {
-	tx, err := db.Begin()
-	if err != nil {
-		log.Fatal().Err(err).Msg("Could not begin transaction")
-		os.Exit(1)
-	}
-	defer tx.Rollback()
+// Lists templates, or gets one template if name is set
+func (s *server) GetTemplates() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-	rows, err := tx.Query("SELECT id FROM users WHERE name='admin' LIMIT 1")
-	if err != nil {
-		log.Fatal().Err(err).Msg("Could not query users table")
-		os.Exit(1)
-	}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-	if !rows.Next() {
-		sqlStmtInsert := fmt.Sprintf("INSERT INTO users (name, token) values ('admin', '%s')", *token)
-		_, err = tx.Exec(sqlStmtInsert)
-		if err != nil {
-			log.Fatal().Err(err).Msg("Could not insert admin user")
-			os.Exit(1)
+		var response map[string]interface{}
+		if name := r.URL.Query().Get("name"); name != "" {
+			tmpl, err := getTemplate(s.db, userid, name)
+			if err == sql.ErrNoRows {
+				s.Respond(w, r, http.StatusNotFound, errors.New("Template not found"))
+				return
+			}
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			response = map[string]interface{}{"Template": tmpl}
+		} else {
+			list, err := listTemplates(s.db, userid)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			response = map[string]interface{}{"Templates": list}
 		}
-	} else {
-		sqlStmtUpdate := fmt.Sprintf("UPDATE users SET token='%s' WHERE name='admin'", *token)
-		_, err = tx.Exec(sqlStmtUpdate)
+
+		responseJson, err := json.Marshal(response)
 		if err != nil {
-			log.Fatal().Err(err).Msg("Could not update admin user")
-			os.Exit(1)
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-	}
-
-	if err := tx.Commit(); err != nil {
-		log.Fatal().Err(err).Msg("Could not commit transaction")
-		os.Exit(1)
+		return
 	}
 }
 
-func (s *server) CreateUser() http.HandlerFunc {
-	type userStruct struct {
-		Name  string `json:"name" binding:"required"`
-		Token string `json:"token" binding:"required"`
+// Deletes a template
+func (s *server) DeleteTemplate() http.HandlerFunc {
+
+	type deleteStruct struct {
+		Name string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		decoder := json.NewDecoder(r.Body)
 
-		var t userStruct
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		decoder := json.NewDecoder(r.Body)
+		var t deleteStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		var userID int
-		err = s.db.QueryRow("SELECT id FROM users WHERE token=? LIMIT 1", t.Token).Scan(&userID)
-		if err == nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("User already exists"))
-			return
-		} else if err != sql.ErrNoRows {
-			s.Respond(w, r, http.StatusInternalServerError, err)
+		if t.Name == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
 			return
 		}
 
-		result, err := s.db.Exec("INSERT INTO users (name, token) VALUES (?, ?)", t.Name, t.Token)
+		deleted, err := deleteTemplate(s.db, userid, t.Name)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
-
-		userIDInt64, err := result.LastInsertId()
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
+		if !deleted {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Template not found"))
 			return
 		}
 
-		userID = int(userIDInt64)
-
-		user := struct {
-			ID    int    `json:"id"`
-			Name  string `json:"name"`
-			Token string `json:"token"`
-		}{
-			ID:    userID,
-			Name:  t.Name,
-			Token: t.Token,
-		}
-
-		responseJSON, err := json.Marshal(user)
+		response := map[string]interface{}{"Details": "Deleted", "Name": t.Name}
+		responseJson, err := json.Marshal(response)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err.Error())
-			return
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		s.Respond(w, r, http.StatusCreated, string(responseJSON))
 		return
 	}
 }
 
-func (s *server) DeleteUser() http.HandlerFunc {
-	type userStruct struct {
-		Token string `json:"token" binding:"required"`
+// Renders a stored or given template with variables without sending it
+func (s *server) PreviewTemplate() http.HandlerFunc {
+
+	type previewStruct struct {
+		Name      string
+		Template  *messageTemplate
+		Variables map[string]string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		decoder := json.NewDecoder(r.Body)
 
-		var t userStruct
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		decoder := json.NewDecoder(r.Body)
+		var t previewStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		rows, err := s.db.Query("SELECT name FROM users WHERE token=? LIMIT 1", t.Token)
-		if err != nil {
-			rows.Close()
-			s.Respond(w, r, http.StatusInternalServerError, err)
-			return
-		}
-
-		for rows.Next() {
-			var name string
-			err = rows.Scan(&name)
+		tmpl := t.Template
+		if tmpl == nil {
+			if t.Name == "" {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name or Template in Payload"))
+				return
+			}
+			tmpl, err = getTemplate(s.db, userid, t.Name)
+			if err == sql.ErrNoRows {
+				s.Respond(w, r, http.StatusNotFound, errors.New("Template not found"))
+				return
+			}
 			if err != nil {
-				rows.Close()
 				s.Respond(w, r, http.StatusInternalServerError, err)
 				return
 			}
-
-			if name == "admin" {
-				rows.Close()
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Cannot delete admin user"))
+		} else {
+			if tmpl.Name == "" {
+				tmpl.Name = "preview"
+			}
+			err = validateTemplate(tmpl)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
 				return
 			}
 		}
 
-		_, err = s.db.Query(fmt.Sprintf("delete from users where token='%s'", t.Token))
+		content, err := renderTemplate(tmpl, t.Variables)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		s.Respond(w, r, http.StatusOK, "User deleted")
+		response := map[string]interface{}{"Type": tmpl.Type, "Content": content, "Variables": tmpl.Variables}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
 		return
 	}
 }
 
-func (s *server) GetUserByToken() http.HandlerFunc {
-	type userResponse struct {
-		ID      int    `json:"id"`
-		Name    string `json:"name"`
-		Token   string `json:"token"`
-		Webhook string `json:"webhook"`
-		Jid     string `json:"jid"`
+// Sends a stored template with its placeholders filled from Variables
+func (s *server) SendTemplate() http.HandlerFunc {
+
+	type templateStruct struct {
+		Phone     string
+		Template  string
+		Variables map[string]string
+		sendOptions
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		decoder := json.NewDecoder(r.Body)
 
-		var t struct {
-			Token string `json:"token" binding:"required"`
-		}
-		if err := decoder.Decode(&t); err != nil {
-			s.Respond(w, r, http.StatusBadRequest, err.Error())
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		var user userResponse
-		err := s.db.QueryRow("SELECT id, name, token, webhook, jid FROM users WHERE token=? LIMIT 1", t.Token).Scan(
-			&user.ID, &user.Name, &user.Token, &user.Webhook, &user.Jid,
-		)
+		var t templateStruct
+		err = json.Unmarshal(body, &t)
 		if err != nil {
-			if err == sql.ErrNoRows {
-				s.Respond(w, r, http.StatusNotFound, "User not found")
-				return
-			}
-			s.Respond(w, r, http.StatusInternalServerError, err)
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		responseJSON, err := json.Marshal(user)
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Template == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Template in Payload"))
+			return
+		}
+
+		tmpl, err := getTemplate(s.db, userid, t.Template)
+		if err == sql.ErrNoRows {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Template not found"))
+			return
+		}
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err.Error())
+			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
 
-		s.Respond(w, r, http.StatusOK, string(responseJSON))
+		content, err := renderTemplate(tmpl, t.Variables)
+		if err != nil {
+			s.respondSendError(w, r, err)
+			return
+		}
+
+		req := &sendRequest{Type: tmpl.Type, To: t.Phone, Content: content, Options: t.sendOptions}
+		s.respondSend(w, r, userid, req, body)
+		return
 	}
 }
 
-// checks if users/phones are on Whatsapp
-func (s *server) CheckUser() http.HandlerFunc {
+// Gets the delivery state of a sent message, with the receipts of each recipient
+func (s *server) GetMessageStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-	type checkUserStruct struct {
-		Phone []string
-	}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-	type User struct {
-		Query        string
-		IsInWhatsapp bool
-		JID          string
-		VerifiedName string
+		msgid := mux.Vars(r)["id"]
+		statuses, err := getMessageStatuses(s.db, userid, []string{msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if len(statuses) == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("No sent message with this Id"))
+			return
+		}
+
+		responseJson, err := json.Marshal(statuses[0])
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
 	}
+}
 
-	type UserCollection struct {
-		Users []User
+// Gets the delivery state of several sent messages
+func (s *server) GetMessageStatuses() http.HandlerFunc {
+
+	type statusStruct struct {
+		Ids []string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1940,41 +1849,43 @@ func (s *server) CheckUser() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
-
 		decoder := json.NewDecoder(r.Body)
-		var t checkUserStruct
+		var t statusStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if len(t.Phone) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		if len(t.Ids) == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Ids in Payload"))
+			return
+		}
+
+		if len(t.Ids) > maxStatusLookup {
+			s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("At most %d Ids can be looked up at once", maxStatusLookup)))
 			return
 		}
 
-		resp, err := clientPointer[userid].IsOnWhatsApp(t.Phone)
+		statuses, err := getMessageStatuses(s.db, userid, t.Ids)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to check if users are on WhatsApp: %s", err)))
+			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
 
-		uc := new(UserCollection)
-		for _, item := range resp {
-			if item.VerifiedName != nil {
-				var msg = User{Query: item.Query, IsInWhatsapp: item.IsIn, JID: fmt.Sprintf("%s", item.JID), VerifiedName: item.VerifiedName.Details.GetVerifiedName()}
-				uc.Users = append(uc.Users, msg)
-			} else {
-				var msg = User{Query: item.Query, IsInWhatsapp: item.IsIn, JID: fmt.Sprintf("%s", item.JID), VerifiedName: ""}
-				uc.Users = append(uc.Users, msg)
+		found := make(map[string]bool)
+		for _, status := range statuses {
+			found[status.Id] = true
+		}
+		notfound := []string{}
+		for _, id := range t.Ids {
+			if !found[id] {
+				notfound = append(notfound, id)
 			}
 		}
-		responseJson, err := json.Marshal(uc)
+
+		response := map[string]interface{}{"Statuses": statuses, "NotFound": notfound}
+		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
@@ -1984,65 +1895,800 @@ func (s *server) CheckUser() http.HandlerFunc {
 	}
 }
 
-// Gets user information
-func (s *server) GetUser() http.HandlerFunc {
+func CreateAdminUser(db *sql.DB, token *string) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not begin transaction")
+		os.Exit(1)
+	}
+	defer tx.Rollback()
 
-	type checkUserStruct struct {
-		Phone []string
+	rows, err := tx.Query("SELECT id FROM users WHERE name='admin' LIMIT 1")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not query users table")
+		os.Exit(1)
 	}
 
-	type UserCollection struct {
-		Users map[types.JID]types.UserInfo
+	if !rows.Next() {
+		sqlStmtInsert := fmt.Sprintf("INSERT INTO users (name, token) values ('admin', '%s')", *token)
+		_, err = tx.Exec(sqlStmtInsert)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not insert admin user")
+			os.Exit(1)
+		}
+	} else {
+		sqlStmtUpdate := fmt.Sprintf("UPDATE users SET token='%s' WHERE name='admin'", *token)
+		_, err = tx.Exec(sqlStmtUpdate)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not update admin user")
+			os.Exit(1)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Fatal().Err(err).Msg("Could not commit transaction")
+		os.Exit(1)
+	}
+}
+
+func (s *server) CreateUser() http.HandlerFunc {
+	type userStruct struct {
+		Name  string `json:"name" binding:"required"`
+		Token string `json:"token" binding:"required"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		decoder := json.NewDecoder(r.Body)
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
+		var t userStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		var userID int
+		err = s.db.QueryRow("SELECT id FROM users WHERE token=? LIMIT 1", t.Token).Scan(&userID)
+		if err == nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("User already exists"))
+			return
+		} else if err != sql.ErrNoRows {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		result, err := s.db.Exec("INSERT INTO users (name, token) VALUES (?, ?)", t.Name, t.Token)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		userIDInt64, err := result.LastInsertId()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		userID = int(userIDInt64)
+
+		user := struct {
+			ID    int    `json:"id"`
+			Name  string `json:"name"`
+			Token string `json:"token"`
+		}{
+			ID:    userID,
+			Name:  t.Name,
+			Token: t.Token,
+		}
+
+		responseJSON, err := json.Marshal(user)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err.Error())
 			return
 		}
 
+		s.Respond(w, r, http.StatusCreated, string(responseJSON))
+		return
+	}
+}
+
+func (s *server) DeleteUser() http.HandlerFunc {
+	type userStruct struct {
+		Token string `json:"token" binding:"required"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
 		decoder := json.NewDecoder(r.Body)
-		var t checkUserStruct
+
+		var t userStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if len(t.Phone) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		rows, err := s.db.Query("SELECT name FROM users WHERE token=? LIMIT 1", t.Token)
+		if err != nil {
+			rows.Close()
+			s.Respond(w, r, http.StatusInternalServerError, err)
 			return
 		}
 
-		var jids []types.JID
-		for _, arg := range t.Phone {
-			jid, ok := parseJID(arg)
-			if !ok {
+		for rows.Next() {
+			var name string
+			err = rows.Scan(&name)
+			if err != nil {
+				rows.Close()
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+
+			if name == "admin" {
+				rows.Close()
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Cannot delete admin user"))
+				return
+			}
+		}
+
+		_, err = s.db.Query(fmt.Sprintf("delete from users where token='%s'", t.Token))
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		s.Respond(w, r, http.StatusOK, "User deleted")
+		return
+	}
+}
+
+func (s *server) GetUserByToken() http.HandlerFunc {
+	type userResponse struct {
+		ID      int    `json:"id"`
+		Name    string `json:"name"`
+		Token   string `json:"token"`
+		Webhook string `json:"webhook"`
+		Jid     string `json:"jid"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		decoder := json.NewDecoder(r.Body)
+
+		var t struct {
+			Token string `json:"token" binding:"required"`
+		}
+		if err := decoder.Decode(&t); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		var user userResponse
+		err := s.db.QueryRow("SELECT id, name, token, webhook, jid FROM users WHERE token=? LIMIT 1", t.Token).Scan(
+			&user.ID, &user.Name, &user.Token, &user.Webhook, &user.Jid,
+		)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				s.Respond(w, r, http.StatusNotFound, "User not found")
+				return
+			}
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJSON, err := json.Marshal(user)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		s.Respond(w, r, http.StatusOK, string(responseJSON))
+	}
+}
+
+// checks if users/phones are on Whatsapp
+func (s *server) CheckUser() http.HandlerFunc {
+
+	type checkUserStruct struct {
+		Phone []string
+	}
+
+	type User struct {
+		Query        string
+		IsInWhatsapp bool
+		JID          string
+		VerifiedName string
+	}
+
+	type UserCollection struct {
+		Users []User
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if getClient(userid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t checkUserStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if len(t.Phone) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		resp, err := getClient(userid).IsOnWhatsApp(t.Phone)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to check if users are on WhatsApp: %s", err)))
+			return
+		}
+
+		uc := new(UserCollection)
+		for _, item := range resp {
+			if item.VerifiedName != nil {
+				var msg = User{Query: item.Query, IsInWhatsapp: item.IsIn, JID: fmt.Sprintf("%s", item.JID), VerifiedName: item.VerifiedName.Details.GetVerifiedName()}
+				uc.Users = append(uc.Users, msg)
+			} else {
+				var msg = User{Query: item.Query, IsInWhatsapp: item.IsIn, JID: fmt.Sprintf("%s", item.JID), VerifiedName: ""}
+				uc.Users = append(uc.Users, msg)
+			}
+		}
+		responseJson, err := json.Marshal(uc)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Gets user information
+func (s *server) GetUser() http.HandlerFunc {
+
+	type checkUserStruct struct {
+		Phone []string
+	}
+
+	type UserCollection struct {
+		Users map[types.JID]types.UserInfo
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if getClient(userid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t checkUserStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if len(t.Phone) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		var jids []types.JID
+		for _, arg := range t.Phone {
+			jid, ok := parseJID(arg)
+			if !ok {
+				return
+			}
+			jids = append(jids, jid)
+		}
+		resp, err := getClient(userid).GetUserInfo(jids)
+
+		if err != nil {
+			msg := fmt.Sprintf("Failed to get user info: %v", err)
+			log.Error().Msg(msg)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+
+		uc := new(UserCollection)
+		uc.Users = make(map[types.JID]types.UserInfo)
+
+		for jid, info := range resp {
+			uc.Users[jid] = info
+		}
+
+		responseJson, err := json.Marshal(uc)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Gets avatar info for user
+func (s *server) GetAvatar() http.HandlerFunc {
+
+	type getAvatarStruct struct {
+		Phone   string
+		Preview bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if getClient(userid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t getAvatarStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if len(t.Phone) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		jid, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+			return
+		}
+
+		var pic *types.ProfilePictureInfo
+
+		existingID := ""
+		pic, err = getClient(userid).GetProfilePictureInfo(jid, &whatsmeow.GetProfilePictureParams{
+			Preview:    t.Preview,
+			ExistingID: existingID,
+		})
+		if err != nil {
+			msg := fmt.Sprintf("Failed to get avatar: %v", err)
+			log.Error().Msg(msg)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+			return
+		}
+
+		if pic == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No avatar found"))
+			return
+		}
+
+		log.Info().Str("id", pic.ID).Str("url", pic.URL).Msg("Got avatar")
+
+		responseJson, err := json.Marshal(pic)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Gets all contacts
+func (s *server) GetContacts() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if getClient(userid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		result := map[types.JID]types.ContactInfo{}
+		result, err := getClient(userid).Store.Contacts.GetAllContacts()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(result)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Sets Chat Presence (typing/paused/recording audio)
+func (s *server) ChatPresence() http.HandlerFunc {
+
+	type chatPresenceStruct struct {
+		Phone string
+		State string
+		Media types.ChatPresenceMedia
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		if getClient(userid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t chatPresenceStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if len(t.Phone) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if len(t.State) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing State in Payload"))
+			return
+		}
+
+		jid, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+			return
+		}
+
+		err = getClient(userid).SendChatPresence(jid, types.ChatPresence(t.State), types.ChatPresenceMedia(t.Media))
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Failure sending chat presence to Whatsapp servers"))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Chat presence set successfuly"}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Downloads Image and returns base64 representation
+func (s *server) DownloadImage() http.HandlerFunc {
+
+	type downloadImageStruct struct {
+		Url           string
+		DirectPath    string
+		MediaKey      []byte
+		Mimetype      string
+		FileEncSHA256 []byte
+		FileSHA256    []byte
+		FileLength    uint64
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		mimetype := ""
+		var imgdata []byte
+
+		if getClient(userid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		// check/creates user directory for files
+		userDirectory := fmt.Sprintf("%s/files/user_%s", s.exPath, txtid)
+		_, err := os.Stat(userDirectory)
+		if os.IsNotExist(err) {
+			errDir := os.MkdirAll(userDirectory, 0751)
+			if errDir != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
+				return
+			}
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t downloadImageStruct
+		err = decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		msg := &waProto.Message{ImageMessage: &waProto.ImageMessage{
+			Url:           proto.String(t.Url),
+			DirectPath:    proto.String(t.DirectPath),
+			MediaKey:      t.MediaKey,
+			Mimetype:      proto.String(t.Mimetype),
+			FileEncSha256: t.FileEncSHA256,
+			FileSha256:    t.FileSHA256,
+			FileLength:    &t.FileLength,
+		}}
+
+		img := msg.GetImageMessage()
+
+		if img != nil {
+			imgdata, err = getClient(userid).Download(img)
+			if err != nil {
+				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download image")
+				msg := fmt.Sprintf("Failed to download image %v", err)
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+				return
+			}
+			mimetype = img.GetMimetype()
+		}
+
+		dataURL := dataurl.New(imgdata, mimetype)
+		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Downloads Document and returns base64 representation
+func (s *server) DownloadDocument() http.HandlerFunc {
+
+	type downloadDocumentStruct struct {
+		Url           string
+		DirectPath    string
+		MediaKey      []byte
+		Mimetype      string
+		FileEncSHA256 []byte
+		FileSHA256    []byte
+		FileLength    uint64
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		mimetype := ""
+		var docdata []byte
+
+		if getClient(userid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		// check/creates user directory for files
+		userDirectory := fmt.Sprintf("%s/files/user_%s", s.exPath, txtid)
+		_, err := os.Stat(userDirectory)
+		if os.IsNotExist(err) {
+			errDir := os.MkdirAll(userDirectory, 0751)
+			if errDir != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
+				return
+			}
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t downloadDocumentStruct
+		err = decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		msg := &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
+			Url:           proto.String(t.Url),
+			DirectPath:    proto.String(t.DirectPath),
+			MediaKey:      t.MediaKey,
+			Mimetype:      proto.String(t.Mimetype),
+			FileEncSha256: t.FileEncSHA256,
+			FileSha256:    t.FileSHA256,
+			FileLength:    &t.FileLength,
+		}}
+
+		doc := msg.GetDocumentMessage()
+
+		if doc != nil {
+			docdata, err = getClient(userid).Download(doc)
+			if err != nil {
+				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download document")
+				msg := fmt.Sprintf("Failed to download document %v", err)
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+				return
+			}
+			mimetype = doc.GetMimetype()
+		}
+
+		dataURL := dataurl.New(docdata, mimetype)
+		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Downloads Video and returns base64 representation
+func (s *server) DownloadVideo() http.HandlerFunc {
+
+	type downloadVideoStruct struct {
+		Url           string
+		DirectPath    string
+		MediaKey      []byte
+		Mimetype      string
+		FileEncSHA256 []byte
+		FileSHA256    []byte
+		FileLength    uint64
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		mimetype := ""
+		var docdata []byte
+
+		if getClient(userid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		// check/creates user directory for files
+		userDirectory := fmt.Sprintf("%s/files/user_%s", s.exPath, txtid)
+		_, err := os.Stat(userDirectory)
+		if os.IsNotExist(err) {
+			errDir := os.MkdirAll(userDirectory, 0751)
+			if errDir != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
+				return
+			}
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t downloadVideoStruct
+		err = decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		msg := &waProto.Message{VideoMessage: &waProto.VideoMessage{
+			Url:           proto.String(t.Url),
+			DirectPath:    proto.String(t.DirectPath),
+			MediaKey:      t.MediaKey,
+			Mimetype:      proto.String(t.Mimetype),
+			FileEncSha256: t.FileEncSHA256,
+			FileSha256:    t.FileSHA256,
+			FileLength:    &t.FileLength,
+		}}
+
+		doc := msg.GetVideoMessage()
+
+		if doc != nil {
+			docdata, err = getClient(userid).Download(doc)
+			if err != nil {
+				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download video")
+				msg := fmt.Sprintf("Failed to download video %v", err)
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+				return
+			}
+			mimetype = doc.GetMimetype()
+		}
+
+		dataURL := dataurl.New(docdata, mimetype)
+		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Downloads Audio and returns base64 representation
+func (s *server) DownloadAudio() http.HandlerFunc {
+
+	type downloadAudioStruct struct {
+		Url           string
+		DirectPath    string
+		MediaKey      []byte
+		Mimetype      string
+		FileEncSHA256 []byte
+		FileSHA256    []byte
+		FileLength    uint64
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		mimetype := ""
+		var docdata []byte
+
+		if getClient(userid) == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		// check/creates user directory for files
+		userDirectory := fmt.Sprintf("%s/files/user_%s", s.exPath, txtid)
+		_, err := os.Stat(userDirectory)
+		if os.IsNotExist(err) {
+			errDir := os.MkdirAll(userDirectory, 0751)
+			if errDir != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
 				return
 			}
-			jids = append(jids, jid)
 		}
-		resp, err := clientPointer[userid].GetUserInfo(jids)
 
+		decoder := json.NewDecoder(r.Body)
+		var t downloadAudioStruct
+		err = decoder.Decode(&t)
 		if err != nil {
-			msg := fmt.Sprintf("Failed to get user info: %v", err)
-			log.Error().Msg(msg)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		uc := new(UserCollection)
-		uc.Users = make(map[types.JID]types.UserInfo)
+		msg := &waProto.Message{AudioMessage: &waProto.AudioMessage{
+			Url:           proto.String(t.Url),
+			DirectPath:    proto.String(t.DirectPath),
+			MediaKey:      t.MediaKey,
+			Mimetype:      proto.String(t.Mimetype),
+			FileEncSha256: t.FileEncSHA256,
+			FileSha256:    t.FileSHA256,
+			FileLength:    &t.FileLength,
+		}}
 
-		for jid, info := range resp {
-			uc.Users[jid] = info
+		doc := msg.GetAudioMessage()
+
+		if doc != nil {
+			docdata, err = getClient(userid).Download(doc)
+			if err != nil {
+				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download audio")
+				msg := fmt.Sprintf("Failed to download audio %v", err)
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+				return
+			}
+			mimetype = doc.GetMimetype()
 		}
 
-		responseJson, err := json.Marshal(uc)
+		dataURL := dataurl.New(docdata, mimetype)
+		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
@@ -2052,12 +2698,13 @@ func (s *server) GetUser() http.HandlerFunc {
 	}
 }
 
-// Gets avatar info for user
-func (s *server) GetAvatar() http.HandlerFunc {
+// React
+func (s *server) React() http.HandlerFunc {
 
-	type getAvatarStruct struct {
-		Phone   string
-		Preview bool
+	type textStruct struct {
+		Phone string
+		Body  string
+		Id    string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2065,82 +2712,78 @@ func (s *server) GetAvatar() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		if getClient(userid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
 		decoder := json.NewDecoder(r.Body)
-		var t getAvatarStruct
+		var t textStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if len(t.Phone) < 1 {
+		if t.Phone == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
 			return
 		}
 
-		jid, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+		if t.Body == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
 			return
 		}
 
-		var pic *types.ProfilePictureInfo
-
-		existingID := ""
-		pic, err = clientPointer[userid].GetProfilePictureInfo(jid, &whatsmeow.GetProfilePictureParams{
-			Preview:    t.Preview,
-			ExistingID: existingID,
-		})
-		if err != nil {
-			msg := fmt.Sprintf("Failed to get avatar: %v", err)
-			log.Error().Msg(msg)
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+		recipient, ok := parseJID(t.Phone)
+		if !ok {
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
 			return
 		}
 
-		if pic == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No avatar found"))
+		if t.Id == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
 			return
-		}
-
-		log.Info().Str("id", pic.ID).Str("url", pic.URL).Msg("Got avatar")
-
-		responseJson, err := json.Marshal(pic)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
+			msgid = t.Id
 		}
-		return
-	}
-}
-
-// Gets all contacts
-func (s *server) GetContacts() http.HandlerFunc {
-
-	return func(w http.ResponseWriter, r *http.Request) {
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
+		fromMe := false
+		if strings.HasPrefix(msgid, "me:") {
+			fromMe = true
+			msgid = msgid[len("me:"):]
+		}
+		reaction := t.Body
+		if reaction == "remove" {
+			reaction = ""
+		}
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
+		msg := &waProto.Message{
+			ReactionMessage: &waProto.ReactionMessage{
+				Key: &waProto.MessageKey{
+					RemoteJid: proto.String(recipient.String()),
+					FromMe:    proto.Bool(fromMe),
+					Id:        proto.String(msgid),
+				},
+				Text:              proto.String(reaction),
+				GroupingKey:       proto.String(reaction),
+				SenderTimestampMs: proto.Int64(time.Now().UnixMilli()),
+			},
 		}
 
-		result := map[types.JID]types.ContactInfo{}
-		result, err := clientPointer[userid].Store.Contacts.GetAllContacts()
+		resp, err = getClient(userid).SendMessage(context.Background(), recipient, msg)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
 		}
 
-		responseJson, err := json.Marshal(result)
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
@@ -2151,13 +2794,14 @@ func (s *server) GetContacts() http.HandlerFunc {
 	}
 }
 
-// Sets Chat Presence (typing/paused/recording audio)
-func (s *server) ChatPresence() http.HandlerFunc {
+// Posts a text, image or video status. The payload is the same as /chat/send without To
+func (s *server) PostStatus() http.HandlerFunc {
 
-	type chatPresenceStruct struct {
-		Phone string
-		State string
-		Media types.ChatPresenceMedia
+	type statusStruct struct {
+		Type     string
+		Content  json.RawMessage
+		Options  sendOptions
+		Audience []string // not implemented yet, see below
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2165,122 +2809,58 @@ func (s *server) ChatPresence() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		body, file, err := readSendPayload(r)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
+		defer file.remove()
 
-		decoder := json.NewDecoder(r.Body)
-		var t chatPresenceStruct
-		err := decoder.Decode(&t)
+		var t statusStruct
+		err = json.Unmarshal(body, &t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if len(t.Phone) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
-		}
-
-		if len(t.State) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing State in Payload"))
-			return
-		}
-
-		jid, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+		if !statusTypes[t.Type] {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Type must be text, image or video"))
 			return
 		}
 
-		err = clientPointer[userid].SendChatPresence(jid, types.ChatPresence(t.State), types.ChatPresenceMedia(t.Media))
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Failure sending chat presence to Whatsapp servers"))
+		// Not implemented yet: the pinned whatsmeow always sends statuses to the recipients of the status
+		// privacy settings and has no way to pass the participants. Requests with an audience fail
+		// rather than post to a wider audience than asked for
+		if t.Audience != nil {
+			s.Respond(w, r, http.StatusNotImplemented, errors.New("Audience is not implemented yet, statuses are shown to the audience of the status privacy settings"))
 			return
 		}
 
-		response := map[string]interface{}{"Details": "Chat presence set successfuly"}
-		responseJson, err := json.Marshal(response)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
-		}
+		req := &sendRequest{Type: t.Type, To: types.StatusBroadcastJID.String(), Content: t.Content, Options: t.Options, file: file, status: true}
+		s.respondSend(w, r, userid, req, body)
 		return
 	}
 }
 
-// Downloads Image and returns base64 representation
-func (s *server) DownloadImage() http.HandlerFunc {
-
-	type downloadImageStruct struct {
-		Url           string
-		DirectPath    string
-		MediaKey      []byte
-		Mimetype      string
-		FileEncSHA256 []byte
-		FileSHA256    []byte
-		FileLength    uint64
-	}
-
+// Gets the status privacy settings, which decide who sees posted statuses
+func (s *server) GetStatusPrivacy() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		mimetype := ""
-		var imgdata []byte
-
-		if clientPointer[userid] == nil {
+		if getClient(userid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		// check/creates user directory for files
-		userDirectory := fmt.Sprintf("%s/files/user_%s", s.exPath, txtid)
-		_, err := os.Stat(userDirectory)
-		if os.IsNotExist(err) {
-			errDir := os.MkdirAll(userDirectory, 0751)
-			if errDir != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
-				return
-			}
-		}
-
-		decoder := json.NewDecoder(r.Body)
-		var t downloadImageStruct
-		err = decoder.Decode(&t)
+		privacy, err := getClient(userid).GetStatusPrivacy()
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to get status privacy: %v", err)))
 			return
 		}
 
-		msg := &waProto.Message{ImageMessage: &waProto.ImageMessage{
-			Url:           proto.String(t.Url),
-			DirectPath:    proto.String(t.DirectPath),
-			MediaKey:      t.MediaKey,
-			Mimetype:      proto.String(t.Mimetype),
-			FileEncSha256: t.FileEncSHA256,
-			FileSha256:    t.FileSHA256,
-			FileLength:    &t.FileLength,
-		}}
-
-		img := msg.GetImageMessage()
-
-		if img != nil {
-			imgdata, err = clientPointer[userid].Download(img)
-			if err != nil {
-				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download image")
-				msg := fmt.Sprintf("Failed to download image %v", err)
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
-				return
-			}
-			mimetype = img.GetMimetype()
-		}
-
-		dataURL := dataurl.New(imgdata, mimetype)
-		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		response := map[string]interface{}{"Privacy": privacy}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -2291,17 +2871,12 @@ func (s *server) DownloadImage() http.HandlerFunc {
 	}
 }
 
-// Downloads Document and returns base64 representation
-func (s *server) DownloadDocument() http.HandlerFunc {
+// Sets the disappearing messages timer of a chat or group
+func (s *server) SetDisappearing() http.HandlerFunc {
 
-	type downloadDocumentStruct struct {
-		Url           string
-		DirectPath    string
-		MediaKey      []byte
-		Mimetype      string
-		FileEncSHA256 []byte
-		FileSHA256    []byte
-		FileLength    uint64
+	type disappearingStruct struct {
+		Phone string
+		Timer string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2309,58 +2884,39 @@ func (s *server) DownloadDocument() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		mimetype := ""
-		var docdata []byte
-
-		if clientPointer[userid] == nil {
+		if getClient(userid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		// check/creates user directory for files
-		userDirectory := fmt.Sprintf("%s/files/user_%s", s.exPath, txtid)
-		_, err := os.Stat(userDirectory)
-		if os.IsNotExist(err) {
-			errDir := os.MkdirAll(userDirectory, 0751)
-			if errDir != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
-				return
-			}
-		}
-
 		decoder := json.NewDecoder(r.Body)
-		var t downloadDocumentStruct
-		err = decoder.Decode(&t)
+		var t disappearingStruct
+		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		msg := &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
-			Url:           proto.String(t.Url),
-			DirectPath:    proto.String(t.DirectPath),
-			MediaKey:      t.MediaKey,
-			Mimetype:      proto.String(t.Mimetype),
-			FileEncSha256: t.FileEncSHA256,
-			FileSha256:    t.FileSHA256,
-			FileLength:    &t.FileLength,
-		}}
+		jid, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+			return
+		}
 
-		doc := msg.GetDocumentMessage()
+		timer, err := parseDisappearingTimer(t.Timer)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
 
-		if doc != nil {
-			docdata, err = clientPointer[userid].Download(doc)
-			if err != nil {
-				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download document")
-				msg := fmt.Sprintf("Failed to download document %v", err)
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
-				return
-			}
-			mimetype = doc.GetMimetype()
+		err = getClient(userid).SetDisappearingTimer(jid, timer)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to set disappearing timer: %v", err)))
+			return
 		}
+		setDisappearingTimer(s.db, userid, jid, uint32(timer.Seconds()))
 
-		dataURL := dataurl.New(docdata, mimetype)
-		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		response := map[string]interface{}{"Details": "Disappearing timer set", "Chat": jid.String(), "Timer": int(timer.Seconds())}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -2371,76 +2927,120 @@ func (s *server) DownloadDocument() http.HandlerFunc {
 	}
 }
 
-// Downloads Video and returns base64 representation
-func (s *server) DownloadVideo() http.HandlerFunc {
-
-	type downloadVideoStruct struct {
-		Url           string
-		DirectPath    string
-		MediaKey      []byte
-		Mimetype      string
-		FileEncSHA256 []byte
-		FileSHA256    []byte
-		FileLength    uint64
-	}
-
+// Gets the disappearing messages timer of a chat or group, in seconds
+func (s *server) GetDisappearing() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		mimetype := ""
-		var docdata []byte
-
-		if clientPointer[userid] == nil {
+		if getClient(userid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		// check/creates user directory for files
-		userDirectory := fmt.Sprintf("%s/files/user_%s", s.exPath, txtid)
-		_, err := os.Stat(userDirectory)
-		if os.IsNotExist(err) {
-			errDir := os.MkdirAll(userDirectory, 0751)
-			if errDir != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
-				return
-			}
+		jid, ok := parseJID(r.URL.Query().Get("phone"))
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse phone"))
+			return
+		}
+
+		timer := getDisappearingTimer(s.db, getClient(userid), userid, jid)
+
+		response := map[string]interface{}{"Chat": jid.String(), "Timer": timer}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+		return
+	}
+}
+
+// Forwards a stored or raw message to one or more chats
+func (s *server) ForwardMessage() http.HandlerFunc {
+
+	type forwardStruct struct {
+		Id      string
+		Message *waProto.Message
+		To      []string
+		Options sendOptions
+	}
+
+	type forwardResult struct {
+		To        string
+		Id        string     `json:",omitempty"`
+		Timestamp *time.Time `json:",omitempty"`
+		Error     string     `json:",omitempty"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
 		decoder := json.NewDecoder(r.Body)
-		var t downloadVideoStruct
-		err = decoder.Decode(&t)
+		var t forwardStruct
+		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		msg := &waProto.Message{VideoMessage: &waProto.VideoMessage{
-			Url:           proto.String(t.Url),
-			DirectPath:    proto.String(t.DirectPath),
-			MediaKey:      t.MediaKey,
-			Mimetype:      proto.String(t.Mimetype),
-			FileEncSha256: t.FileEncSHA256,
-			FileSha256:    t.FileSHA256,
-			FileLength:    &t.FileLength,
-		}}
-
-		doc := msg.GetVideoMessage()
+		if len(t.To) == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing To in Payload"))
+			return
+		}
+		// Every forward is a separate message, which can't share an ID
+		if t.Options.Id != "" && len(t.To) > 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Options.Id can only be set when forwarding to a single chat"))
+			return
+		}
 
-		if doc != nil {
-			docdata, err = clientPointer[userid].Download(doc)
+		msg := t.Message
+		if msg == nil {
+			if t.Id == "" {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id or Message in Payload"))
+				return
+			}
+			stored, err := getStoredMessage(s.db, userid, t.Id)
+			if err == sql.ErrNoRows {
+				s.Respond(w, r, http.StatusNotFound, errors.New("Message not found, pass its content in Message"))
+				return
+			}
 			if err != nil {
-				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download video")
-				msg := fmt.Sprintf("Failed to download video %v", err)
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+				s.Respond(w, r, http.StatusInternalServerError, err)
 				return
 			}
-			mimetype = doc.GetMimetype()
+			msg = stored.Message
 		}
 
-		dataURL := dataurl.New(docdata, mimetype)
-		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		results := []forwardResult{}
+		var firsterr error
+		sent := 0
+		for _, to := range t.To {
+			p, err := prepareForward(s.db, userid, to, msg, t.Options)
+			var result *sendResult
+			if err == nil {
+				result, err = p.send()
+			}
+			if err != nil {
+				if firsterr == nil {
+					firsterr = err
+				}
+				results = append(results, forwardResult{To: to, Error: err.Error()})
+				continue
+			}
+			sent++
+			results = append(results, forwardResult{To: to, Id: result.Id, Timestamp: &result.Timestamp})
+		}
+		if sent == 0 {
+			s.respondSendError(w, r, firsterr)
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Forwarded", "Results": results}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -2451,17 +3051,14 @@ func (s *server) DownloadVideo() http.HandlerFunc {
 	}
 }
 
-// Downloads Audio and returns base64 representation
-func (s *server) DownloadAudio() http.HandlerFunc {
+// Edits the text or caption of a sent message
+func (s *server) EditMessage() http.HandlerFunc {
 
-	type downloadAudioStruct struct {
-		Url           string
-		DirectPath    string
-		MediaKey      []byte
-		Mimetype      string
-		FileEncSHA256 []byte
-		FileSHA256    []byte
-		FileLength    uint64
+	type editStruct struct {
+		Phone   string
+		Id      string
+		Body    string
+		OnLimit string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2469,58 +3066,85 @@ func (s *server) DownloadAudio() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		mimetype := ""
-		var docdata []byte
-
-		if clientPointer[userid] == nil {
+		if getClient(userid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		// check/creates user directory for files
-		userDirectory := fmt.Sprintf("%s/files/user_%s", s.exPath, txtid)
-		_, err := os.Stat(userDirectory)
-		if os.IsNotExist(err) {
-			errDir := os.MkdirAll(userDirectory, 0751)
-			if errDir != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
-				return
-			}
-		}
-
 		decoder := json.NewDecoder(r.Body)
-		var t downloadAudioStruct
-		err = decoder.Decode(&t)
+		var t editStruct
+		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		msg := &waProto.Message{AudioMessage: &waProto.AudioMessage{
-			Url:           proto.String(t.Url),
-			DirectPath:    proto.String(t.DirectPath),
-			MediaKey:      t.MediaKey,
-			Mimetype:      proto.String(t.Mimetype),
-			FileEncSha256: t.FileEncSHA256,
-			FileSha256:    t.FileSHA256,
-			FileLength:    &t.FileLength,
-		}}
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
 
-		doc := msg.GetAudioMessage()
+		if t.Id == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
+			return
+		}
 
-		if doc != nil {
-			docdata, err = clientPointer[userid].Download(doc)
+		if t.Body == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
+			return
+		}
+
+		if t.OnLimit != "" && t.OnLimit != "reject" && t.OnLimit != "wait" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("OnLimit must be reject or wait"))
+			return
+		}
+
+		recipient, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+			return
+		}
+
+		// Keep the type of the original message when it is known, so captions can be edited too
+		content := &waProto.Message{Conversation: proto.String(t.Body)}
+		stored, err := getStoredMessage(s.db, userid, t.Id)
+		if err == nil {
+			if !stored.IsFromMe {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Only messages sent by this session can be edited"))
+				return
+			}
+			if time.Since(time.Unix(stored.Timestamp, 0)) > whatsmeow.EditWindow {
+				s.Respond(w, r, http.StatusBadRequest, errors.New(fmt.Sprintf("Messages can only be edited within %s of being sent", whatsmeow.EditWindow)))
+				return
+			}
+			content, err = editedContent(stored.Message, t.Body)
 			if err != nil {
-				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download audio")
-				msg := fmt.Sprintf("Failed to download audio %v", err)
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+				s.Respond(w, r, http.StatusBadRequest, err)
 				return
 			}
-			mimetype = doc.GetMimetype()
+		} else if err != sql.ErrNoRows {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
 		}
 
-		dataURL := dataurl.New(docdata, mimetype)
-		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		// Edits and revokes count against the rate limits like any other message
+		reserved, err := throttleSend(s.db, getClient(userid), userid, recipient, t.OnLimit == "wait")
+		if err != nil {
+			s.respondSendError(w, r, err)
+			return
+		}
+		resp, err := getClient(userid).SendMessage(context.Background(), recipient, getClient(userid).BuildEdit(recipient, t.Id, content))
+		if err != nil {
+			getLimiter(userid).release(reserved)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending edit: %v", err)))
+			return
+		}
+		if stored != nil {
+			updateStoredText(s.db, userid, t.Id, t.Body)
+		}
+
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", t.Id).Msg("Message edited")
+		response := map[string]interface{}{"Details": "Edited", "Timestamp": resp.Timestamp, "Id": t.Id}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -2531,13 +3155,14 @@ func (s *server) DownloadAudio() http.HandlerFunc {
 	}
 }
 
-// React
-func (s *server) React() http.HandlerFunc {
+// Deletes a message for everyone, group admins can delete messages from other participants
+func (s *server) RevokeMessage() http.HandlerFunc {
 
-	type textStruct struct {
-		Phone string
-		Body  string
-		Id    string
+	type revokeStruct struct {
+		Phone       string
+		Id          string
+		Participant string
+		OnLimit     string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2545,16 +3170,13 @@ func (s *server) React() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		if getClient(userid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
 		decoder := json.NewDecoder(r.Body)
-		var t textStruct
+		var t revokeStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
@@ -2566,63 +3188,54 @@ func (s *server) React() http.HandlerFunc {
 			return
 		}
 
-		if t.Body == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
+		if t.Id == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
 			return
 		}
 
-		recipient, ok := parseJID(t.Phone)
-		if !ok {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+		if t.OnLimit != "" && t.OnLimit != "reject" && t.OnLimit != "wait" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("OnLimit must be reject or wait"))
 			return
 		}
 
-		if t.Id == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
+		recipient, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
 			return
-		} else {
-			msgid = t.Id
 		}
 
-		fromMe := false
-		if strings.HasPrefix(msgid, "me:") {
-			fromMe = true
-			msgid = msgid[len("me:"):]
-		}
-		reaction := t.Body
-		if reaction == "remove" {
-			reaction = ""
+		// Sender of the revoked message, empty for own messages
+		sender := types.EmptyJID
+		if t.Participant != "" {
+			sender, ok = parseJID(t.Participant)
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Participant"))
+				return
+			}
+		} else if stored, err := getStoredMessage(s.db, userid, t.Id); err == nil && !stored.IsFromMe {
+			sender = stored.Sender
 		}
 
-		msg := &waProto.Message{
-			ReactionMessage: &waProto.ReactionMessage{
-				Key: &waProto.MessageKey{
-					RemoteJid: proto.String(recipient.String()),
-					FromMe:    proto.Bool(fromMe),
-					Id:        proto.String(msgid),
-				},
-				Text:              proto.String(reaction),
-				GroupingKey:       proto.String(reaction),
-				SenderTimestampMs: proto.Int64(time.Now().UnixMilli()),
-			},
+		reserved, err := throttleSend(s.db, getClient(userid), userid, recipient, t.OnLimit == "wait")
+		if err != nil {
+			s.respondSendError(w, r, err)
+			return
 		}
-
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg)
+		resp, err := getClient(userid).SendMessage(context.Background(), recipient, getClient(userid).BuildRevoke(recipient, sender, t.Id))
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			getLimiter(userid).release(reserved)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending revoke: %v", err)))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", t.Id).Msg("Message revoked")
+		response := map[string]interface{}{"Details": "Revoked", "Timestamp": resp.Timestamp, "Id": t.Id}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
 		return
 	}
 }
@@ -2641,7 +3254,7 @@ func (s *server) MarkRead() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		if getClient(userid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -2664,7 +3277,7 @@ func (s *server) MarkRead() http.HandlerFunc {
 			return
 		}
 
-		err = clientPointer[userid].MarkRead(t.Id, time.Now(), t.Chat, t.Sender)
+		err = getClient(userid).MarkRead(t.Id, time.Now(), t.Chat, t.Sender)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("Failure marking messages as read"))
 			return
@@ -2693,12 +3306,12 @@ func (s *server) ListGroups() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		if getClient(userid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		resp, err := clientPointer[userid].GetJoinedGroups()
+		resp, err := getClient(userid).GetJoinedGroups()
 
 		if err != nil {
 			msg := fmt.Sprintf("Failed to get group list: %v", err)
@@ -2735,7 +3348,7 @@ func (s *server) GetGroupInfo() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		if getClient(userid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -2754,7 +3367,7 @@ func (s *server) GetGroupInfo() http.HandlerFunc {
 			return
 		}
 
-		resp, err := clientPointer[userid].GetGroupInfo(group)
+		resp, err := getClient(userid).GetGroupInfo(group)
 
 		if err != nil {
 			msg := fmt.Sprintf("Failed to get group info: %v", err)
@@ -2788,7 +3401,7 @@ func (s *server) GetGroupInviteLink() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		if getClient(userid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -2807,7 +3420,7 @@ func (s *server) GetGroupInviteLink() http.HandlerFunc {
 			return
 		}
 
-		resp, err := clientPointer[userid].GetGroupInviteLink(group, t.Reset)
+		resp, err := getClient(userid).GetGroupInviteLink(group, t.Reset)
 
 		if err != nil {
 			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to get group invite link")
@@ -2842,7 +3455,7 @@ func (s *server) SetGroupPhoto() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		if getClient(userid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -2881,7 +3494,7 @@ func (s *server) SetGroupPhoto() http.HandlerFunc {
 			return
 		}
 
-		picture_id, err := clientPointer[userid].SetGroupPhoto(group, filedata)
+		picture_id, err := getClient(userid).SetGroupPhoto(group, filedata)
 
 		if err != nil {
 			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group photo")
@@ -2916,7 +3529,7 @@ func (s *server) SetGroupName() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		if getClient(userid) == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -2940,7 +3553,7 @@ func (s *server) SetGroupName() http.HandlerFunc {
 			return
 		}
 
-		err = clientPointer[userid].SetGroupName(group, t.Name)
+		err = getClient(userid).SetGroupName(group, t.Name)
 
 		if err != nil {
 			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group name")
@@ -2986,25 +3599,3 @@ func (s *server) Respond(w http.ResponseWriter, r *http.Request, status int, dat
 		panic("respond: " + err.Error())
 	}
 }
-
-func validateMessageFields(phone string, stanzaid *string, participant *string) (types.JID, error) {
-
-	recipient, ok := parseJID(phone)
-	if !ok {
-		return types.NewJID("", types.DefaultUserServer), errors.New("Could not parse Phone")
-	}
-
-	if stanzaid != nil {
-		if participant == nil {
-			return types.NewJID("", types.DefaultUserServer), errors.New("Missing Participant in ContextInfo")
-		}
-	}
-
-	if participant != nil {
-		if stanzaid == nil {
-			return types.NewJID("", types.DefaultUserServer), errors.New("Missing StanzaId in ContextInfo")
-		}
-	}
-
-	return recipient, nil
-}
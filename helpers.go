@@ -1,5 +1,16 @@
 package main
 
+import (
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/patrickmn/go-cache"
+)
+
 func Find(slice []string, val string) bool {
 	for _, item := range slice {
 		if item == val {
@@ -16,20 +27,75 @@ func updateUserInfo(values interface{}, field string, value string) interface{}
 	return values
 }
 
+// Returns the HTTP client used for webhooks of a user
+func webhookClient(id int) *resty.Client {
+	if client, ok := clientHttp[id]; ok {
+		return client
+	}
+	client := resty.New()
+	client.SetRedirectPolicy(resty.FlexibleRedirectPolicy(15))
+	client.SetTimeout(5 * time.Second)
+	client.SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
+	return client
+}
+
 // webhook for regular messages
-func callHook(myurl string, payload map[string]string, id int) {
+func callHook(myurl string, payload map[string]string, id int) (*resty.Response, error) {
 	log.Info().Str("url", myurl).Msg("Sending POST")
-	_, err := clientHttp[id].R().SetFormData(payload).Post(myurl)
-
-	if err != nil {
-		log.Debug().Str("error", err.Error())
-	}
+	resp, err := webhookClient(id).R().SetFormData(payload).Post(myurl)
+	return resp, webhookError(resp, err)
 }
 
 // webhook for messages with file attachments
-func callHookFile(myurl string, payload map[string]string, id int, file string) {
+func callHookFile(myurl string, payload map[string]string, id int, file string) (*resty.Response, error) {
 	log.Info().Str("file", file).Str("url", myurl).Msg("Sending POST")
-	clientHttp[id].R().SetFiles(map[string]string{
+	resp, err := webhookClient(id).R().SetFiles(map[string]string{
 		"file": file,
 	}).SetFormData(payload).Post(myurl)
+	return resp, webhookError(resp, err)
+}
+
+// Turns error status codes returned by webhooks into errors
+func webhookError(resp *resty.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode())
+	}
+	return nil
+}
+
+// Loads a per user setting stored as JSON into v, v is left untouched if the setting was never saved
+func getUserSetting(db *sql.DB, userid int, name string, v interface{}) error {
+	key := fmt.Sprintf("%d:%s", userid, name)
+	value := ""
+	cached, found := settingscache.Get(key)
+	if found {
+		value = cached.(string)
+	} else {
+		err := db.QueryRow("SELECT value FROM user_settings WHERE user_id=? AND name=? LIMIT 1", userid, name).Scan(&value)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		settingscache.Set(key, value, cache.DefaultExpiration)
+	}
+	if value == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(value), v)
+}
+
+// Stores a per user setting as JSON
+func setUserSetting(db *sql.DB, userid int, name string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO user_settings (user_id, name, value) VALUES (?, ?, ?) ON CONFLICT(user_id, name) DO UPDATE SET value=excluded.value", userid, name, string(value))
+	if err != nil {
+		return err
+	}
+	settingscache.Set(fmt.Sprintf("%d:%s", userid, name), string(value), cache.DefaultExpiration)
+	return nil
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Keys of requests currently being processed, to reject concurrent retries
+var idempotencyInFlight = make(map[string]bool)
+var idempotencyMutex sync.Mutex
+
+// Hash of a request payload and its uploaded file, a key reused with a different payload is rejected
+func idempotencyHash(payload []byte, file *uploadedFile) string {
+	h := sha256.New()
+	h.Write(payload)
+	if file != nil {
+		fmt.Fprintf(h, "\x00%s\x00%s\x00%x", file.FileName, file.Mimetype, file.Sha256)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Marks a key as being processed, returns false if it already is
+func lockIdempotencyKey(userid int, key string) bool {
+	idempotencyMutex.Lock()
+	defer idempotencyMutex.Unlock()
+	name := fmt.Sprintf("%d:%s", userid, key)
+	if idempotencyInFlight[name] {
+		return false
+	}
+	idempotencyInFlight[name] = true
+	return true
+}
+
+func unlockIdempotencyKey(userid int, key string) {
+	idempotencyMutex.Lock()
+	defer idempotencyMutex.Unlock()
+	delete(idempotencyInFlight, fmt.Sprintf("%d:%s", userid, key))
+}
+
+// Gets the stored response for a key within the idempotency window, returns sql.ErrNoRows if there is none
+func getIdempotentResponse(db *sql.DB, userid int, key string) (hash string, response string, err error) {
+	cutoff := time.Now().Add(-*idemWindow).Unix()
+	err = db.QueryRow("SELECT hash, response FROM idempotency_keys WHERE user_id=? AND key=? AND created>=? LIMIT 1", userid, key, cutoff).Scan(&hash, &response)
+	return hash, response, err
+}
+
+// Stores the response for a key, dropping keys older than the idempotency window
+func saveIdempotentResponse(db *sql.DB, userid int, key string, hash string, response string) {
+	now := time.Now()
+	_, err := db.Exec("DELETE FROM idempotency_keys WHERE created<?", now.Add(-*idemWindow).Unix())
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not expire idempotency keys")
+	}
+	sqlStmt := `INSERT OR REPLACE INTO idempotency_keys (user_id, key, hash, response, created) VALUES (?, ?, ?, ?, ?)`
+	_, err = db.Exec(sqlStmt, userid, key, hash, response, now.Unix())
+	if err != nil {
+		log.Warn().Err(err).Str("key", key).Msg(sqlStmt)
+	}
+}
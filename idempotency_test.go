@@ -0,0 +1,29 @@
+package main
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+func TestIdempotencyHash(t *testing.T) {
+	photoSum, otherSum := sha256.Sum256([]byte("photo")), sha256.Sum256([]byte("other"))
+	payload := []byte(`{"Phone":"5491155554444","Caption":"hi"}`)
+	photo := &uploadedFile{Sha256: photoSum[:], FileName: "photo.jpg", Mimetype: "image/jpeg"}
+	tests := []struct {
+		name  string
+		other *uploadedFile
+		same  bool
+	}{
+		{"same file", &uploadedFile{Sha256: photoSum[:], FileName: "photo.jpg", Mimetype: "image/jpeg"}, true},
+		{"different content", &uploadedFile{Sha256: otherSum[:], FileName: "photo.jpg", Mimetype: "image/jpeg"}, false},
+		{"different name", &uploadedFile{Sha256: photoSum[:], FileName: "other.jpg", Mimetype: "image/jpeg"}, false},
+		{"no file", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := idempotencyHash(payload, photo) == idempotencyHash(payload, tt.other); got != tt.same {
+				t.Errorf("hashes equal = %v, want %v", got, tt.same)
+			}
+		})
+	}
+}
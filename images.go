@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// JPEG quality of generated thumbnails
+const thumbnailQuality = 75
+
+// Largest image decoded, a few bytes of a compressed image can claim dimensions needing gigabytes of memory
+const maxImagePixels = 40_000_000
+
+// Decodes a JPEG, PNG, GIF, WebP or BMP image, checking its dimensions before decoding it
+func decodeImage(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkImageSize(config.Width, config.Height); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+func checkImageSize(width int, height int) error {
+	if width <= 0 || height <= 0 || int64(width)*int64(height) > maxImagePixels {
+		return fmt.Errorf("image dimensions %dx%d exceed %d pixels", width, height, maxImagePixels)
+	}
+	return nil
+}
+
+// Scales an image down to fit in a square of maxSide pixels, keeping its aspect ratio
+func fitImage(img image.Image, maxSide int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSide && height <= maxSide {
+		return img
+	}
+	if width > height {
+		height = height * maxSide / width
+		width = maxSide
+	} else {
+		width = width * maxSide / height
+		height = maxSide
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+	return scaled
+}
+
+// Encodes a JPEG thumbnail of an image fitting in maxSide pixels, returning its dimensions
+func jpegThumbnail(img image.Image, maxSide int) ([]byte, int, int, error) {
+	thumb := fitImage(img, maxSide)
+	// JPEG has no transparency, draw on white so transparent areas don't turn black
+	bounds := thumb.Bounds()
+	flat := image.NewRGBA(bounds)
+	draw.Draw(flat, bounds, image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, bounds, thumb, bounds.Min, draw.Over)
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, flat, &jpeg.Options{Quality: thumbnailQuality})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return buf.Bytes(), bounds.Dx(), bounds.Dy(), nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"google.golang.org/protobuf/proto"
+)
+
+// Limits when fetching the page and image of a link preview
+const previewTimeout = 10 * time.Second
+const maxPreviewPage = 1 << 20
+const maxPreviewImage = 5 << 20
+
+// Size of link preview thumbnails
+const previewThumbnailSize = 300
+
+// First http or https URL in a text
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// Link preview data, fetched from the page OpenGraph tags or given by the client
+type linkPreview struct {
+	Url          string
+	Title        string
+	Description  string
+	Thumbnail    string // base64 encoded image in data URL format
+	ThumbnailUrl string
+	image        []byte
+}
+
+// Finds the first URL in a text, without trailing punctuation
+func findURL(text string) string {
+	link := urlPattern.FindString(text)
+	return strings.TrimRight(link, ".,;:!?)]}'")
+}
+
+// Fetches the OpenGraph title, description and image of a page, falling back to its title and meta description
+func fetchLinkPreview(link string) (*linkPreview, error) {
+	page, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), previewTimeout)
+	defer cancel()
+	resp, err := mediaFetchClient.R().SetContext(ctx).SetDoNotParseResponse(true).SetHeader("User-Agent", "WhatsApp/2").Get(link)
+	if err != nil {
+		return nil, err
+	}
+	body := resp.RawBody()
+	defer body.Close()
+	if resp.IsError() {
+		return nil, fmt.Errorf("status %d", resp.StatusCode())
+	}
+	if !strings.Contains(resp.Header().Get("Content-Type"), "html") {
+		return nil, errors.New("not an HTML page")
+	}
+
+	preview := &linkPreview{Url: link}
+	var pageTitle, description, image string
+	tokenizer := html.NewTokenizer(io.LimitReader(body, maxPreviewPage))
+	inTitle := false
+parse:
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			break parse
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.DataAtom {
+			case atom.Title:
+				inTitle = true
+			case atom.Meta:
+				var key, content string
+				for _, attr := range token.Attr {
+					switch attr.Key {
+					case "property", "name":
+						key = strings.ToLower(attr.Val)
+					case "content":
+						content = strings.TrimSpace(attr.Val)
+					}
+				}
+				switch key {
+				case "og:title":
+					preview.Title = content
+				case "og:description":
+					preview.Description = content
+				case "description":
+					description = content
+				case "og:image", "og:image:url", "og:image:secure_url":
+					if image == "" {
+						image = content
+					}
+				case "og:url":
+					if canonical, err := page.Parse(content); err == nil {
+						preview.Url = canonical.String()
+					}
+				}
+			case atom.Body:
+				break parse
+			}
+		case html.TextToken:
+			if inTitle && pageTitle == "" {
+				pageTitle = strings.TrimSpace(string(tokenizer.Text()))
+			}
+		case html.EndTagToken:
+			if tokenizer.Token().DataAtom == atom.Title {
+				inTitle = false
+			}
+		}
+	}
+	if preview.Title == "" {
+		preview.Title = pageTitle
+	}
+	if preview.Description == "" {
+		preview.Description = description
+	}
+	if preview.Title == "" {
+		return nil, errors.New("no title found")
+	}
+	if image != "" {
+		if imageurl, err := page.Parse(image); err == nil {
+			preview.ThumbnailUrl = imageurl.String()
+		}
+	}
+	return preview, nil
+}
+
+// Loads the thumbnail image of a preview, given as base64 data or fetched from its URL within the preview limits
+func (p *linkPreview) loadImage() error {
+	var media *outgoingMedia
+	var err error
+	switch {
+	case p.Thumbnail != "":
+		media, err = loadMedia(nil, p.Thumbnail, "", "", "image")
+	case p.ThumbnailUrl != "":
+		media, _, err = fetchLimitedMedia(p.ThumbnailUrl, maxPreviewImage, previewTimeout)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(media.Data) > maxPreviewImage {
+		return badRequest(fmt.Sprintf("Preview image is larger than %d MB", maxPreviewImage>>20))
+	}
+	p.image = media.Data
+	return nil
+}
+
+// Sets the preview fields of a text message. The preview URL must appear in the text
+func applyLinkPreview(msg *waProto.ExtendedTextMessage, matched string, preview *linkPreview) {
+	msg.MatchedText = proto.String(matched)
+	msg.CanonicalUrl = proto.String(preview.Url)
+	msg.Title = proto.String(preview.Title)
+	if preview.Description != "" {
+		msg.Description = proto.String(preview.Description)
+	}
+	msg.PreviewType = waProto.ExtendedTextMessage_NONE.Enum()
+	if len(preview.image) == 0 {
+		return
+	}
+	img, err := decodeImage(preview.image)
+	if err != nil {
+		log.Warn().Err(err).Str("url", preview.Url).Msg("Could not decode link preview image")
+		return
+	}
+	thumbnail, width, height, err := jpegThumbnail(img, previewThumbnailSize)
+	if err != nil {
+		log.Warn().Err(err).Str("url", preview.Url).Msg("Could not create link preview thumbnail")
+		return
+	}
+	msg.JpegThumbnail = thumbnail
+	msg.ThumbnailWidth = proto.Uint32(uint32(width))
+	msg.ThumbnailHeight = proto.Uint32(uint32(height))
+}
+
+// Adds a link preview to a text message: the explicit preview if given, else one fetched for the
+// first URL of the text unless disabled. Failing to fetch a preview does not prevent sending the text
+func addLinkPreview(msg *waProto.ExtendedTextMessage, enabled *bool, explicit *linkPreview) error {
+	text := msg.GetText()
+	if explicit != nil {
+		if explicit.Title == "" {
+			return badRequest("Missing Title in Preview")
+		}
+		matched := findURL(text)
+		if explicit.Url == "" {
+			explicit.Url = matched
+		}
+		if explicit.Url == "" {
+			return badRequest("Missing Url in Preview and no URL found in Body")
+		}
+		if matched == "" {
+			matched = explicit.Url
+		}
+		if err := explicit.loadImage(); err != nil {
+			return err
+		}
+		applyLinkPreview(msg, matched, explicit)
+		return nil
+	}
+
+	if enabled != nil && !*enabled {
+		return nil
+	}
+	link := findURL(text)
+	if link == "" {
+		return nil
+	}
+	preview, err := fetchLinkPreview(link)
+	if err != nil {
+		log.Info().Err(err).Str("url", link).Msg("No link preview")
+		return nil
+	}
+	if err := preview.loadImage(); err != nil {
+		log.Info().Err(err).Str("url", preview.ThumbnailUrl).Msg("Could not load link preview image")
+	}
+	applyLinkPreview(msg, link, preview)
+	return nil
+}
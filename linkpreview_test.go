@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchLinkPreview(t *testing.T) {
+	pages := map[string]string{
+		"/og":       `<html><head><title>Page</title><meta property="og:title" content="Title"><meta property="og:description" content="Text"><meta property="og:image" content="/img.png"><meta property="og:url" content="/canonical"></head><body></body></html>`,
+		"/fallback": `<html><head><title> Page title </title><meta name="description" content="Meta description"></head><body></body></html>`,
+		"/untitled": `<html><head></head><body><h1>No title</h1></body></html>`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(page))
+	}))
+	defer server.Close()
+
+	*allowPrivate = false
+	if _, err := fetchLinkPreview(server.URL + "/og"); err == nil {
+		t.Fatal("preview of a loopback address should be refused")
+	}
+	*allowPrivate = true
+	defer func() { *allowPrivate = false }()
+
+	tests := []struct {
+		path  string
+		want  *linkPreview
+		fails bool
+	}{
+		{"/og", &linkPreview{Url: server.URL + "/canonical", Title: "Title", Description: "Text", ThumbnailUrl: server.URL + "/img.png"}, false},
+		{"/fallback", &linkPreview{Url: server.URL + "/fallback", Title: "Page title", Description: "Meta description"}, false},
+		{"/untitled", nil, true},
+		{"/missing", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			preview, err := fetchLinkPreview(server.URL + tt.path)
+			if tt.fails {
+				if err == nil {
+					t.Errorf("got %+v, want an error", preview)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetchLinkPreview: %v", err)
+			}
+			if preview.Url != tt.want.Url || preview.Title != tt.want.Title || preview.Description != tt.want.Description || preview.ThumbnailUrl != tt.want.ThumbnailUrl {
+				t.Errorf("got %+v, want %+v", preview, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreviewImageLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// No Content-Length, the limit must hold while reading
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.Write(pngHeader)
+		w.Write(bytes.Repeat([]byte{0}, maxPreviewImage))
+	}))
+	defer server.Close()
+	*allowPrivate = true
+	defer func() { *allowPrivate = false }()
+
+	preview := &linkPreview{ThumbnailUrl: server.URL}
+	err := preview.loadImage()
+	if err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("loadImage() = %v, want a size error", err)
+	}
+	if preview.image != nil {
+		t.Error("oversized image kept")
+	}
+}
@@ -28,21 +28,38 @@ type server struct {
 }
 
 var (
-	address    = flag.String("address", "0.0.0.0", "Bind IP Address")
-	port       = flag.String("port", "8080", "Listen Port")
-	waDebug    = flag.String("wadebug", "", "Enable whatsmeow debug (INFO or DEBUG)")
-	logType    = flag.String("logtype", "console", "Type of log output (console or json)")
-	sslcert    = flag.String("sslcertificate", "", "SSL Certificate File")
-	sslprivkey = flag.String("sslprivatekey", "", "SSL Certificate Private Key File")
-	token      = flag.String("token", "", "Token for authentication an Admin user")
-	container  *sqlstore.Container
-
-	killchannel   = make(map[int](chan bool))
-	userinfocache = cache.New(5*time.Minute, 10*time.Minute)
-	log           zerolog.Logger
+	address      = flag.String("address", "0.0.0.0", "Bind IP Address")
+	port         = flag.String("port", "8080", "Listen Port")
+	waDebug      = flag.String("wadebug", "", "Enable whatsmeow debug (INFO or DEBUG)")
+	logType      = flag.String("logtype", "console", "Type of log output (console or json)")
+	sslcert      = flag.String("sslcertificate", "", "SSL Certificate File")
+	sslprivkey   = flag.String("sslprivatekey", "", "SSL Certificate Private Key File")
+	token        = flag.String("token", "", "Token for authentication an Admin user")
+	baseURL      = flag.String("baseurl", "", "Public base URL used for media links sent on webhooks")
+	secret       = flag.String("secret", "", "Secret used to sign media links (defaults to admin token)")
+	mediaWorks   = flag.Int("mediaworkers", 4, "Number of workers downloading media for webhooks")
+	webhookQueue = flag.Int("webhookqueue", 1000, "Maximum number of pending webhook deliveries per session")
+	webhookWait  = flag.Duration("webhookqueuetimeout", time.Minute, "How long events wait for room in a full webhook queue before being dropped")
+	maxMediaSize = flag.Int64("maxmediasize", 64, "Maximum size in MB of media sent from URLs or uploads")
+	mediaTimeout = flag.Duration("mediatimeout", 60*time.Second, "Timeout for fetching media sent from URLs")
+	allowPrivate = flag.Bool("allowprivateurls", false, "Allow fetching media from loopback, private and link-local addresses")
+	idemWindow   = flag.Duration("idempotencywindow", 24*time.Hour, "How long results of sends with an Idempotency-Key are kept")
+	ffmpegPath   = flag.String("ffmpeg", "", "Path to ffmpeg, used to extract video thumbnails and convert voice notes and stickers (disabled if empty)")
+	queueExpiry  = flag.Duration("queueexpiry", 24*time.Hour, "How long queued messages wait for their session before expiring")
+	queueRetries = flag.Int("queueretries", 5, "Number of attempts to send a queued message on transient errors")
+	ffprobePath  = flag.String("ffprobe", "", "Path to ffprobe, used to read video and audio metadata (disabled if empty)")
+	msgRetention = flag.Duration("messageretention", 30*24*time.Hour, "How long messages are kept for media downloads, quotes and forwards, and delivery states of sent messages (0 keeps them forever)")
+	container    *sqlstore.Container
+
+	killchannel    = make(map[int](chan bool))
+	userinfocache  = cache.New(5*time.Minute, 10*time.Minute)
+	settingscache  = cache.New(5*time.Minute, 10*time.Minute)
+	groupinfocache = cache.New(5*time.Minute, 10*time.Minute)
+	log            zerolog.Logger
 )
 
-func init() {
+// Parses the flags and sets up logging. Called from main rather than init so the package can be tested
+func setup() {
 
 	flag.Parse()
 
@@ -56,6 +73,8 @@ func init() {
 
 func main() {
 
+	setup()
+
 	ex, err := os.Executable()
 	if err != nil {
 		panic(err)
@@ -75,6 +94,10 @@ func main() {
 		*token = "1234ABC"
 	}
 
+	if *secret == "" {
+		*secret = *token
+	}
+
 	db, err := sql.Open("sqlite", exPath+"/dbdata/users.db")
 	if err != nil {
 		log.Fatal().Err(err).Msg("Could not open/create " + exPath + "/dbdata/users.db")
@@ -82,10 +105,32 @@ func main() {
 	}
 	defer db.Close()
 
-	sqlStmt := `CREATE TABLE IF NOT EXISTS users (id INTEGER NOT NULL PRIMARY KEY, name TEXT NOT NULL, token TEXT NOT NULL, webhook TEXT NOT NULL default "", jid TEXT NOT NULL default "", qrcode TEXT NOT NULL default "", connected INTEGER, expiration INTEGER, events TEXT NOT NULL default "All");`
-	_, err = db.Exec(sqlStmt)
-	if err != nil {
-		panic(fmt.Sprintf("%q: %s\n", err, sqlStmt))
+	sqlStmts := []string{
+		`CREATE TABLE IF NOT EXISTS users (id INTEGER NOT NULL PRIMARY KEY, name TEXT NOT NULL, token TEXT NOT NULL, webhook TEXT NOT NULL default "", jid TEXT NOT NULL default "", qrcode TEXT NOT NULL default "", connected INTEGER, expiration INTEGER, events TEXT NOT NULL default "All");`,
+		`CREATE TABLE IF NOT EXISTS user_settings (user_id INTEGER NOT NULL, name TEXT NOT NULL, value TEXT NOT NULL default "", PRIMARY KEY (user_id, name));`,
+		`CREATE TABLE IF NOT EXISTS messages (user_id INTEGER NOT NULL, id TEXT NOT NULL, chat TEXT NOT NULL, sender TEXT NOT NULL, fromme INTEGER NOT NULL default 0, timestamp INTEGER NOT NULL, message BLOB, PRIMARY KEY (user_id, id));`,
+		`CREATE INDEX IF NOT EXISTS messages_timestamp ON messages (timestamp);`,
+		`CREATE TABLE IF NOT EXISTS scheduled_messages (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, send_at INTEGER NOT NULL, timezone TEXT NOT NULL default "UTC", status TEXT NOT NULL, message_id TEXT NOT NULL default "", error TEXT NOT NULL default "", sent_at INTEGER, created INTEGER NOT NULL, request TEXT NOT NULL);`,
+		`CREATE INDEX IF NOT EXISTS scheduled_messages_due ON scheduled_messages (status, send_at);`,
+		`CREATE INDEX IF NOT EXISTS scheduled_messages_user_due ON scheduled_messages (user_id, status, send_at);`,
+		`CREATE TABLE IF NOT EXISTS campaigns (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, name TEXT NOT NULL default "", status TEXT NOT NULL, type TEXT NOT NULL, content TEXT NOT NULL, options TEXT NOT NULL, interval_ms INTEGER NOT NULL, created INTEGER NOT NULL, finished INTEGER);`,
+		`CREATE TABLE IF NOT EXISTS campaign_recipients (id INTEGER PRIMARY KEY AUTOINCREMENT, campaign_id INTEGER NOT NULL, recipient TEXT NOT NULL, variables TEXT NOT NULL default "{}", status TEXT NOT NULL, message_id TEXT NOT NULL default "", error TEXT NOT NULL default "", updated INTEGER NOT NULL);`,
+		`CREATE INDEX IF NOT EXISTS campaign_recipients_campaign ON campaign_recipients (campaign_id, status);`,
+		`CREATE INDEX IF NOT EXISTS campaign_recipients_message ON campaign_recipients (message_id);`,
+		`CREATE TABLE IF NOT EXISTS outbound_queue (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, status TEXT NOT NULL, message_id TEXT NOT NULL, attempts INTEGER NOT NULL default 0, error TEXT NOT NULL default "", next_attempt INTEGER NOT NULL, expires INTEGER NOT NULL, sent_at INTEGER, created INTEGER NOT NULL, request TEXT NOT NULL);`,
+		`CREATE INDEX IF NOT EXISTS outbound_queue_pending ON outbound_queue (status, user_id, id);`,
+		`CREATE TABLE IF NOT EXISTS message_status (user_id INTEGER NOT NULL, id TEXT NOT NULL, chat TEXT NOT NULL, status TEXT NOT NULL, error TEXT NOT NULL default "", sent INTEGER, failed INTEGER, created INTEGER NOT NULL default 0, PRIMARY KEY (user_id, id));`,
+		`CREATE INDEX IF NOT EXISTS message_status_created ON message_status (created);`,
+		`CREATE TABLE IF NOT EXISTS message_receipts (user_id INTEGER NOT NULL, id TEXT NOT NULL, recipient TEXT NOT NULL, delivered_at INTEGER, read_at INTEGER, played_at INTEGER, PRIMARY KEY (user_id, id, recipient));`,
+		`CREATE TABLE IF NOT EXISTS message_templates (user_id INTEGER NOT NULL, name TEXT NOT NULL, type TEXT NOT NULL, content TEXT NOT NULL, created INTEGER NOT NULL, updated INTEGER NOT NULL, PRIMARY KEY (user_id, name));`,
+		`CREATE TABLE IF NOT EXISTS disappearing_timers (user_id INTEGER NOT NULL, chat TEXT NOT NULL, timer INTEGER NOT NULL, updated INTEGER NOT NULL, PRIMARY KEY (user_id, chat));`,
+		`CREATE TABLE IF NOT EXISTS idempotency_keys (user_id INTEGER NOT NULL, key TEXT NOT NULL, hash TEXT NOT NULL, response TEXT NOT NULL, created INTEGER NOT NULL, PRIMARY KEY (user_id, key));`,
+	}
+	for _, sqlStmt := range sqlStmts {
+		_, err = db.Exec(sqlStmt)
+		if err != nil {
+			panic(fmt.Sprintf("%q: %s\n", err, sqlStmt))
+		}
 	}
 
 	CreateAdminUser(db, token)
@@ -107,6 +152,12 @@ func main() {
 	}
 	s.routes()
 
+	startMediaWorkers(*mediaWorks)
+	startMessagePruning(db)
+	startScheduler(db)
+	startCampaigns(db)
+	startQueue(db)
+
 	s.connectOnStartup()
 
 	srv := &http.Server{
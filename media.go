@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+var mediaTypes = []string{"image", "audio", "video", "document", "sticker"}
+var mediaModes = []string{"eager", "lazy", "off"}
+
+// How long signed media links sent on webhooks remain valid
+const mediaLinkValidity = 7 * 24 * time.Hour
+
+// Media handling policy for incoming messages, configured per user
+type mediaPolicy struct {
+	Mode    string            // eager (download and attach to webhook), lazy (send a signed link) or off
+	Types   map[string]string // per media type mode overrides
+	MaxSize uint64            // media larger than this (in bytes) is never downloaded, 0 means no limit
+}
+
+// Media attachment found in a message
+type mediaInfo struct {
+	Type     string
+	Mimetype string
+	FileName string
+	Size     uint64
+	message  whatsmeow.DownloadableMessage
+}
+
+// Download job processed by the media worker pool
+type mediaJob struct {
+	mycli    *MyClient
+	id       string
+	media    *mediaInfo
+	delivery *webhookDelivery
+}
+
+var mediaJobs = make(chan mediaJob, 256)
+
+// Gets the media policy for a user, defaults to eager download of every media type
+func getMediaPolicy(db *sql.DB, userid int) mediaPolicy {
+	policy := mediaPolicy{Mode: "eager"}
+	err := getUserSetting(db, userid, "mediapolicy", &policy)
+	if err != nil {
+		log.Warn().Err(err).Int("userid", userid).Msg("Could not load media policy, using default")
+	}
+	return policy
+}
+
+// Checks the policy only contains known modes and media types
+func (p mediaPolicy) validate() error {
+	if !Find(mediaModes, p.Mode) {
+		return fmt.Errorf("Invalid Mode %q, must be one of eager, lazy or off", p.Mode)
+	}
+	for mediatype, mode := range p.Types {
+		if !Find(mediaTypes, mediatype) {
+			return fmt.Errorf("Invalid media type %q in Types", mediatype)
+		}
+		if !Find(mediaModes, mode) {
+			return fmt.Errorf("Invalid Mode %q for %s, must be one of eager, lazy or off", mode, mediatype)
+		}
+	}
+	return nil
+}
+
+// Returns how a given media attachment should be handled
+func (p mediaPolicy) modeFor(media *mediaInfo) string {
+	if p.MaxSize > 0 && media.Size > p.MaxSize {
+		return "off"
+	}
+	mode := p.Mode
+	if override, ok := p.Types[media.Type]; ok {
+		mode = override
+	}
+	if mode == "" {
+		mode = "eager"
+	}
+	return mode
+}
+
+// Returns the downloadable attachment of a message, if any
+func getMediaInfo(msg *waProto.Message) *mediaInfo {
+	if msg == nil {
+		return nil
+	}
+	if img := msg.GetImageMessage(); img != nil {
+		return &mediaInfo{Type: "image", Mimetype: img.GetMimetype(), Size: img.GetFileLength(), message: img}
+	}
+	if audio := msg.GetAudioMessage(); audio != nil {
+		return &mediaInfo{Type: "audio", Mimetype: audio.GetMimetype(), Size: audio.GetFileLength(), message: audio}
+	}
+	if video := msg.GetVideoMessage(); video != nil {
+		return &mediaInfo{Type: "video", Mimetype: video.GetMimetype(), Size: video.GetFileLength(), message: video}
+	}
+	if document := msg.GetDocumentMessage(); document != nil {
+		return &mediaInfo{Type: "document", Mimetype: document.GetMimetype(), FileName: document.GetFileName(), Size: document.GetFileLength(), message: document}
+	}
+	if sticker := msg.GetStickerMessage(); sticker != nil {
+		return &mediaInfo{Type: "sticker", Mimetype: sticker.GetMimetype(), Size: sticker.GetFileLength(), message: sticker}
+	}
+	return nil
+}
+
+// Webhook representation of a media attachment
+func (media *mediaInfo) webhookData() map[string]interface{} {
+	return map[string]interface{}{
+		"type":     media.Type,
+		"mimetype": media.Mimetype,
+		"filename": media.FileName,
+		"size":     media.Size,
+	}
+}
+
+// File extension used to store a media attachment
+func (media *mediaInfo) extension() string {
+	exts, err := mime.ExtensionsByType(media.Mimetype)
+	if err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	// The file name is chosen by the sender, its extension is only kept if it is plain
+	ext := filepath.Ext(media.FileName)
+	if len(ext) < 2 || len(ext) > 10 || !validMessageID(ext[1:]) {
+		return ""
+	}
+	return ext
+}
+
+// Checks/creates user directory for files
+func userDirectory(exPath string, txtid string) (string, error) {
+	userDirectory := fmt.Sprintf("%s/files/user_%s", exPath, txtid)
+	_, err := os.Stat(userDirectory)
+	if os.IsNotExist(err) {
+		errDir := os.MkdirAll(userDirectory, 0751)
+		if errDir != nil {
+			return "", errDir
+		}
+	}
+	return userDirectory, nil
+}
+
+// Downloads a media attachment into the user directory, returning the cached copy if already downloaded
+func downloadMedia(client *whatsmeow.Client, exPath string, userid int, id string, media *mediaInfo) (string, error) {
+	// IDs of received messages are chosen by the sender, only plain IDs are used in file names
+	if id == "" || !validMessageID(id) {
+		return "", fmt.Errorf("Invalid message ID %q", id)
+	}
+	directory, err := userDirectory(exPath, strconv.Itoa(userid))
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(directory, id+media.extension())
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if client == nil {
+		return "", errors.New("No session")
+	}
+	data, err := client.Download(media.message)
+	if err != nil {
+		return "", fmt.Errorf("Failed to download %s: %v", media.Type, err)
+	}
+	// Write to a temporary file first so concurrent readers never see partial files. Each download
+	// has its own temporary file, concurrent downloads of the same media just replace each other
+	tmpfile, err := os.CreateTemp(directory, id+"-*.part")
+	if err != nil {
+		return "", fmt.Errorf("Failed to save %s: %v", media.Type, err)
+	}
+	_, err = tmpfile.Write(data)
+	if closeErr := tmpfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return "", fmt.Errorf("Failed to save %s: %v", media.Type, err)
+	}
+	log.Info().Str("path", path).Msg("Media saved")
+	return path, nil
+}
+
+// Signature for a media link
+func signMediaLink(userid int, id string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(*secret))
+	mac.Write([]byte(fmt.Sprintf("%d:%s:%d", userid, id, expires)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Validates a media link signature and expiration
+func checkMediaLink(userid int, id string, expires int64, signature string) bool {
+	if time.Now().Unix() > expires {
+		return false
+	}
+	expected := signMediaLink(userid, id, expires)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// Builds a signed link to the /media endpoint for a message
+func mediaLink(userid int, id string) string {
+	base := *baseURL
+	if base == "" {
+		scheme := "http"
+		if *sslcert != "" {
+			scheme = "https"
+		}
+		base = fmt.Sprintf("%s://%s:%s", scheme, *address, *port)
+	}
+	expires := time.Now().Add(mediaLinkValidity).Unix()
+	query := url.Values{}
+	query.Set("user", strconv.Itoa(userid))
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("sig", signMediaLink(userid, id, expires))
+	return fmt.Sprintf("%s/media/%s?%s", base, url.PathEscape(id), query.Encode())
+}
+
+// Starts the pool of workers downloading media off the whatsmeow event loop
+func startMediaWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range mediaJobs {
+				job.run()
+			}
+		}()
+	}
+}
+
+// Queues a media download, returns false if the pool is saturated
+func queueMediaDownload(job mediaJob) bool {
+	select {
+	case mediaJobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// Downloads the media and releases the pending webhook delivery with the file attached
+func (job mediaJob) run() {
+	defer close(job.delivery.ready)
+	path, err := downloadMedia(job.mycli.WAClient, job.mycli.exPath, job.mycli.userID, job.id, job.media)
+	if err != nil {
+		log.Error().Err(err).Str("id", job.id).Msg("Failed to download media")
+		job.delivery.postmap["media"].(map[string]interface{})["error"] = err.Error()
+		return
+	}
+	job.delivery.path = path
+}
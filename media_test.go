@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMediaExtension(t *testing.T) {
+	tests := []struct {
+		mimetype string
+		filename string
+		want     string
+	}{
+		{"image/png", "", ".png"},
+		{"application/x-unknown", "report.XLSB", ".XLSB"},
+		{"application/x-unknown", "archive.tar.gz", ".gz"},
+		{"application/x-unknown", "no extension", ""},
+		{"application/x-unknown", "evil.pdf/../../../etc/passwd", ""},
+		{"application/x-unknown", "evil.p df", ""},
+		{"application/x-unknown", "evil.verylongextension", ""},
+		{"application/x-unknown", "trailing.", ""},
+	}
+	for _, tt := range tests {
+		media := &mediaInfo{Mimetype: tt.mimetype, FileName: tt.filename}
+		if got := media.extension(); got != tt.want {
+			t.Errorf("extension(%q, %q) = %q, want %q", tt.mimetype, tt.filename, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadMediaInvalidID(t *testing.T) {
+	dir := t.TempDir()
+	media := &mediaInfo{Type: "image", Mimetype: "image/jpeg"}
+	for _, id := range []string{"../../../etc/passwd", "3EB0/../x", "", strings.Repeat("A", 65)} {
+		if _, err := downloadMedia(nil, dir, 1, id, media); err == nil || !strings.HasPrefix(err.Error(), "Invalid message ID") {
+			t.Errorf("downloadMedia(%q) = %v, want an invalid ID error", id, err)
+		}
+	}
+	// Valid IDs get as far as the download
+	if _, err := downloadMedia(nil, dir, 1, "3EB06F9067F80BAB89FF", media); err == nil || err.Error() != "No session" {
+		t.Errorf("downloadMedia() = %v, want No session", err)
+	}
+}
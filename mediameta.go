@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Size of the thumbnails shown while media is downloaded
+const mediaThumbnailSize = 100
+
+// Dimensions, duration and thumbnail of an image, video or audio
+type mediaMetadata struct {
+	Width     int
+	Height    int
+	Duration  time.Duration
+	Thumbnail []byte
+}
+
+// Duration in whole seconds, rounded up so short clips don't show as 0:00
+func (m *mediaMetadata) seconds() uint32 {
+	return uint32((m.Duration + time.Second - 1) / time.Second)
+}
+
+// Gets the dimensions and a JPEG thumbnail of an image
+func imageMetadata(data []byte) (*mediaMetadata, error) {
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	thumbnail, _, _, err := jpegThumbnail(img, mediaThumbnailSize)
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	return &mediaMetadata{Width: bounds.Dx(), Height: bounds.Dy(), Thumbnail: thumbnail}, nil
+}
+
+// Gets the duration and dimensions of a video from its mp4 headers, falling back to ffprobe,
+// and extracts a thumbnail with ffmpeg when configured and wanted
+func videoMetadata(data []byte, thumbnail bool) *mediaMetadata {
+	meta, err := mp4Metadata(data)
+	if err != nil || meta.Width == 0 {
+		if probed, err := probeMedia(data); err == nil {
+			meta = probed
+		} else if meta == nil {
+			meta = &mediaMetadata{}
+		}
+	}
+	if !thumbnail || *ffmpegPath == "" {
+		return meta
+	}
+	// Skip the first frame, often black, unless the video is too short
+	at := "1"
+	if meta.Duration > 0 && meta.Duration < 2*time.Second {
+		at = "0"
+	}
+	frame, err := runFFmpeg(data, "-ss", at, "-frames:v", "1", "-f", "image2", "-c:v", "mjpeg", "pipe:1")
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not extract video thumbnail")
+		return meta
+	}
+	img, err := decodeImage(frame)
+	if err == nil {
+		meta.Thumbnail, _, _, err = jpegThumbnail(img, mediaThumbnailSize)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not create video thumbnail")
+	}
+	return meta
+}
+
+// Gets the duration of an ogg or mp4 audio, falling back to ffprobe
+func audioMetadata(data []byte, mimetype string) *mediaMetadata {
+	var meta *mediaMetadata
+	var err error
+	switch {
+	case strings.HasPrefix(mimetype, "audio/ogg") || strings.HasPrefix(mimetype, "application/ogg"):
+		meta, err = oggMetadata(data)
+	default:
+		meta, err = mp4Metadata(data)
+	}
+	if err == nil && meta.Duration > 0 {
+		return meta
+	}
+	if probed, err := probeMedia(data); err == nil {
+		return probed
+	}
+	return &mediaMetadata{}
+}
+
+// Normalizes a thumbnail given by the client to a small JPEG
+func clientThumbnail(data []byte) ([]byte, error) {
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, badRequest("Could not decode thumbnail image")
+	}
+	thumbnail, _, _, err := jpegThumbnail(img, mediaThumbnailSize)
+	return thumbnail, err
+}
+
+// Reads the duration from the mvhd box and the dimensions of the first video track from the tkhd boxes
+func mp4Metadata(data []byte) (*mediaMetadata, error) {
+	moov := mp4Box(data, "moov")
+	if moov == nil {
+		return nil, errors.New("no moov box found")
+	}
+	meta := &mediaMetadata{}
+	if mvhd := mp4Box(moov, "mvhd"); len(mvhd) >= 32 {
+		var timescale, duration uint64
+		if mvhd[0] == 1 {
+			timescale = uint64(binary.BigEndian.Uint32(mvhd[20:]))
+			duration = binary.BigEndian.Uint64(mvhd[24:])
+		} else {
+			timescale = uint64(binary.BigEndian.Uint32(mvhd[12:]))
+			duration = uint64(binary.BigEndian.Uint32(mvhd[16:]))
+		}
+		if timescale > 0 {
+			meta.Duration = time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+		}
+	}
+	for _, trak := range mp4Boxes(moov, "trak") {
+		tkhd := mp4Box(trak, "tkhd")
+		// Matrix and dimensions come after the version dependent times and duration
+		offset := 40
+		if len(tkhd) > 0 && tkhd[0] == 1 {
+			offset = 52
+		}
+		if len(tkhd) < offset+44 {
+			continue
+		}
+		width := int(binary.BigEndian.Uint32(tkhd[offset+36:]) >> 16)
+		height := int(binary.BigEndian.Uint32(tkhd[offset+40:]) >> 16)
+		if width == 0 || height == 0 {
+			continue
+		}
+		// A rotated video has a zero first matrix coefficient, its displayed dimensions are swapped
+		if binary.BigEndian.Uint32(tkhd[offset:]) == 0 {
+			width, height = height, width
+		}
+		meta.Width, meta.Height = width, height
+		break
+	}
+	return meta, nil
+}
+
+// Returns the content of the first box of a type in an mp4 container
+func mp4Box(data []byte, kind string) []byte {
+	boxes := mp4Boxes(data, kind)
+	if len(boxes) == 0 {
+		return nil
+	}
+	return boxes[0]
+}
+
+// Returns the content of the boxes of a type in an mp4 container
+func mp4Boxes(data []byte, kind string) [][]byte {
+	var boxes [][]byte
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return boxes
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return boxes
+		}
+		if string(data[4:8]) == kind {
+			boxes = append(boxes, data[header:size])
+		}
+		data = data[size:]
+	}
+	return boxes
+}
+
+// Reads the duration of an Opus or Vorbis ogg file from the granule position of its last page
+func oggMetadata(data []byte) (*mediaMetadata, error) {
+	if !bytes.HasPrefix(data, []byte("OggS")) || len(data) < 27 || len(data) < 27+int(data[26]) {
+		return nil, errors.New("not an ogg file")
+	}
+	// The first page holds the codec identification header
+	header := data[27+int(data[26]):]
+	var rate, skip uint64
+	switch {
+	case bytes.HasPrefix(header, []byte("OpusHead")) && len(header) >= 12:
+		// Opus granule positions always count samples at 48kHz, after a pre-skip
+		rate = 48000
+		skip = uint64(binary.LittleEndian.Uint16(header[10:]))
+	case bytes.HasPrefix(header, []byte("\x01vorbis")) && len(header) >= 16:
+		rate = uint64(binary.LittleEndian.Uint32(header[12:]))
+	default:
+		return nil, errors.New("unsupported ogg codec")
+	}
+	last := bytes.LastIndex(data, []byte("OggS"))
+	if rate == 0 || last < 0 || len(data) < last+14 {
+		return nil, errors.New("invalid ogg file")
+	}
+	granule := binary.LittleEndian.Uint64(data[last+6:])
+	if granule == ^uint64(0) || granule < skip {
+		return nil, fmt.Errorf("invalid granule position %d", granule)
+	}
+	return &mediaMetadata{Duration: time.Duration(float64(granule-skip) / float64(rate) * float64(time.Second))}, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func encodePNG(width int, height int) []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)))
+	return buf.Bytes()
+}
+
+// PNG header claiming the given dimensions, with no image data
+func pngBomb(width uint32, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12] = 8 // bit depth, grayscale
+	data := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d")
+	data = append(data, ihdr...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(ihdr))
+	return append(data, crc...)
+}
+
+func TestImageMetadata(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		width  int
+		height int
+		ok     bool
+	}{
+		{"landscape", encodePNG(200, 100), 200, 100, true},
+		{"portrait", encodePNG(30, 60), 30, 60, true},
+		{"too many pixels", pngBomb(100000, 100000), 0, 0, false},
+		{"too wide", pngBomb(maxImagePixels+1, 1), 0, 0, false},
+		{"not an image", []byte("hello"), 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := imageMetadata(tt.data)
+			if (err == nil) != tt.ok {
+				t.Fatalf("imageMetadata() error = %v, want ok %v", err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+			if meta.Width != tt.width || meta.Height != tt.height || len(meta.Thumbnail) == 0 {
+				t.Errorf("got %dx%d with %d bytes thumbnail, want %dx%d", meta.Width, meta.Height, len(meta.Thumbnail), tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestClientThumbnailSize(t *testing.T) {
+	if _, err := clientThumbnail(pngBomb(100000, 100000)); err == nil {
+		t.Error("oversized thumbnail accepted")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/patrickmn/go-cache"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Phone numbers written as @5491155554444 in a text or caption
+var mentionPattern = regexp.MustCompile(`@(\d{5,20})\b`)
+
+// Message types with a text or caption that can hold mentions
+var mentionTypes = map[string]bool{"text": true, "image": true, "video": true, "document": true}
+
+// Works out the JIDs mentioned by a message: the Mentions option, MentionedJid of the raw ContextInfo,
+// @number tokens of the text, and every participant with MentionAll. In groups, explicit mentions must
+// be participants and tokens that are not are left as plain text. MentionAll is only allowed for admins
+func resolveMentions(client *whatsmeow.Client, userid int, recipient types.JID, req *sendRequest, text string) ([]string, error) {
+	explicit := req.Options.Mentions
+	if req.Options.ContextInfo != nil {
+		explicit = append(explicit, req.Options.ContextInfo.MentionedJid...)
+	}
+	if len(explicit) == 0 && !req.Options.MentionAll && !strings.Contains(text, "@") {
+		return nil, nil
+	}
+	if (len(explicit) > 0 || req.Options.MentionAll) && !mentionTypes[req.Type] {
+		return nil, badRequest("Mentions are only supported for text, image, video and document messages")
+	}
+
+	mentions := []string{}
+	seen := make(map[string]bool)
+	add := func(jid types.JID) {
+		if !seen[jid.String()] {
+			seen[jid.String()] = true
+			mentions = append(mentions, jid.String())
+		}
+	}
+
+	explicitJIDs := []types.JID{}
+	for _, mention := range explicit {
+		jid, ok := parseJID(mention)
+		if !ok || jid.Server != types.DefaultUserServer {
+			return nil, badRequest(fmt.Sprintf("Invalid mention %q", mention))
+		}
+		explicitJIDs = append(explicitJIDs, jid.ToNonAD())
+	}
+	detected := []types.JID{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		detected = append(detected, types.NewJID(match[1], types.DefaultUserServer))
+	}
+	if len(explicitJIDs) == 0 && len(detected) == 0 && !req.Options.MentionAll {
+		return nil, nil
+	}
+
+	if recipient.Server != types.GroupServer {
+		if req.Options.MentionAll {
+			return nil, badRequest("MentionAll is only supported in groups")
+		}
+		for _, jid := range append(explicitJIDs, detected...) {
+			add(jid)
+		}
+		return mentions, nil
+	}
+
+	info, err := getGroupInfo(client, userid, recipient)
+	if err != nil {
+		return nil, fmt.Errorf("Could not get group info to check mentions: %v", err)
+	}
+	participants := make(map[types.JID]bool)
+	admin := false
+	for _, participant := range info.Participants {
+		participants[participant.JID.ToNonAD()] = true
+		if client.Store.ID != nil && participant.JID.User == client.Store.ID.User {
+			admin = participant.IsAdmin || participant.IsSuperAdmin
+		}
+	}
+
+	for _, jid := range explicitJIDs {
+		if !participants[jid] {
+			return nil, badRequest(fmt.Sprintf("%s is not a participant of the group", jid.User))
+		}
+		add(jid)
+	}
+	for _, jid := range detected {
+		if participants[jid] {
+			add(jid)
+		}
+	}
+	if req.Options.MentionAll {
+		if !admin {
+			return nil, &sendError{Status: http.StatusForbidden, Err: fmt.Errorf("Only group admins can mention everyone")}
+		}
+		for _, participant := range info.Participants {
+			if client.Store.ID == nil || participant.JID.User != client.Store.ID.User {
+				add(participant.JID.ToNonAD())
+			}
+		}
+	}
+	return mentions, nil
+}
+
+// Gets the participants of a group, cached so mentions in a burst of messages don't query WhatsApp each time.
+// Participant changes received by the session drop the cached entry
+func getGroupInfo(client *whatsmeow.Client, userid int, group types.JID) (*types.GroupInfo, error) {
+	key := fmt.Sprintf("%d:%s", userid, group)
+	if cached, found := groupinfocache.Get(key); found {
+		return cached.(*types.GroupInfo), nil
+	}
+	info, err := client.GetGroupInfo(group)
+	if err != nil {
+		return nil, err
+	}
+	groupinfocache.Set(key, info, cache.DefaultExpiration)
+	return info, nil
+}
+
+func forgetGroupInfo(userid int, group types.JID) {
+	groupinfocache.Delete(fmt.Sprintf("%d:%s", userid, group))
+}
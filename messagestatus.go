@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Maximum number of message IDs in a bulk status lookup
+const maxStatusLookup = 500
+
+// Delivery states of sent messages, from least to most advanced. Failed messages never advance
+var messageStates = []string{"sending", "sent", "delivered", "read", "played"}
+
+// Delivery state of a sent message. Status is the most advanced state reached by any recipient,
+// group messages have one entry in Recipients for each participant that sent a receipt
+type messageStatus struct {
+	Id         string
+	Chat       string
+	Status     string     // sending, sent, delivered, read, played or failed
+	Error      string     `json:",omitempty"`
+	Sent       *time.Time `json:",omitempty"`
+	Failed     *time.Time `json:",omitempty"`
+	Recipients []*recipientStatus
+}
+
+type recipientStatus struct {
+	Jid       string
+	Status    string     // delivered, read or played
+	Delivered *time.Time `json:",omitempty"`
+	Read      *time.Time `json:",omitempty"`
+	Played    *time.Time `json:",omitempty"`
+}
+
+// Records a message about to be sent. Its row exists before the send returns, since receipts may arrive first
+func recordMessageSending(db *sql.DB, userid int, id string, chat types.JID) {
+	sqlStmt := `INSERT OR REPLACE INTO message_status (user_id, id, chat, status, error, sent, failed, created) VALUES (?, ?, ?, 'sending', '', NULL, NULL, ?)`
+	_, err := db.Exec(sqlStmt, userid, id, chat.String(), time.Now().Unix())
+	if err != nil {
+		log.Warn().Err(err).Str("id", id).Msg(sqlStmt)
+	}
+}
+
+// Records a message acknowledged by the server
+func recordMessageSent(db *sql.DB, userid int, id string, timestamp time.Time) {
+	sqlStmt := `UPDATE message_status SET sent=?, status=CASE WHEN status='sending' THEN 'sent' ELSE status END WHERE user_id=? AND id=?`
+	_, err := db.Exec(sqlStmt, timestamp.Unix(), userid, id)
+	if err != nil {
+		log.Warn().Err(err).Str("id", id).Msg(sqlStmt)
+	}
+}
+
+// Records a message that could not be sent
+func recordMessageFailed(db *sql.DB, userid int, id string, sendErr error) {
+	sqlStmt := `UPDATE message_status SET status='failed', error=?, failed=? WHERE user_id=? AND id=?`
+	_, err := db.Exec(sqlStmt, sendErr.Error(), time.Now().Unix(), userid, id)
+	if err != nil {
+		log.Warn().Err(err).Str("id", id).Msg(sqlStmt)
+	}
+}
+
+// Records a delivery, read or played receipt for messages sent by the session. A read message
+// was also delivered, and a played one also read, even if those receipts never arrive
+func (mycli *MyClient) recordReceipt(evt *events.Receipt) {
+	var state string
+	switch evt.Type {
+	case events.ReceiptTypeDelivered:
+		state = "delivered"
+	case events.ReceiptTypeRead:
+		state = "read"
+	case events.ReceiptTypePlayed:
+		state = "played"
+	default:
+		return
+	}
+	if evt.IsFromMe {
+		return
+	}
+	ts := evt.Timestamp.Unix()
+	var delivered, read, played interface{} = ts, nil, nil
+	if state == "read" || state == "played" {
+		read = ts
+	}
+	if state == "played" {
+		played = ts
+	}
+	recipient := evt.Sender.ToNonAD().String()
+	lower := "'" + strings.Join(messageStates[:stateRank(state)], "','") + "'"
+	for _, id := range evt.MessageIDs {
+		sqlStmt := `INSERT INTO message_receipts (user_id, id, recipient, delivered_at, read_at, played_at)
+			SELECT ?, ?, ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM message_status WHERE user_id=? AND id=?)
+			ON CONFLICT (user_id, id, recipient) DO UPDATE SET delivered_at=COALESCE(delivered_at, excluded.delivered_at),
+			read_at=COALESCE(read_at, excluded.read_at), played_at=COALESCE(played_at, excluded.played_at)`
+		_, err := mycli.db.Exec(sqlStmt, mycli.userID, id, recipient, delivered, read, played, mycli.userID, id)
+		if err != nil {
+			log.Warn().Err(err).Str("id", id).Msg("Could not record receipt")
+			continue
+		}
+		_, err = mycli.db.Exec("UPDATE message_status SET status=? WHERE user_id=? AND id=? AND status IN ("+lower+")", state, mycli.userID, id)
+		if err != nil {
+			log.Warn().Err(err).Str("id", id).Msg("Could not update message status")
+		}
+	}
+}
+
+// Position of a state in messageStates
+func stateRank(state string) int {
+	for i, s := range messageStates {
+		if s == state {
+			return i
+		}
+	}
+	return -1
+}
+
+func unixTime(value sql.NullInt64) *time.Time {
+	if !value.Valid {
+		return nil
+	}
+	t := time.Unix(value.Int64, 0)
+	return &t
+}
+
+// Gets the delivery state of sent messages with their recipients. Unknown IDs are left out
+func getMessageStatuses(db *sql.DB, userid int, ids []string) ([]*messageStatus, error) {
+	if len(ids) == 0 {
+		return []*messageStatus{}, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := []interface{}{userid}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	rows, err := db.Query("SELECT id, chat, status, error, sent, failed FROM message_status WHERE user_id=? AND id IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	byId := make(map[string]*messageStatus)
+	for rows.Next() {
+		var sent, failed sql.NullInt64
+		m := &messageStatus{Recipients: []*recipientStatus{}}
+		if err := rows.Scan(&m.Id, &m.Chat, &m.Status, &m.Error, &sent, &failed); err != nil {
+			return nil, err
+		}
+		m.Sent, m.Failed = unixTime(sent), unixTime(failed)
+		byId[m.Id] = m
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query("SELECT id, recipient, delivered_at, read_at, played_at FROM message_receipts WHERE user_id=? AND id IN ("+placeholders+") ORDER BY recipient", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var delivered, read, played sql.NullInt64
+		r := &recipientStatus{}
+		if err := rows.Scan(&id, &r.Jid, &delivered, &read, &played); err != nil {
+			return nil, err
+		}
+		r.Delivered, r.Read, r.Played = unixTime(delivered), unixTime(read), unixTime(played)
+		switch {
+		case played.Valid:
+			r.Status = "played"
+		case read.Valid:
+			r.Status = "read"
+		default:
+			r.Status = "delivered"
+		}
+		if m, ok := byId[id]; ok {
+			m.Recipients = append(m.Recipients, r)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Keep the order of the requested IDs
+	list := []*messageStatus{}
+	for _, id := range ids {
+		if m, ok := byId[id]; ok {
+			list = append(list, m)
+			delete(byId, id)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// Message as kept in the local message store
+type storedMessage struct {
+	ID        string
+	Chat      types.JID
+	Sender    types.JID
+	IsFromMe  bool
+	Timestamp int64
+	Message   *waProto.Message
+}
+
+// Saves a received or sent message so it can be referenced later (media downloads, quotes, forwards)
+func storeMessage(db *sql.DB, userid int, info *types.MessageInfo, msg *waProto.Message) {
+	if msg == nil || info.ID == "" {
+		return
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		log.Warn().Err(err).Str("id", info.ID).Msg("Could not marshal message for store")
+		return
+	}
+	sqlStmt := `INSERT OR REPLACE INTO messages (user_id, id, chat, sender, fromme, timestamp, message) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err = db.Exec(sqlStmt, userid, info.ID, info.Chat.String(), info.Sender.String(), info.IsFromMe, info.Timestamp.Unix(), data)
+	if err != nil {
+		log.Warn().Err(err).Str("id", info.ID).Msg(sqlStmt)
+	}
+}
+
+// How often messages older than the retention are removed from the store
+const messagePruneInterval = time.Hour
+
+// Starts the background loop removing messages older than the -messageretention flag
+func startMessagePruning(db *sql.DB) {
+	if *msgRetention <= 0 {
+		return
+	}
+	go func() {
+		for {
+			before := time.Now().Add(-*msgRetention)
+			pruneMessages(db, before)
+			pruneMessageStatus(db, before)
+			time.Sleep(messagePruneInterval)
+		}
+	}()
+}
+
+// Removes stored messages sent or received before a given time
+func pruneMessages(db *sql.DB, before time.Time) {
+	res, err := db.Exec("DELETE FROM messages WHERE timestamp<?", before.Unix())
+	if err != nil {
+		log.Error().Err(err).Msg("Could not prune stored messages")
+		return
+	}
+	if count, _ := res.RowsAffected(); count > 0 {
+		log.Info().Int64("count", count).Msg("Pruned stored messages")
+	}
+}
+
+// Removes the delivery status of messages sent before a given time, with their receipts
+func pruneMessageStatus(db *sql.DB, before time.Time) {
+	res, err := db.Exec("DELETE FROM message_status WHERE created<?", before.Unix())
+	if err != nil {
+		log.Error().Err(err).Msg("Could not prune message status")
+		return
+	}
+	if count, _ := res.RowsAffected(); count > 0 {
+		log.Info().Int64("count", count).Msg("Pruned message status")
+	}
+	// Receipts are only stored for tracked messages, the ones left are those of pruned messages
+	_, err = db.Exec("DELETE FROM message_receipts WHERE NOT EXISTS (SELECT 1 FROM message_status s WHERE s.user_id=message_receipts.user_id AND s.id=message_receipts.id)")
+	if err != nil {
+		log.Error().Err(err).Msg("Could not prune message receipts")
+	}
+}
+
+// Retrieves a message from the local message store, returns sql.ErrNoRows if it is unknown
+func getStoredMessage(db *sql.DB, userid int, id string) (*storedMessage, error) {
+	var chat, sender string
+	var data []byte
+	sm := &storedMessage{ID: id}
+	err := db.QueryRow("SELECT chat, sender, fromme, timestamp, message FROM messages WHERE user_id=? AND id=? LIMIT 1", userid, id).Scan(&chat, &sender, &sm.IsFromMe, &sm.Timestamp, &data)
+	if err != nil {
+		return nil, err
+	}
+	sm.Chat, _ = types.ParseJID(chat)
+	sm.Sender, _ = types.ParseJID(sender)
+	sm.Message = &waProto.Message{}
+	err = proto.Unmarshal(data, sm.Message)
+	if err != nil {
+		return nil, err
+	}
+	return sm, nil
+}
+
+// Replaces the text or caption of a stored message when it is edited. The rest of the message, such as
+// media keys and the quoted message, is kept so it can still be downloaded, quoted and forwarded
+func updateStoredText(db *sql.DB, userid int, id string, text string) {
+	stored, err := getStoredMessage(db, userid, id)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Warn().Err(err).Str("id", id).Msg("Could not load edited message")
+		}
+		return
+	}
+	if !setMessageText(stored.Message, text) {
+		return
+	}
+	data, err := proto.Marshal(stored.Message)
+	if err != nil {
+		log.Warn().Err(err).Str("id", id).Msg("Could not marshal message for store")
+		return
+	}
+	sqlStmt := `UPDATE messages SET message=? WHERE user_id=? AND id=?`
+	_, err = db.Exec(sqlStmt, data, userid, id)
+	if err != nil {
+		log.Warn().Err(err).Str("id", id).Msg(sqlStmt)
+	}
+}
+
+// Returns the text of a message, or the caption for media
+func messageText(msg *waProto.Message) string {
+	switch {
+	case msg.Conversation != nil:
+		return msg.GetConversation()
+	case msg.ExtendedTextMessage != nil:
+		return msg.ExtendedTextMessage.GetText()
+	case msg.ImageMessage != nil:
+		return msg.ImageMessage.GetCaption()
+	case msg.VideoMessage != nil:
+		return msg.VideoMessage.GetCaption()
+	case msg.DocumentMessage != nil:
+		return msg.DocumentMessage.GetCaption()
+	}
+	return ""
+}
+
+// Replaces the text of a message, or the caption for media. Returns false for other messages
+func setMessageText(msg *waProto.Message, text string) bool {
+	switch {
+	case msg.Conversation != nil:
+		msg.Conversation = proto.String(text)
+	case msg.ExtendedTextMessage != nil:
+		msg.ExtendedTextMessage.Text = proto.String(text)
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.Caption = proto.String(text)
+	case msg.VideoMessage != nil:
+		msg.VideoMessage.Caption = proto.String(text)
+	case msg.DocumentMessage != nil:
+		msg.DocumentMessage.Caption = proto.String(text)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Opens an in memory database with the given tables
+func newTestDB(t *testing.T, sqlStmts ...string) *sql.DB {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// Every connection would get its own in memory database
+	db.SetMaxOpenConns(1)
+	for _, sqlStmt := range sqlStmts {
+		if _, err := db.Exec(sqlStmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestUpdateStoredText(t *testing.T) {
+	db := newTestDB(t, `CREATE TABLE messages (user_id INTEGER NOT NULL, id TEXT NOT NULL, chat TEXT NOT NULL, sender TEXT NOT NULL, fromme INTEGER NOT NULL default 0, timestamp INTEGER NOT NULL, message BLOB, PRIMARY KEY (user_id, id));`)
+	quoted := &waProto.ContextInfo{StanzaId: proto.String("3EB06F9067F80BAB89FF")}
+	tests := []struct {
+		name   string
+		msg    *waProto.Message
+		edited bool
+	}{
+		{"text", &waProto.Message{Conversation: proto.String("Helo")}, true},
+		{"reply", &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{Text: proto.String("Helo"), ContextInfo: quoted}}, true},
+		{"image caption", &waProto.Message{ImageMessage: &waProto.ImageMessage{Caption: proto.String("Helo"), Url: proto.String("https://mmg.whatsapp.net/v/t62/1"), MediaKey: []byte{1, 2, 3}, DirectPath: proto.String("/v/t62/1")}}, true},
+		{"location", &waProto.Message{LocationMessage: &waProto.LocationMessage{DegreesLatitude: proto.Float64(-34.6)}}, false},
+	}
+	for i, tt := range tests {
+		id := fmt.Sprintf("MSG%d", i)
+		data, _ := proto.Marshal(tt.msg)
+		db.Exec("INSERT INTO messages (user_id, id, chat, sender, fromme, timestamp, message) VALUES (1, ?, 'chat', 'me', 1, 0, ?)", id, data)
+
+		updateStoredText(db, 1, id, "Hello")
+
+		stored, err := getStoredMessage(db, 1, id)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		// Everything but the text is kept, and messages without text are left untouched
+		want := proto.Clone(tt.msg).(*waProto.Message)
+		if tt.edited {
+			setMessageText(want, "Hello")
+		}
+		if !proto.Equal(stored.Message, want) {
+			t.Errorf("%s: stored %v, want %v", tt.name, stored.Message, want)
+		}
+	}
+	// Edits of unknown messages are ignored
+	updateStoredText(db, 1, "UNKNOWN", "Hello")
+}
+
+func TestPruneMessageStatus(t *testing.T) {
+	db := newTestDB(t,
+		`CREATE TABLE message_status (user_id INTEGER NOT NULL, id TEXT NOT NULL, chat TEXT NOT NULL, status TEXT NOT NULL, error TEXT NOT NULL default "", sent INTEGER, failed INTEGER, created INTEGER NOT NULL default 0, PRIMARY KEY (user_id, id));`,
+		`CREATE TABLE message_receipts (user_id INTEGER NOT NULL, id TEXT NOT NULL, recipient TEXT NOT NULL, delivered_at INTEGER, read_at INTEGER, played_at INTEGER, PRIMARY KEY (user_id, id, recipient));`,
+	)
+
+	now := time.Now()
+	messages := []struct {
+		userid  int
+		id      string
+		created time.Time
+	}{
+		{1, "OLD", now.Add(-48 * time.Hour)},
+		{1, "NEW", now},
+		{2, "OLD", now},
+	}
+	for _, m := range messages {
+		db.Exec("INSERT INTO message_status (user_id, id, chat, status, created) VALUES (?, ?, 'group', 'read', ?)", m.userid, m.id, m.created.Unix())
+		for _, recipient := range []string{"ana", "luis"} {
+			db.Exec("INSERT INTO message_receipts (user_id, id, recipient, read_at) VALUES (?, ?, ?, ?)", m.userid, m.id, recipient, m.created.Unix())
+		}
+	}
+
+	pruneMessageStatus(db, now.Add(-24*time.Hour))
+
+	tests := []struct {
+		userid   int
+		id       string
+		status   int
+		receipts int
+	}{
+		{1, "OLD", 0, 0},
+		{1, "NEW", 1, 2},
+		{2, "OLD", 1, 2},
+	}
+	for _, tt := range tests {
+		var status, receipts int
+		db.QueryRow("SELECT COUNT(*) FROM message_status WHERE user_id=? AND id=?", tt.userid, tt.id).Scan(&status)
+		db.QueryRow("SELECT COUNT(*) FROM message_receipts WHERE user_id=? AND id=?", tt.userid, tt.id).Scan(&receipts)
+		if status != tt.status || receipts != tt.receipts {
+			t.Errorf("user %d message %s: %d status and %d receipts, want %d and %d", tt.userid, tt.id, status, receipts, tt.status, tt.receipts)
+		}
+	}
+}
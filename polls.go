@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Maximum number of options WhatsApp accepts in a poll
+const maxPollOptions = 12
+
+// Returns the poll of a poll creation message, whichever version it was sent with
+func getPoll(msg *waProto.Message) *waProto.PollCreationMessage {
+	if poll := msg.GetPollCreationMessage(); poll != nil {
+		return poll
+	}
+	if poll := msg.GetPollCreationMessageV2(); poll != nil {
+		return poll
+	}
+	return msg.GetPollCreationMessageV3()
+}
+
+type pollContent struct {
+	Name            string
+	Options         []string
+	SelectableCount int
+}
+
+func buildPollMessage(ctx *sendContext, content json.RawMessage) (*waProto.Message, error) {
+	var t pollContent
+	if err := decodeContent(content, &t); err != nil {
+		return nil, err
+	}
+	if t.Name == "" {
+		return nil, badRequest("Missing Name in Payload")
+	}
+	if len(t.Options) < 2 || len(t.Options) > maxPollOptions {
+		return nil, badRequest("Options must have between 2 and 12 items")
+	}
+	seen := make(map[string]bool)
+	for _, option := range t.Options {
+		if option == "" {
+			return nil, badRequest("Options can not be empty")
+		}
+		if seen[option] {
+			return nil, badRequest("Options must be unique")
+		}
+		seen[option] = true
+	}
+	if t.SelectableCount < 0 || t.SelectableCount > len(t.Options) {
+		return nil, badRequest("SelectableCount must be between 0 (any number) and the number of Options")
+	}
+	return ctx.client.BuildPollCreation(t.Name, t.Options, t.SelectableCount), nil
+}
+
+// Decrypts a poll vote into a PollVote event with the selected option names, returns false for other messages.
+// Votes are encrypted with the poll secret, which whatsmeow keeps for sent and received polls,
+// and reference options by hash, which are matched against the poll kept in the message store
+func (mycli *MyClient) pollVoteEvent(evt *events.Message, postmap map[string]interface{}) bool {
+	update := evt.Message.GetPollUpdateMessage()
+	if update == nil {
+		return false
+	}
+	pollid := update.GetPollCreationMessageKey().GetId()
+	postmap["type"] = "PollVote"
+	vote := map[string]interface{}{
+		"pollId":    pollid,
+		"chat":      evt.Info.Chat.String(),
+		"voter":     evt.Info.Sender.ToNonAD().String(),
+		"timestamp": evt.Info.Timestamp.Unix(),
+	}
+	postmap["vote"] = vote
+
+	decrypted, err := mycli.WAClient.DecryptPollVote(evt)
+	if err != nil {
+		log.Warn().Err(err).Str("id", evt.Info.ID).Str("poll", pollid).Msg("Could not decrypt poll vote")
+		vote["error"] = err.Error()
+		return true
+	}
+
+	selected := []string{}
+	stored, err := getStoredMessage(mycli.db, mycli.userID, pollid)
+	if err != nil || getPoll(stored.Message) == nil {
+		// Poll not known, only the option hashes can be reported
+		hashes := []string{}
+		for _, hash := range decrypted.GetSelectedOptions() {
+			hashes = append(hashes, hex.EncodeToString(hash))
+		}
+		vote["optionHashes"] = hashes
+		vote["options"] = selected
+		vote["error"] = "Unknown poll"
+		return true
+	}
+
+	poll := getPoll(stored.Message)
+	vote["pollName"] = poll.GetName()
+	names := []string{}
+	for _, option := range poll.GetOptions() {
+		names = append(names, option.GetOptionName())
+	}
+	hashes := whatsmeow.HashPollOptions(names)
+	for _, hash := range decrypted.GetSelectedOptions() {
+		for i, optionhash := range hashes {
+			if bytes.Equal(hash, optionhash) {
+				selected = append(selected, names[i])
+			}
+		}
+	}
+	vote["options"] = selected
+	log.Info().Str("poll", pollid).Str("voter", evt.Info.Sender.String()).Strs("options", selected).Msg("Poll vote received")
+	return true
+}
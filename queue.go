@@ -0,0 +1,361 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// How often the queue looks for messages of sessions that reconnected
+const queueInterval = 2 * time.Second
+
+// Delay before retrying a message after a transient error, doubled on each attempt
+const queueRetryDelay = 5 * time.Second
+const maxQueueRetryDelay = 5 * time.Minute
+
+// Message persisted until its session is connected, sent in order with the other messages of the session
+type queuedMessage struct {
+	Id          int64
+	Status      string // queued, sending, sent, failed, expired or cancelled
+	MessageId   string
+	Attempts    int
+	Error       string     `json:",omitempty"`
+	NextAttempt *time.Time `json:",omitempty"`
+	Expires     time.Time
+	SentAt      *time.Time `json:",omitempty"`
+	Created     time.Time
+	Request     sendRequest
+}
+
+// Sessions with a goroutine sending their queue, so messages are never sent out of order
+var queueRunners = make(map[int]bool)
+var queueMutex sync.Mutex
+
+// Stores a message to be sent as soon as its session is connected. The message ID is assigned now
+// so callers can correlate receipts and the final SendStatus event
+func queueMessage(db *sql.DB, userid int, req *sendRequest) (*queuedMessage, error) {
+	if req.status {
+		return nil, badRequest("Status updates can not be queued")
+	}
+	// Uploads are only kept in memory for the request, the stored request would lose the file
+	if req.file != nil {
+		return nil, badRequest("Files uploaded with multipart requests can not be queued, pass the media as a Url or base64 data")
+	}
+	if err := validateSendRequest(req); err != nil {
+		return nil, badRequest(err.Error())
+	}
+	expiry := *queueExpiry
+	if req.Options.QueueExpiry > 0 {
+		expiry = time.Duration(req.Options.QueueExpiry * float64(time.Second))
+	}
+	if req.Options.Id == "" {
+		req.Options.Id = whatsmeow.GenerateMessageID()
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	qm := &queuedMessage{Status: "queued", MessageId: req.Options.Id, Expires: now.Add(expiry), Created: now, Request: *req}
+	sqlStmt := `INSERT INTO outbound_queue (user_id, status, message_id, next_attempt, expires, created, request) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	res, err := db.Exec(sqlStmt, userid, qm.Status, qm.MessageId, now.Unix(), qm.Expires.Unix(), now.Unix(), string(data))
+	if err != nil {
+		return nil, err
+	}
+	qm.Id, _ = res.LastInsertId()
+	runQueue(db, userid)
+	return qm, nil
+}
+
+const queueColumns = `id, status, message_id, attempts, error, next_attempt, expires, sent_at, created, request`
+
+func scanQueuedMessage(row interface{ Scan(...interface{}) error }) (*queuedMessage, error) {
+	var nextAttempt, expires, created int64
+	var sentAt sql.NullInt64
+	var request string
+	qm := &queuedMessage{}
+	err := row.Scan(&qm.Id, &qm.Status, &qm.MessageId, &qm.Attempts, &qm.Error, &nextAttempt, &expires, &sentAt, &created, &request)
+	if err != nil {
+		return nil, err
+	}
+	if qm.Status == "queued" && qm.Attempts > 0 {
+		t := time.Unix(nextAttempt, 0)
+		qm.NextAttempt = &t
+	}
+	qm.Expires = time.Unix(expires, 0)
+	qm.Created = time.Unix(created, 0)
+	qm.SentAt = unixTime(sentAt)
+	err = json.Unmarshal([]byte(request), &qm.Request)
+	return qm, err
+}
+
+// Lists the queued messages of a user, filtered by status if set
+func listQueuedMessages(db *sql.DB, userid int, status string) ([]*queuedMessage, error) {
+	query := "SELECT " + queueColumns + " FROM outbound_queue WHERE user_id=?"
+	args := []interface{}{userid}
+	if status != "" {
+		query += " AND status=?"
+		args = append(args, status)
+	}
+	rows, err := db.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*queuedMessage{}
+	for rows.Next() {
+		qm, err := scanQueuedMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, qm)
+	}
+	return list, rows.Err()
+}
+
+// Cancels a message still waiting in the queue, returns false if it does not exist or was already sent
+func cancelQueuedMessage(db *sql.DB, userid int, id int64) (bool, error) {
+	res, err := db.Exec("UPDATE outbound_queue SET status='cancelled' WHERE id=? AND user_id=? AND status='queued'", id, userid)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// Starts the background loop sending the queues of connected sessions
+func startQueue(db *sql.DB) {
+	recoverQueuedMessages(db)
+	go func() {
+		for range time.Tick(queueInterval) {
+			expireQueuedMessages(db)
+			rows, err := db.Query("SELECT DISTINCT user_id FROM outbound_queue WHERE status='queued'")
+			if err != nil {
+				log.Error().Err(err).Msg("Could not load queued messages")
+				continue
+			}
+			users := []int{}
+			for rows.Next() {
+				var userid int
+				if rows.Scan(&userid) == nil {
+					users = append(users, userid)
+				}
+			}
+			rows.Close()
+			for _, userid := range users {
+				runQueue(db, userid)
+			}
+		}
+	}()
+}
+
+// Fails the messages being sent when the server stopped, they may or may not have reached WhatsApp.
+// Each one gets its final SendStatus webhook like any other failed message
+func recoverQueuedMessages(db *sql.DB) {
+	rows, err := db.Query("SELECT user_id, " + queueColumns + " FROM outbound_queue WHERE status='sending' ORDER BY id")
+	if err != nil {
+		log.Error().Err(err).Msg("Could not recover queued messages")
+		return
+	}
+	type interruptedMessage struct {
+		qm     *queuedMessage
+		userid int
+	}
+	interrupted := []interruptedMessage{}
+	for rows.Next() {
+		var userid int
+		qm, err := scanQueuedMessage(scanFunc(func(dest ...interface{}) error {
+			return rows.Scan(append([]interface{}{&userid}, dest...)...)
+		}))
+		if err != nil {
+			log.Error().Err(err).Msg("Could not load queued message")
+			continue
+		}
+		interrupted = append(interrupted, interruptedMessage{qm, userid})
+	}
+	rows.Close()
+	for _, m := range interrupted {
+		finishQueuedMessage(db, m.userid, m.qm, "failed", errors.New("Interrupted by server restart"), nil)
+	}
+}
+
+// Adapts a scan function to the row interface of the scan helpers
+type scanFunc func(dest ...interface{}) error
+
+func (f scanFunc) Scan(dest ...interface{}) error {
+	return f(dest...)
+}
+
+// Expires the messages that waited too long, also for sessions that are started but disconnected.
+// Messages of stopped sessions expire once they start, so the final webhook can be delivered
+func expireQueuedMessages(db *sql.DB) {
+	rows, err := db.Query("SELECT id, user_id FROM outbound_queue WHERE status='queued' AND expires<? ORDER BY id", time.Now().Unix())
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load expired queued messages")
+		return
+	}
+	type expiredMessage struct {
+		id     int64
+		userid int
+	}
+	expired := []expiredMessage{}
+	for rows.Next() {
+		var e expiredMessage
+		if rows.Scan(&e.id, &e.userid) == nil {
+			expired = append(expired, e)
+		}
+	}
+	rows.Close()
+
+	for _, e := range expired {
+		if getMyClient(e.userid) == nil {
+			continue
+		}
+		// Claim the message so it is not sent or cancelled at the same time
+		res, err := db.Exec("UPDATE outbound_queue SET status='sending' WHERE id=? AND status='queued'", e.id)
+		if err != nil {
+			log.Error().Err(err).Int64("id", e.id).Msg("Could not claim queued message")
+			continue
+		}
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			continue
+		}
+		qm, err := scanQueuedMessage(db.QueryRow("SELECT "+queueColumns+" FROM outbound_queue WHERE id=?", e.id))
+		if err != nil {
+			log.Error().Err(err).Int64("id", e.id).Msg("Could not load queued message")
+			continue
+		}
+		finishQueuedMessage(db, e.userid, qm, "expired", errors.New("Expired before it could be sent"), nil)
+	}
+}
+
+// Starts sending the queue of a session in the background unless it is already being sent
+func runQueue(db *sql.DB, userid int) {
+	client := getClient(userid)
+	if client == nil || !client.IsConnected() || !client.IsLoggedIn() {
+		return
+	}
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	if queueRunners[userid] {
+		return
+	}
+	queueRunners[userid] = true
+	go sendQueue(db, userid)
+}
+
+// Sends the queued messages of a session in order. A message waiting to be retried holds back the
+// ones after it, the queue stops until the next round when it is due or the session disconnects
+func sendQueue(db *sql.DB, userid int) {
+	defer func() {
+		queueMutex.Lock()
+		delete(queueRunners, userid)
+		queueMutex.Unlock()
+	}()
+	for {
+		client := getClient(userid)
+		if client == nil || !client.IsConnected() || !client.IsLoggedIn() {
+			return
+		}
+		qm, err := scanQueuedMessage(db.QueryRow("SELECT "+queueColumns+" FROM outbound_queue WHERE user_id=? AND status='queued' ORDER BY id LIMIT 1", userid))
+		if err == sql.ErrNoRows {
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Int("userid", userid).Msg("Could not load queued message")
+			return
+		}
+		now := time.Now()
+		if now.After(qm.Expires) {
+			finishQueuedMessage(db, userid, qm, "expired", errors.New("Expired before it could be sent"), nil)
+			continue
+		}
+		if qm.NextAttempt != nil && now.Before(*qm.NextAttempt) {
+			return
+		}
+		// Claim the message so a concurrent cancel can not race with the send
+		res, err := db.Exec("UPDATE outbound_queue SET status='sending' WHERE id=? AND status='queued'", qm.Id)
+		if err != nil {
+			log.Error().Err(err).Int64("id", qm.Id).Msg("Could not claim queued message")
+			return
+		}
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			continue
+		}
+		sendQueuedMessage(db, userid, qm)
+	}
+}
+
+// Sends a queued message, retrying it later on transient errors
+func sendQueuedMessage(db *sql.DB, userid int, qm *queuedMessage) {
+	// Queued messages wait for their turn instead of failing when rate limited
+	qm.Request.Options.OnLimit = "wait"
+	result, err := sendMessage(db, userid, &qm.Request)
+	if err == nil {
+		finishQueuedMessage(db, userid, qm, "sent", nil, result)
+		return
+	}
+
+	// Invalid requests will never succeed, anything else may once the connection is back
+	var serr *sendError
+	permanent := errors.As(err, &serr) && serr.Status >= 400 && serr.Status < 500 && serr.Status != http.StatusTooManyRequests
+	// Sends interrupted by a disconnection don't count as attempts
+	client := getClient(userid)
+	if client != nil && client.IsConnected() {
+		qm.Attempts++
+	}
+	if permanent || qm.Attempts >= *queueRetries {
+		finishQueuedMessage(db, userid, qm, "failed", err, nil)
+		return
+	}
+	delay := queueRetryDelay << qm.Attempts
+	if delay > maxQueueRetryDelay || delay <= 0 {
+		delay = maxQueueRetryDelay
+	}
+	log.Warn().Err(err).Int64("id", qm.Id).Int("attempts", qm.Attempts).Dur("retry", delay).Msg("Queued message failed, will retry")
+	sqlStmt := `UPDATE outbound_queue SET status='queued', attempts=?, error=?, next_attempt=? WHERE id=? AND status='sending'`
+	_, dberr := db.Exec(sqlStmt, qm.Attempts, err.Error(), time.Now().Add(delay).Unix(), qm.Id)
+	if dberr != nil {
+		log.Error().Err(dberr).Int64("id", qm.Id).Msg(sqlStmt)
+	}
+}
+
+// Records the final outcome of a queued message and reports it as a SendStatus webhook
+func finishQueuedMessage(db *sql.DB, userid int, qm *queuedMessage, status string, sendErr error, result *sendResult) {
+	qm.Status = status
+	var sentAt interface{}
+	if sendErr != nil {
+		qm.Error = sendErr.Error()
+		log.Warn().Err(sendErr).Int64("id", qm.Id).Int("userid", userid).Str("status", status).Msg("Queued message not sent")
+	} else {
+		now := time.Now()
+		qm.Error = ""
+		qm.SentAt = &now
+		sentAt = now.Unix()
+	}
+	sqlStmt := `UPDATE outbound_queue SET status=?, attempts=?, error=?, sent_at=? WHERE id=?`
+	_, err := db.Exec(sqlStmt, qm.Status, qm.Attempts, qm.Error, sentAt, qm.Id)
+	if err != nil {
+		log.Error().Err(err).Int64("id", qm.Id).Msg(sqlStmt)
+	}
+
+	recipient, _ := parseJID(qm.Request.To)
+	postmap := map[string]interface{}{"type": "SendStatus", "id": qm.MessageId, "to": recipient.String(), "messageType": qm.Request.Type, "queueId": qm.Id, "attempts": qm.Attempts}
+	switch status {
+	case "sent":
+		postmap["state"] = "Sent"
+		postmap["timestamp"] = result.Timestamp.Unix()
+	case "expired":
+		postmap["state"] = "Expired"
+		postmap["error"] = qm.Error
+	default:
+		postmap["state"] = "Failed"
+		postmap["error"] = qm.Error
+	}
+	serverEvent(db, userid, recipient.String(), postmap)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestQueueMessageRejects(t *testing.T) {
+	text := json.RawMessage(`{"Body":"Your code is 4821"}`)
+	tests := []struct {
+		name string
+		req  sendRequest
+	}{
+		{"status update", sendRequest{Type: "text", Content: text, status: true}},
+		{"uploaded file", sendRequest{Type: "image", To: "5491155554444", Content: json.RawMessage(`{"Caption":"Invoice"}`), file: &uploadedFile{Path: "/tmp/wuzapi-upload-1", FileName: "invoice.png"}}},
+		{"uploaded file with invalid To", sendRequest{Type: "image", Content: json.RawMessage(`{}`), file: &uploadedFile{Path: "/tmp/wuzapi-upload-2"}}},
+		{"invalid To", sendRequest{Type: "text", To: "not a phone", Content: text}},
+		{"invalid Type", sendRequest{Type: "fax", To: "5491155554444", Content: text}},
+	}
+	for _, tt := range tests {
+		// Rejected requests never reach the database
+		_, err := queueMessage(nil, 1, &tt.req)
+		var serr *sendError
+		if !errors.As(err, &serr) || serr.Status != http.StatusBadRequest {
+			t.Errorf("%s: got %v, want a 400 error", tt.name, err)
+		}
+	}
+}
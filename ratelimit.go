@@ -0,0 +1,235 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Outbound limits of a session, zero values mean no limit
+type rateLimits struct {
+	PerMinute         int     // messages sent per minute
+	RecipientInterval float64 // minimum seconds between messages to the same recipient
+	Jitter            float64 // maximum random delay in seconds added before each message
+	DailyNewContacts  int     // contacts without previous conversation messaged per day
+}
+
+func (l *rateLimits) validate() error {
+	if l.PerMinute < 0 || l.RecipientInterval < 0 || l.Jitter < 0 || l.DailyNewContacts < 0 {
+		return errors.New("Limits can not be negative")
+	}
+	return nil
+}
+
+// Send queue of a session, messages get consecutive time slots respecting the limits
+type sessionLimiter struct {
+	mu          sync.Mutex
+	slots       []time.Time          // send times within the last minute, and reserved ones
+	last        time.Time            // latest reserved slot
+	recipients  map[string]time.Time // latest slot per recipient
+	day         string
+	newContacts map[string]bool // contacts first messaged today
+}
+
+var limiters = make(map[int]*sessionLimiter)
+var limitersMutex sync.Mutex
+
+// Gets the outbound limits of a user, defaults to no limits
+func getRateLimits(db *sql.DB, userid int) rateLimits {
+	limits := rateLimits{}
+	err := getUserSetting(db, userid, "ratelimit", &limits)
+	if err != nil {
+		log.Warn().Err(err).Int("userid", userid).Msg("Could not load rate limits, using default")
+	}
+	return limits
+}
+
+func getLimiter(userid int) *sessionLimiter {
+	limitersMutex.Lock()
+	defer limitersMutex.Unlock()
+	l := limiters[userid]
+	if l == nil {
+		l = &sessionLimiter{recipients: make(map[string]time.Time)}
+		limiters[userid] = l
+	}
+	return l
+}
+
+// Slot reserved for a message, released if the message is not sent
+type reservation struct {
+	slot       time.Time
+	recipient  string
+	previous   time.Time // slot of the previous message to recipient, zero if none
+	newContact bool      // counted against the daily new contact cap
+}
+
+// Waits for the turn of a message to recipient. If wait is false and the message can not be sent right
+// away a 429 error is returned instead. Messages over the daily new contact cap are always rejected.
+// The returned reservation is nil when the session has no limits
+func throttleSend(db *sql.DB, client *whatsmeow.Client, userid int, recipient types.JID, wait bool) (*reservation, error) {
+	limits := getRateLimits(db, userid)
+	if limits == (rateLimits{}) {
+		return nil, nil
+	}
+	isNew := func() bool { return isNewContact(db, client, userid, recipient) }
+	delay, r, err := getLimiter(userid).reserve(db, userid, recipient, limits, wait, isNew)
+	if err != nil {
+		return nil, err
+	}
+	if delay > 0 {
+		log.Debug().Int("userid", userid).Str("to", recipient.String()).Dur("delay", delay).Msg("Send throttled")
+		time.Sleep(delay)
+	}
+	return r, nil
+}
+
+// Reserves the next slot for a message to recipient and returns how long to wait for it. Nothing is
+// reserved unless every limit allows the message. isNew tells whether recipient is a new contact
+func (l *sessionLimiter) reserve(db *sql.DB, userid int, recipient types.JID, limits rateLimits, wait bool, isNew func() bool) (time.Duration, *reservation, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	to := recipient.String()
+
+	newContact := false
+	if limits.DailyNewContacts > 0 && recipient.Server == types.DefaultUserServer {
+		day := now.Format("2006-01-02")
+		if l.day != day || l.newContacts == nil {
+			l.day = day
+			l.newContacts = newContactsSince(db, userid, startOfDay(now))
+		}
+		if !l.newContacts[to] && isNew() {
+			if len(l.newContacts) >= limits.DailyNewContacts {
+				retry := startOfDay(now).AddDate(0, 0, 1).Sub(now)
+				return 0, nil, &sendError{Status: http.StatusTooManyRequests, Err: fmt.Errorf("Daily limit of %d new contacts reached", limits.DailyNewContacts), RetryAfter: retry}
+			}
+			newContact = true
+		}
+	}
+
+	// Drop slots that no longer count for the per minute limit
+	for len(l.slots) > 0 && l.slots[0].Before(now.Add(-time.Minute)) {
+		l.slots = l.slots[1:]
+	}
+
+	slot := now
+	if l.last.After(slot) {
+		slot = l.last
+	}
+	previous, ok := l.recipients[to]
+	if ok && limits.RecipientInterval > 0 {
+		next := previous.Add(time.Duration(limits.RecipientInterval * float64(time.Second)))
+		if next.After(slot) {
+			slot = next
+		}
+	}
+	if limits.PerMinute > 0 && len(l.slots) >= limits.PerMinute {
+		next := l.slots[len(l.slots)-limits.PerMinute].Add(time.Minute)
+		if next.After(slot) {
+			slot = next
+		}
+	}
+	if !wait && slot.After(now) {
+		retry := slot.Sub(now)
+		return 0, nil, &sendError{Status: http.StatusTooManyRequests, Err: fmt.Errorf("Rate limit exceeded, retry in %.0f seconds", retry.Seconds()), RetryAfter: retry}
+	}
+	// Every message gets a random delay, also with OnLimit reject, so messages never go out at regular
+	// intervals. The delay of a message sent right away does not hold back the next ones
+	base := slot
+	if limits.Jitter > 0 {
+		slot = slot.Add(time.Duration(rand.Float64() * limits.Jitter * float64(time.Second)))
+	}
+
+	if newContact {
+		l.newContacts[to] = true
+	}
+	l.slots = append(l.slots, slot)
+	sort.Slice(l.slots, func(i, j int) bool { return l.slots[i].Before(l.slots[j]) })
+	if wait {
+		l.last = slot
+	} else if base.After(l.last) {
+		l.last = base
+	}
+	l.recipients[to] = slot
+	for jid, t := range l.recipients {
+		if t.Before(now.Add(-time.Duration(limits.RecipientInterval * float64(time.Second)))) {
+			delete(l.recipients, jid)
+		}
+	}
+	return slot.Sub(now), &reservation{slot: slot, recipient: to, previous: previous, newContact: newContact}, nil
+}
+
+// Gives back the slot of a message that could not be sent, and its place in the daily new contact cap
+func (l *sessionLimiter) release(r *reservation) {
+	if r == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, slot := range l.slots {
+		if slot.Equal(r.slot) {
+			l.slots = append(l.slots[:i], l.slots[i+1:]...)
+			break
+		}
+	}
+	if l.last.Equal(r.slot) {
+		l.last = time.Time{}
+		if len(l.slots) > 0 {
+			l.last = l.slots[len(l.slots)-1]
+		}
+	}
+	if current, ok := l.recipients[r.recipient]; ok && current.Equal(r.slot) {
+		if r.previous.IsZero() {
+			delete(l.recipients, r.recipient)
+		} else {
+			l.recipients[r.recipient] = r.previous
+		}
+	}
+	if r.newContact {
+		delete(l.newContacts, r.recipient)
+	}
+}
+
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// Chats whose conversation was started by this session since a time, according to the message store
+func newContactsSince(db *sql.DB, userid int, since time.Time) map[string]bool {
+	contacts := make(map[string]bool)
+	// SQLite takes fromme from the row holding the earliest timestamp
+	rows, err := db.Query("SELECT chat, MIN(timestamp), fromme FROM messages WHERE user_id=? GROUP BY chat HAVING MIN(timestamp)>=? AND fromme=1", userid, since.Unix())
+	if err != nil {
+		log.Warn().Err(err).Int("userid", userid).Msg("Could not load new contacts")
+		return contacts
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var chat string
+		var first int64
+		var fromme bool
+		if rows.Scan(&chat, &first, &fromme) == nil {
+			contacts[chat] = true
+		}
+	}
+	return contacts
+}
+
+// A contact is new if it is not in the address book and there are no messages with it
+func isNewContact(db *sql.DB, client *whatsmeow.Client, userid int, recipient types.JID) bool {
+	if contact, err := client.Store.Contacts.GetContact(recipient); err == nil && contact.Found {
+		return false
+	}
+	var found int
+	err := db.QueryRow("SELECT 1 FROM messages WHERE user_id=? AND chat=? LIMIT 1", userid, recipient.String()).Scan(&found)
+	return err == sql.ErrNoRows
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+var (
+	ana   = types.NewJID("5491155554444", types.DefaultUserServer)
+	luis  = types.NewJID("5491155553935", types.DefaultUserServer)
+	group = types.NewJID("120363025246125486", types.GroupServer)
+)
+
+func newTestLimiter() *sessionLimiter {
+	return &sessionLimiter{recipients: make(map[string]time.Time), day: time.Now().Format("2006-01-02"), newContacts: make(map[string]bool)}
+}
+
+func TestReserve(t *testing.T) {
+	type send struct {
+		to       types.JID
+		isNew    bool
+		wait     bool
+		rejected bool
+		minDelay time.Duration
+		maxDelay time.Duration
+		counted  int // new contacts counted after the send
+	}
+	tests := []struct {
+		name   string
+		limits rateLimits
+		sends  []send
+	}{
+		{"per minute reject", rateLimits{PerMinute: 2}, []send{
+			{to: ana}, {to: luis}, {to: ana, rejected: true},
+		}},
+		{"per minute wait", rateLimits{PerMinute: 1}, []send{
+			{to: ana}, {to: luis, wait: true, minDelay: 59 * time.Second, maxDelay: time.Minute},
+		}},
+		{"recipient interval", rateLimits{RecipientInterval: 10}, []send{
+			{to: ana}, {to: luis}, {to: ana, rejected: true}, {to: ana, wait: true, minDelay: 9 * time.Second, maxDelay: 10 * time.Second},
+		}},
+		{"jitter when rejecting", rateLimits{Jitter: 0.5}, []send{
+			{to: ana, maxDelay: 500 * time.Millisecond}, {to: luis, maxDelay: time.Second},
+		}},
+		{"jitter when waiting", rateLimits{Jitter: 0.5}, []send{
+			{to: ana, wait: true, maxDelay: 500 * time.Millisecond},
+		}},
+		{"daily new contacts", rateLimits{DailyNewContacts: 1}, []send{
+			{to: ana, isNew: true, counted: 1}, {to: ana, isNew: true, counted: 1}, {to: luis, isNew: true, rejected: true, counted: 1}, {to: group, isNew: true, counted: 1},
+		}},
+		{"known contacts not counted", rateLimits{DailyNewContacts: 1}, []send{
+			{to: luis}, {to: ana, isNew: true, counted: 1},
+		}},
+		{"new contact not counted when rate limited", rateLimits{DailyNewContacts: 2, PerMinute: 1}, []send{
+			{to: ana}, {to: luis, isNew: true, rejected: true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLimiter()
+			for i, s := range tt.sends {
+				isNew := s.isNew
+				delay, r, err := l.reserve(nil, 1, s.to, tt.limits, s.wait, func() bool { return isNew })
+				if s.rejected {
+					serr, ok := err.(*sendError)
+					if !ok || serr.Status != http.StatusTooManyRequests || r != nil {
+						t.Fatalf("send %d: got %v, want a 429 error", i, err)
+					}
+				} else if err != nil {
+					t.Fatalf("send %d: %v", i, err)
+				} else if delay < s.minDelay || delay > s.maxDelay {
+					t.Errorf("send %d: delay %v, want between %v and %v", i, delay, s.minDelay, s.maxDelay)
+				}
+				if len(l.newContacts) != s.counted {
+					t.Errorf("send %d: %d new contacts counted, want %d", i, len(l.newContacts), s.counted)
+				}
+			}
+		})
+	}
+}
+
+func TestReserveRelease(t *testing.T) {
+	limits := rateLimits{PerMinute: 1, RecipientInterval: 10, DailyNewContacts: 1}
+	l := newTestLimiter()
+	isNew := func() bool { return true }
+	_, r, err := l.reserve(nil, 1, ana, limits, false, isNew)
+	if err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	if _, _, err := l.reserve(nil, 1, luis, limits, false, isNew); err == nil {
+		t.Fatal("second reserve should be rejected")
+	}
+	// The failed send gives back the per minute slot, the recipient interval and the new contact
+	l.release(r)
+	if len(l.slots) != 0 || len(l.recipients) != 0 || len(l.newContacts) != 0 || !l.last.IsZero() {
+		t.Errorf("release left state behind: %+v", l)
+	}
+	if _, _, err := l.reserve(nil, 1, luis, limits, false, isNew); err != nil {
+		t.Errorf("reserve after release: %v", err)
+	}
+	l.release(nil)
+}
@@ -52,23 +52,63 @@ func (s *server) routes() {
 	s.router.Handle("/session/logout", c.Then(s.Logout())).Methods("POST")
 	s.router.Handle("/session/status", c.Then(s.GetStatus())).Methods("GET")
 	s.router.Handle("/session/qr", c.Then(s.GetQR())).Methods("GET")
+	s.router.Handle("/session/ratelimit", c.Then(s.SetRateLimits())).Methods("POST")
+	s.router.Handle("/session/ratelimit", c.Then(s.GetRateLimits())).Methods("GET")
 
 	s.router.Handle("/webhook", c.Then(s.SetWebhook())).Methods("POST")
 	s.router.Handle("/webhook", c.Then(s.GetWebhook())).Methods("GET")
+	s.router.Handle("/webhook/media", c.Then(s.SetMediaPolicy())).Methods("POST")
+	s.router.Handle("/webhook/media", c.Then(s.GetMediaPolicy())).Methods("GET")
+	s.router.Handle("/webhook/dispatch", c.Then(s.SetWebhookDispatch())).Methods("POST")
+	s.router.Handle("/webhook/dispatch", c.Then(s.GetWebhookDispatch())).Methods("GET")
+	s.router.Handle("/webhook/template", c.Then(s.SetWebhookTemplate())).Methods("POST")
+	s.router.Handle("/webhook/template", c.Then(s.GetWebhookTemplate())).Methods("GET")
+	s.router.Handle("/webhook/preview", c.Then(s.PreviewWebhook())).Methods("POST")
+	s.router.Handle("/webhook/test", c.Then(s.TestWebhook())).Methods("POST")
+	s.router.Handle("/webhook/deliveries", c.Then(s.GetWebhookDeliveries())).Methods("GET")
 
+	s.router.Handle("/chat/send", c.Then(s.SendChat())).Methods("POST")
 	s.router.Handle("/chat/send/text", c.Then(s.SendMessage())).Methods("POST")
 	s.router.Handle("/chat/send/image", c.Then(s.SendImage())).Methods("POST")
 	s.router.Handle("/chat/send/audio", c.Then(s.SendAudio())).Methods("POST")
 	s.router.Handle("/chat/send/document", c.Then(s.SendDocument())).Methods("POST")
-	//	s.router.Handle("/chat/send/template", c.Then(s.SendTemplate())).Methods("POST")
+	s.router.Handle("/chat/send/template", c.Then(s.SendTemplate())).Methods("POST")
 	s.router.Handle("/chat/send/video", c.Then(s.SendVideo())).Methods("POST")
 	s.router.Handle("/chat/send/sticker", c.Then(s.SendSticker())).Methods("POST")
 	s.router.Handle("/chat/send/location", c.Then(s.SendLocation())).Methods("POST")
 	s.router.Handle("/chat/send/contact", c.Then(s.SendContact())).Methods("POST")
+	s.router.Handle("/chat/send/poll", c.Then(s.SendPoll())).Methods("POST")
 	s.router.Handle("/chat/react", c.Then(s.React())).Methods("POST")
+	s.router.Handle("/chat/schedule", c.Then(s.ScheduleMessage())).Methods("POST")
+	s.router.Handle("/chat/schedule", c.Then(s.ListScheduledMessages())).Methods("GET")
+	s.router.Handle("/chat/schedule/cancel", c.Then(s.CancelScheduledMessage())).Methods("POST")
+	s.router.Handle("/chat/queue", c.Then(s.ListQueuedMessages())).Methods("GET")
+	s.router.Handle("/chat/queue/cancel", c.Then(s.CancelQueuedMessage())).Methods("POST")
+	s.router.Handle("/chat/disappearing", c.Then(s.SetDisappearing())).Methods("POST")
+	s.router.Handle("/chat/disappearing", c.Then(s.GetDisappearing())).Methods("GET")
+	s.router.Handle("/chat/forward", c.Then(s.ForwardMessage())).Methods("POST")
+	s.router.Handle("/chat/status", c.Then(s.GetMessageStatuses())).Methods("POST")
+	s.router.Handle("/chat/status/{id}", c.Then(s.GetMessageStatus())).Methods("GET")
+	s.router.Handle("/chat/edit", c.Then(s.EditMessage())).Methods("POST")
+	s.router.Handle("/chat/revoke", c.Then(s.RevokeMessage())).Methods("POST")
 	s.router.Handle("/chat/send/buttons", c.Then(s.SendButtons())).Methods("POST")
 	s.router.Handle("/chat/send/list", c.Then(s.SendList())).Methods("POST")
 
+	s.router.Handle("/status/send", c.Then(s.PostStatus())).Methods("POST")
+	s.router.Handle("/status/privacy", c.Then(s.GetStatusPrivacy())).Methods("GET")
+
+	s.router.Handle("/template", c.Then(s.SaveTemplate())).Methods("POST")
+	s.router.Handle("/template", c.Then(s.GetTemplates())).Methods("GET")
+	s.router.Handle("/template/delete", c.Then(s.DeleteTemplate())).Methods("POST")
+	s.router.Handle("/template/preview", c.Then(s.PreviewTemplate())).Methods("POST")
+
+	s.router.Handle("/campaign/create", c.Then(s.CreateCampaign())).Methods("POST")
+	s.router.Handle("/campaign", c.Then(s.GetCampaigns())).Methods("GET")
+	s.router.Handle("/campaign/recipients", c.Then(s.GetCampaignRecipients())).Methods("GET")
+	s.router.Handle("/campaign/pause", c.Then(s.ChangeCampaign("paused", "Paused", "running"))).Methods("POST")
+	s.router.Handle("/campaign/resume", c.Then(s.ChangeCampaign("running", "Resumed", "paused"))).Methods("POST")
+	s.router.Handle("/campaign/cancel", c.Then(s.ChangeCampaign("cancelled", "Cancelled", "running", "paused"))).Methods("POST")
+
 	s.router.Handle("/user/create", c.Then(s.CreateUser())).Methods("POST")
 	s.router.Handle("/user/delete", c.Then(s.DeleteUser())).Methods("POST")
 	s.router.Handle("/user/fetch", c.Then(s.GetUserByToken())).Methods("POST")
@@ -90,5 +130,8 @@ func (s *server) routes() {
 	s.router.Handle("/group/photo", c.Then(s.SetGroupPhoto())).Methods("POST")
 	s.router.Handle("/group/name", c.Then(s.SetGroupName())).Methods("POST")
 
+	// Signed links sent on webhooks, authenticated by signature instead of token
+	s.router.Handle("/media/{messageId}", s.GetMedia()).Methods("GET")
+
 	s.router.PathPrefix("/").Handler(http.FileServer(http.Dir(exPath + "/static/")))
 }
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+	_ "time/tzdata"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// How often the scheduler looks for due messages
+const schedulerInterval = 5 * time.Second
+
+// Message waiting to be sent at a given time
+type scheduledMessage struct {
+	Id        int64
+	SendAt    time.Time
+	Timezone  string
+	Status    string // pending, sending, sent, failed or cancelled
+	MessageId string
+	Error     string     `json:",omitempty"`
+	SentAt    *time.Time `json:",omitempty"`
+	Created   time.Time
+	Request   sendRequest
+}
+
+// Layouts accepted for SendAt without a UTC offset, interpreted in the given timezone
+var sendAtLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02 15:04"}
+
+// Parses a send time, either with an offset (RFC 3339) or as local time in timezone (UTC if empty)
+func parseSendAt(value string, timezone string) (time.Time, error) {
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid Timezone %q", timezone)
+	}
+	if sendAt, err := time.Parse(time.RFC3339, value); err == nil {
+		return sendAt.In(loc), nil
+	}
+	for _, layout := range sendAtLayouts {
+		if sendAt, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return sendAt, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid SendAt %q, use RFC 3339 or YYYY-MM-DD HH:MM[:SS]", value)
+}
+
+// Checks a send request can be stored for later, media can't be uploaded as files
+func validateSendRequest(req *sendRequest) error {
+	if _, ok := parseJID(req.To); !ok {
+		return errors.New("Could not parse To")
+	}
+	if err := validateContent(req.Type, req.Content); err != nil {
+		return err
+	}
+	if req.file != nil {
+		return errors.New("Files can not be uploaded for later sending, pass the media as a Url or base64 data")
+	}
+	if req.Options.Id != "" && !validMessageID(req.Options.Id) {
+		return errors.New("Invalid Id, must be up to 64 letters and digits")
+	}
+	return nil
+}
+
+// Checks the content of a message decodes into the fields of its type. Required fields and media are
+// only checked when the message is built
+func validateContent(msgType string, content json.RawMessage) error {
+	if _, ok := messageBuilders[msgType]; !ok {
+		return fmt.Errorf("Invalid Type %q", msgType)
+	}
+	if len(content) == 0 {
+		return errors.New("Missing Content in Payload")
+	}
+	value := reflect.New(reflect.TypeOf(messageContents[msgType])).Interface()
+	if err := json.Unmarshal(content, value); err != nil {
+		return fmt.Errorf("Invalid Content for Type %s: %v", msgType, err)
+	}
+	return nil
+}
+
+// Stores a message to be sent at sendAt. The message ID is assigned now so callers can correlate receipts
+func scheduleMessage(db *sql.DB, userid int, req *sendRequest, sendAt time.Time, timezone string) (*scheduledMessage, error) {
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	if req.Options.Id == "" {
+		req.Options.Id = whatsmeow.GenerateMessageID()
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	sm := &scheduledMessage{SendAt: sendAt, Timezone: timezone, Status: "pending", MessageId: req.Options.Id, Created: time.Now(), Request: *req}
+	sqlStmt := `INSERT INTO scheduled_messages (user_id, send_at, timezone, status, message_id, request, created) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	res, err := db.Exec(sqlStmt, userid, sendAt.Unix(), timezone, sm.Status, sm.MessageId, string(data), sm.Created.Unix())
+	if err != nil {
+		return nil, err
+	}
+	sm.Id, _ = res.LastInsertId()
+	return sm, nil
+}
+
+func scanScheduledMessage(rows *sql.Rows) (*scheduledMessage, int, error) {
+	var userid int
+	var sendAt, created int64
+	var sentAt sql.NullInt64
+	var request string
+	sm := &scheduledMessage{}
+	err := rows.Scan(&sm.Id, &userid, &sendAt, &sm.Timezone, &sm.Status, &sm.MessageId, &sm.Error, &sentAt, &created, &request)
+	if err != nil {
+		return nil, 0, err
+	}
+	loc, err := time.LoadLocation(sm.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	sm.SendAt = time.Unix(sendAt, 0).In(loc)
+	sm.Created = time.Unix(created, 0)
+	if sentAt.Valid {
+		t := time.Unix(sentAt.Int64, 0)
+		sm.SentAt = &t
+	}
+	err = json.Unmarshal([]byte(request), &sm.Request)
+	return sm, userid, err
+}
+
+const scheduledColumns = `id, user_id, send_at, timezone, status, message_id, error, sent_at, created, request`
+
+// Lists the scheduled messages of a user, filtered by status if set
+func listScheduledMessages(db *sql.DB, userid int, status string) ([]*scheduledMessage, error) {
+	query := "SELECT " + scheduledColumns + " FROM scheduled_messages WHERE user_id=?"
+	args := []interface{}{userid}
+	if status != "" {
+		query += " AND status=?"
+		args = append(args, status)
+	}
+	rows, err := db.Query(query+" ORDER BY send_at, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*scheduledMessage{}
+	for rows.Next() {
+		sm, _, err := scanScheduledMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, sm)
+	}
+	return list, rows.Err()
+}
+
+// Cancels a pending scheduled message, returns false if it does not exist or was already sent
+func cancelScheduledMessage(db *sql.DB, userid int, id int64) (bool, error) {
+	res, err := db.Exec("UPDATE scheduled_messages SET status='cancelled' WHERE id=? AND user_id=? AND status='pending'", id, userid)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// Starts the background loop sending due scheduled messages
+func startScheduler(db *sql.DB) {
+	// Messages being sent when the server stopped may or may not have reached WhatsApp
+	_, err := db.Exec("UPDATE scheduled_messages SET status='failed', error='Interrupted by server restart' WHERE status='sending'")
+	if err != nil {
+		log.Error().Err(err).Msg("Could not recover scheduled messages")
+	}
+	go func() {
+		for range time.Tick(schedulerInterval) {
+			runScheduledMessages(db)
+		}
+	}()
+}
+
+// Sessions with a goroutine sending their due messages, so a rate limited session does not hold back the others
+var schedulerRunners = make(map[int]bool)
+var schedulerMutex sync.Mutex
+
+// Sends due messages of connected sessions, messages of disconnected sessions wait until they reconnect.
+// Each session sends its messages in order on its own goroutine
+func runScheduledMessages(db *sql.DB) {
+	for _, userid := range connectedUsers() {
+		schedulerMutex.Lock()
+		running := schedulerRunners[userid]
+		schedulerMutex.Unlock()
+		// Messages due while the session is still sending are picked up on a later round
+		if running {
+			continue
+		}
+		messages, err := dueScheduledMessages(db, userid)
+		if err != nil {
+			log.Error().Err(err).Int("userid", userid).Msg("Could not load scheduled messages")
+			continue
+		}
+		if len(messages) == 0 {
+			continue
+		}
+		schedulerMutex.Lock()
+		schedulerRunners[userid] = true
+		schedulerMutex.Unlock()
+		go sendScheduledMessages(db, userid, messages)
+	}
+}
+
+// Loads the oldest due messages of a session, selected per session so a backlog of one can not hold back the others
+func dueScheduledMessages(db *sql.DB, userid int) ([]*scheduledMessage, error) {
+	rows, err := db.Query("SELECT "+scheduledColumns+" FROM scheduled_messages WHERE user_id=? AND status='pending' AND send_at<=? ORDER BY send_at, id LIMIT 100", userid, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := []*scheduledMessage{}
+	for rows.Next() {
+		sm, _, err := scanScheduledMessage(rows)
+		if err != nil {
+			log.Error().Err(err).Int("userid", userid).Msg("Could not load scheduled message")
+			continue
+		}
+		messages = append(messages, sm)
+	}
+	return messages, rows.Err()
+}
+
+// Sends the due messages of a session in order
+func sendScheduledMessages(db *sql.DB, userid int, messages []*scheduledMessage) {
+	defer func() {
+		schedulerMutex.Lock()
+		delete(schedulerRunners, userid)
+		schedulerMutex.Unlock()
+	}()
+	for _, sm := range messages {
+		// Claim the message so a concurrent cancel can not race with the send
+		res, err := db.Exec("UPDATE scheduled_messages SET status='sending' WHERE id=? AND status='pending'", sm.Id)
+		if err != nil {
+			log.Error().Err(err).Int64("id", sm.Id).Msg("Could not claim scheduled message")
+			continue
+		}
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			continue
+		}
+		sendScheduledMessage(db, userid, sm)
+	}
+}
+
+// Sends a scheduled message, records the result and reports it to the webhook
+func sendScheduledMessage(db *sql.DB, userid int, sm *scheduledMessage) {
+	// Scheduled messages wait for their turn instead of failing when rate limited
+	sm.Request.Options.OnLimit = "wait"
+	result, err := sendMessage(db, userid, &sm.Request)
+	now := time.Now()
+	if err != nil {
+		sm.Status = "failed"
+		sm.Error = err.Error()
+		log.Warn().Err(err).Int64("id", sm.Id).Int("userid", userid).Msg("Scheduled message failed")
+	} else {
+		sm.Status = "sent"
+		sm.MessageId = result.Id
+		sm.SentAt = &now
+	}
+	sqlStmt := `UPDATE scheduled_messages SET status=?, message_id=?, error=?, sent_at=? WHERE id=?`
+	_, dberr := db.Exec(sqlStmt, sm.Status, sm.MessageId, sm.Error, now.Unix(), sm.Id)
+	if dberr != nil {
+		log.Error().Err(dberr).Int64("id", sm.Id).Msg(sqlStmt)
+	}
+
+	postmap := map[string]interface{}{"type": "ScheduledMessage", "event": sm}
+	if err != nil {
+		postmap["state"] = "Failed"
+	} else {
+		postmap["state"] = "Sent"
+	}
+	recipient, _ := parseJID(sm.Request.To)
+	serverEvent(db, userid, recipient.String(), postmap)
+}
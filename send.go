@@ -0,0 +1,889 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// Message send request, used by /chat/send and by the per type endpoints
+type sendRequest struct {
+	Type    string
+	To      string
+	Content json.RawMessage // type specific fields, same names as in the per type endpoints
+	Options sendOptions
+	file    *uploadedFile // media uploaded with a multipart request
+	status  bool          // posted as status, To is ignored
+	media   *mediaCache   // media of the previous campaign message, reused when unchanged
+}
+
+// Options common to every message type
+type sendOptions struct {
+	Id          string               // message ID to use, generated if empty
+	ContextInfo *waProto.ContextInfo // replies, StanzaId and Participant of the quoted message
+	OnLimit     string               // reject (default) or wait when the session rate limits are reached
+	Simulate    *simulateOptions     // show typing or recording before sending
+	Mentions    []string             // phone numbers or JIDs mentioned in the text or caption
+	MentionAll  bool                 // mention every participant of the group, admins only
+	ViewOnce    bool                 // images, videos and voice notes that can only be viewed once
+	Queue       bool                 // store the message and send it once the session is connected
+	QueueExpiry float64              // seconds a queued message may wait, -queueexpiry by default
+}
+
+// Outcome of a sent message
+type sendResult struct {
+	Id        string
+	Timestamp time.Time
+}
+
+// Error carrying the HTTP status to answer with
+type sendError struct {
+	Status     int
+	Err        error
+	RetryAfter time.Duration // set on 429 errors
+}
+
+func (e *sendError) Error() string {
+	return e.Err.Error()
+}
+
+// Invalid request error
+func badRequest(text string) error {
+	return &sendError{Status: http.StatusBadRequest, Err: errors.New(text)}
+}
+
+// State shared by the steps building a message
+type sendContext struct {
+	client *whatsmeow.Client
+	db     *sql.DB
+	userid int
+	file   *uploadedFile
+	media  *mediaCache
+}
+
+// Media loaded and uploaded for the previous message of a campaign. Only the last media of each field is
+// kept, so recipients with the same media share one download and upload, and per recipient media is not held
+type mediaCache struct {
+	loaded   map[string]cachedMedia
+	uploaded map[string]cachedUpload
+}
+
+type cachedMedia struct {
+	key   string
+	media outgoingMedia
+}
+
+type cachedUpload struct {
+	key      string
+	uploaded whatsmeow.UploadResponse
+}
+
+func newMediaCache() *mediaCache {
+	return &mediaCache{loaded: make(map[string]cachedMedia), uploaded: make(map[string]cachedUpload)}
+}
+
+func mediaCacheKey(parts ...[]byte) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write(part)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Builds the message for a type from the request content, uploading media if needed
+type messageBuilder func(ctx *sendContext, content json.RawMessage) (*waProto.Message, error)
+
+var messageBuilders = map[string]messageBuilder{
+	"text":     buildTextMessage,
+	"image":    buildImageMessage,
+	"audio":    buildAudioMessage,
+	"document": buildDocumentMessage,
+	"video":    buildVideoMessage,
+	"sticker":  buildStickerMessage,
+	"location": buildLocationMessage,
+	"contact":  buildContactMessage,
+	"buttons":  buildButtonsMessage,
+	"list":     buildListMessage,
+	"poll":     buildPollMessage,
+}
+
+// Content of each message type, used to check stored contents and to find the fields holding JSON in multipart requests
+var messageContents = map[string]interface{}{
+	"text":     textContent{},
+	"image":    imageContent{},
+	"audio":    audioContent{},
+	"document": documentContent{},
+	"video":    videoContent{},
+	"sticker":  stickerContent{},
+	"location": locationContent{},
+	"contact":  contactContent{},
+	"buttons":  buttonsContent{},
+	"list":     listContent{},
+	"poll":     pollContent{},
+}
+
+// Message built and ready to be sent
+type preparedMessage struct {
+	client    *whatsmeow.Client
+	db        *sql.DB
+	userid    int
+	req       *sendRequest
+	recipient types.JID
+	id        string
+	msg       *waProto.Message
+}
+
+// Validates, builds and sends a message
+func sendMessage(db *sql.DB, userid int, req *sendRequest) (*sendResult, error) {
+	p, err := prepareMessage(db, userid, req)
+	if err != nil {
+		return nil, err
+	}
+	return p.send()
+}
+
+// Validates and builds a message, uploading its media, so it can be sent later
+func prepareMessage(db *sql.DB, userid int, req *sendRequest) (*preparedMessage, error) {
+
+	client := getClient(userid)
+	if client == nil {
+		return nil, errors.New("No session")
+	}
+
+	build, ok := messageBuilders[req.Type]
+	if !ok {
+		return nil, badRequest(fmt.Sprintf("Invalid Type %q", req.Type))
+	}
+
+	recipient, ok := parseJID(req.To)
+	if req.status {
+		recipient, ok = types.StatusBroadcastJID, true
+	}
+	if !ok {
+		return nil, badRequest("Could not parse Phone")
+	}
+
+	reply, err := replyContext(db, userid, req.Options.ContextInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	msgid := req.Options.Id
+	if msgid == "" {
+		msgid = whatsmeow.GenerateMessageID()
+	} else if !validMessageID(msgid) {
+		return nil, badRequest("Invalid Id, must be up to 64 letters and digits")
+	}
+
+	if req.Options.OnLimit != "" && req.Options.OnLimit != "reject" && req.Options.OnLimit != "wait" {
+		return nil, badRequest("OnLimit must be reject or wait")
+	}
+
+	if len(req.Content) == 0 {
+		if req.file == nil {
+			return nil, badRequest("Missing Content in Payload")
+		}
+		req.Content = json.RawMessage("{}")
+	}
+	ctx := &sendContext{client: client, db: db, userid: userid, file: req.file, media: req.media}
+	msg, err := build(ctx, req.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.status && msg.ExtendedTextMessage != nil {
+		err = applyStatusStyle(msg, req.Content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mentions, err := resolveMentions(client, userid, recipient, req, messageText(msg))
+	if err != nil {
+		return nil, err
+	}
+	if len(mentions) > 0 {
+		if reply == nil {
+			reply = &waProto.ContextInfo{}
+		}
+		reply.MentionedJid = mentions
+	}
+
+	if reply != nil {
+		err = applyContextInfo(msg, reply)
+		if err != nil {
+			return nil, &sendError{Status: http.StatusBadRequest, Err: err}
+		}
+	}
+
+	if !req.status {
+		if timer := getDisappearingTimer(db, client, userid, recipient); timer > 0 {
+			applyDisappearingTimer(msg, timer)
+		}
+	}
+
+	if req.Options.ViewOnce {
+		msg, err = viewOnceMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &preparedMessage{client: client, db: db, userid: userid, req: req, recipient: recipient, id: msgid, msg: msg}, nil
+}
+
+// Sends a prepared message once the rate limits allow it, simulating typing first if requested
+func (p *preparedMessage) send() (*sendResult, error) {
+	client, db, userid, recipient, msg := p.client, p.db, p.userid, p.recipient, p.msg
+
+	reserved, err := throttleSend(db, client, userid, recipient, p.req.Options.OnLimit == "wait")
+	if err != nil {
+		return nil, err
+	}
+
+	if p.req.Options.Simulate != nil {
+		p.simulate()
+	}
+
+	recordMessageSending(db, userid, p.id, recipient)
+	resp, err := client.SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: p.id})
+	if p.req.Options.Simulate != nil {
+		client.SendChatPresence(recipient, types.ChatPresencePaused, p.presenceMedia())
+	}
+	if err != nil {
+		// A message that never went out does not count against the limits
+		getLimiter(userid).release(reserved)
+		err = fmt.Errorf("Error sending message: %v", err)
+		recordMessageFailed(db, userid, p.id, err)
+		return nil, err
+	}
+	recordMessageSent(db, userid, p.id, resp.Timestamp)
+
+	log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", p.id).Str("type", p.req.Type).Msg("Message sent")
+
+	// Keep sent messages so they can be quoted or forwarded later
+	info := &types.MessageInfo{
+		MessageSource: types.MessageSource{Chat: recipient, IsFromMe: true, IsGroup: recipient.Server == types.GroupServer},
+		ID:            resp.ID,
+		Timestamp:     resp.Timestamp,
+	}
+	if client.Store.ID != nil {
+		info.Sender = client.Store.ID.ToNonAD()
+	}
+	storeMessage(db, userid, info, msg)
+
+	return &sendResult{Id: resp.ID, Timestamp: resp.Timestamp}, nil
+}
+
+// Copy of a sent message with its text or caption replaced, as sent in edits
+func editedContent(msg *waProto.Message, text string) (*waProto.Message, error) {
+	edited := proto.Clone(msg).(*waProto.Message)
+	if !setMessageText(edited, text) {
+		return nil, badRequest("Only text messages and media captions can be edited")
+	}
+	if edited.Conversation == nil {
+		applyContextInfo(edited, nil)
+	}
+	return edited, nil
+}
+
+// Checks a client supplied message ID is safe to send to WhatsApp
+func validMessageID(id string) bool {
+	if len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+// Attaches context info to the sub-message holding the content
+func applyContextInfo(msg *waProto.Message, info *waProto.ContextInfo) error {
+	switch {
+	case msg.ExtendedTextMessage != nil:
+		msg.ExtendedTextMessage.ContextInfo = info
+	case msg.ImageMessage != nil:
+		msg.ImageMessage.ContextInfo = info
+	case msg.AudioMessage != nil:
+		msg.AudioMessage.ContextInfo = info
+	case msg.DocumentMessage != nil:
+		msg.DocumentMessage.ContextInfo = info
+	case msg.VideoMessage != nil:
+		msg.VideoMessage.ContextInfo = info
+	case msg.StickerMessage != nil:
+		msg.StickerMessage.ContextInfo = info
+	case msg.LocationMessage != nil:
+		msg.LocationMessage.ContextInfo = info
+	case msg.ContactMessage != nil:
+		msg.ContactMessage.ContextInfo = info
+	case msg.ButtonsMessage != nil:
+		msg.ButtonsMessage.ContextInfo = info
+	case msg.ListMessage != nil:
+		msg.ListMessage.ContextInfo = info
+	case msg.PollCreationMessage != nil:
+		msg.PollCreationMessage.ContextInfo = info
+	case msg.ViewOnceMessage != nil && msg.ViewOnceMessage.Message != nil:
+		return applyContextInfo(msg.ViewOnceMessage.Message, info)
+	default:
+		return errors.New("ContextInfo is not supported for this message type")
+	}
+	return nil
+}
+
+var whatsappMediaTypes = map[string]whatsmeow.MediaType{
+	"image":    whatsmeow.MediaImage,
+	"sticker":  whatsmeow.MediaImage,
+	"video":    whatsmeow.MediaVideo,
+	"audio":    whatsmeow.MediaAudio,
+	"document": whatsmeow.MediaDocument,
+}
+
+// Loads the media given in a data URL field, a Url or the uploaded file and uploads it to WhatsApp
+func (ctx *sendContext) uploadMedia(field string, data string, link string, mimetype string) (*outgoingMedia, whatsmeow.UploadResponse, error) {
+	var uploaded whatsmeow.UploadResponse
+	media, err := ctx.loadMedia(field, data, link, mimetype)
+	if err != nil {
+		return nil, uploaded, err
+	}
+	uploaded, err = ctx.upload(field, media)
+	if err != nil {
+		return nil, uploaded, err
+	}
+	return media, uploaded, nil
+}
+
+// Loads the media given in a data URL field, a Url or the uploaded file, checking it matches the message type
+func (ctx *sendContext) loadMedia(field string, data string, link string, mimetype string) (*outgoingMedia, error) {
+	var key string
+	if ctx.media != nil {
+		key = mediaCacheKey([]byte(data), []byte(link), []byte(mimetype))
+		if cached, ok := ctx.media.loaded[field]; ok && cached.key == key {
+			// Builders replace the data when converting it, a copy keeps the cached media intact
+			media := cached.media
+			return &media, nil
+		}
+	}
+	media, err := loadMedia(ctx.file, data, link, mimetype, strings.ToLower(field))
+	if err != nil {
+		return nil, err
+	}
+	if media == nil {
+		return nil, badRequest(fmt.Sprintf("Missing %s in Payload", field))
+	}
+	err = checkMediaKind(strings.ToLower(field), media.Mimetype)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.media != nil {
+		ctx.media.loaded[field] = cachedMedia{key: key, media: *media}
+	}
+	return media, nil
+}
+
+// Uploads loaded media to WhatsApp
+func (ctx *sendContext) upload(field string, media *outgoingMedia) (whatsmeow.UploadResponse, error) {
+	var key string
+	if ctx.media != nil {
+		key = mediaCacheKey(media.Data)
+		if cached, ok := ctx.media.uploaded[field]; ok && cached.key == key {
+			return cached.uploaded, nil
+		}
+	}
+	uploaded, err := ctx.client.Upload(context.Background(), media.Data, whatsappMediaTypes[strings.ToLower(field)])
+	if err != nil {
+		return uploaded, fmt.Errorf("Failed to upload file: %v", err)
+	}
+	if ctx.media != nil {
+		ctx.media.uploaded[field] = cachedUpload{key: key, uploaded: uploaded}
+	}
+	return uploaded, nil
+}
+
+func decodeContent(content json.RawMessage, v interface{}) error {
+	err := json.Unmarshal(content, v)
+	if err != nil {
+		return badRequest("Could not decode Payload")
+	}
+	return nil
+}
+
+type textContent struct {
+	Body        string
+	LinkPreview *bool        // false disables the automatic link preview
+	Preview     *linkPreview // explicit link preview
+}
+
+func buildTextMessage(ctx *sendContext, content json.RawMessage) (*waProto.Message, error) {
+	var t textContent
+	if err := decodeContent(content, &t); err != nil {
+		return nil, err
+	}
+	if t.Body == "" {
+		return nil, badRequest("Missing Body in Payload")
+	}
+	msg := &waProto.ExtendedTextMessage{
+		Text: &t.Body,
+	}
+	if err := addLinkPreview(msg, t.LinkPreview, t.Preview); err != nil {
+		return nil, err
+	}
+	return &waProto.Message{ExtendedTextMessage: msg}, nil
+}
+
+type imageContent struct {
+	Image    string
+	Url      string
+	Mimetype string
+	Caption  string
+}
+
+func buildImageMessage(ctx *sendContext, content json.RawMessage) (*waProto.Message, error) {
+	var t imageContent
+	if err := decodeContent(content, &t); err != nil {
+		return nil, err
+	}
+	media, uploaded, err := ctx.uploadMedia("Image", t.Image, t.Url, t.Mimetype)
+	if err != nil {
+		return nil, err
+	}
+	msg := &waProto.ImageMessage{
+		Caption:       proto.String(t.Caption),
+		Url:           proto.String(uploaded.URL),
+		DirectPath:    proto.String(uploaded.DirectPath),
+		MediaKey:      uploaded.MediaKey,
+		Mimetype:      proto.String(media.Mimetype),
+		FileEncSha256: uploaded.FileEncSHA256,
+		FileSha256:    uploaded.FileSHA256,
+		FileLength:    proto.Uint64(uint64(len(media.Data))),
+	}
+	meta, err := imageMetadata(media.Data)
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not read image metadata")
+	} else {
+		msg.Width = proto.Uint32(uint32(meta.Width))
+		msg.Height = proto.Uint32(uint32(meta.Height))
+		msg.JpegThumbnail = meta.Thumbnail
+	}
+	return &waProto.Message{ImageMessage: msg}, nil
+}
+
+type audioContent struct {
+	Audio    string
+	Url      string
+	Mimetype string
+	Ptt      *bool // sends as a voice note, converting to ogg/opus if needed. Defaults to true for ogg audio
+}
+
+func buildAudioMessage(ctx *sendContext, content json.RawMessage) (*waProto.Message, error) {
+	var t audioContent
+	if err := decodeContent(content, &t); err != nil {
+		return nil, err
+	}
+	media, err := ctx.loadMedia("Audio", t.Audio, t.Url, t.Mimetype)
+	if err != nil {
+		return nil, err
+	}
+	// Ogg is sent as a voice note, which WhatsApp only plays if encoded with opus
+	mimetype := media.Mimetype
+	ogg := strings.HasPrefix(mimetype, "audio/ogg") || strings.HasPrefix(mimetype, "application/ogg")
+	ptt := ogg
+	if t.Ptt != nil {
+		ptt = *t.Ptt
+	}
+	var waveform []byte
+	if ptt {
+		if !isOpus(media.Data) {
+			media.Data, err = encodeVoiceNote(media.Data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		mimetype = "audio/ogg; codecs=opus"
+		waveform = voiceWaveform(media.Data)
+	}
+	uploaded, err := ctx.upload("Audio", media)
+	if err != nil {
+		return nil, err
+	}
+	msg := &waProto.AudioMessage{
+		Url:           proto.String(uploaded.URL),
+		DirectPath:    proto.String(uploaded.DirectPath),
+		MediaKey:      uploaded.MediaKey,
+		Mimetype:      proto.String(mimetype),
+		FileEncSha256: uploaded.FileEncSHA256,
+		FileSha256:    uploaded.FileSHA256,
+		FileLength:    proto.Uint64(uint64(len(media.Data))),
+		Ptt:           proto.Bool(ptt),
+		Waveform:      waveform,
+	}
+	if meta := audioMetadata(media.Data, mimetype); meta.Duration > 0 {
+		msg.Seconds = proto.Uint32(meta.seconds())
+	}
+	return &waProto.Message{AudioMessage: msg}, nil
+}
+
+type documentContent struct {
+	Document string
+	Url      string
+	Mimetype string
+	FileName string
+}
+
+func buildDocumentMessage(ctx *sendContext, content json.RawMessage) (*waProto.Message, error) {
+	var t documentContent
+	if err := decodeContent(content, &t); err != nil {
+		return nil, err
+	}
+	media, uploaded, err := ctx.uploadMedia("Document", t.Document, t.Url, t.Mimetype)
+	if err != nil {
+		return nil, err
+	}
+	if t.FileName == "" {
+		t.FileName = media.FileName
+	}
+	if t.FileName == "" {
+		return nil, badRequest("Missing FileName in Payload")
+	}
+	return &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
+		Url:           proto.String(uploaded.URL),
+		FileName:      &t.FileName,
+		DirectPath:    proto.String(uploaded.DirectPath),
+		MediaKey:      uploaded.MediaKey,
+		Mimetype:      proto.String(media.Mimetype),
+		FileEncSha256: uploaded.FileEncSHA256,
+		FileSha256:    uploaded.FileSHA256,
+		FileLength:    proto.Uint64(uint64(len(media.Data))),
+	}}, nil
+}
+
+type videoContent struct {
+	Video         string
+	Url           string
+	Mimetype      string
+	Caption       string
+	JpegThumbnail []byte // base64 encoded JPEG
+	Thumbnail     string // base64 encoded image in data URL format
+	ThumbnailUrl  string
+}
+
+func buildVideoMessage(ctx *sendContext, content json.RawMessage) (*waProto.Message, error) {
+	var t videoContent
+	if err := decodeContent(content, &t); err != nil {
+		return nil, err
+	}
+	// A thumbnail given by the client replaces the one extracted from the video
+	var thumbnail []byte
+	if len(t.JpegThumbnail) > 0 || t.Thumbnail != "" || t.ThumbnailUrl != "" {
+		image := t.JpegThumbnail
+		if len(image) == 0 {
+			loaded, err := loadMedia(nil, t.Thumbnail, t.ThumbnailUrl, "", "image")
+			if err != nil {
+				return nil, err
+			}
+			image = loaded.Data
+		}
+		var err error
+		thumbnail, err = clientThumbnail(image)
+		if err != nil {
+			return nil, err
+		}
+	}
+	media, uploaded, err := ctx.uploadMedia("Video", t.Video, t.Url, t.Mimetype)
+	if err != nil {
+		return nil, err
+	}
+	msg := &waProto.VideoMessage{
+		Caption:       proto.String(t.Caption),
+		Url:           proto.String(uploaded.URL),
+		DirectPath:    proto.String(uploaded.DirectPath),
+		MediaKey:      uploaded.MediaKey,
+		Mimetype:      proto.String(media.Mimetype),
+		FileEncSha256: uploaded.FileEncSHA256,
+		FileSha256:    uploaded.FileSHA256,
+		FileLength:    proto.Uint64(uint64(len(media.Data))),
+	}
+	meta := videoMetadata(media.Data, thumbnail == nil)
+	if meta.Width > 0 {
+		msg.Width = proto.Uint32(uint32(meta.Width))
+		msg.Height = proto.Uint32(uint32(meta.Height))
+	}
+	if meta.Duration > 0 {
+		msg.Seconds = proto.Uint32(meta.seconds())
+	}
+	if thumbnail == nil {
+		thumbnail = meta.Thumbnail
+	}
+	msg.JpegThumbnail = thumbnail
+	return &waProto.Message{VideoMessage: msg}, nil
+}
+
+type stickerContent struct {
+	Sticker      string
+	Url          string
+	Mimetype     string
+	PngThumbnail []byte
+	PackName     string
+	PackAuthor   string
+	Emojis       []string
+}
+
+func buildStickerMessage(ctx *sendContext, content json.RawMessage) (*waProto.Message, error) {
+	var t stickerContent
+	if err := decodeContent(content, &t); err != nil {
+		return nil, err
+	}
+	media, err := ctx.loadMedia("Sticker", t.Sticker, t.Url, t.Mimetype)
+	if err != nil {
+		return nil, err
+	}
+	media.Data, err = convertSticker(media.Data, media.Mimetype)
+	if err != nil {
+		return nil, err
+	}
+	media.Mimetype = "image/webp"
+	if t.PackName != "" || t.PackAuthor != "" || len(t.Emojis) > 0 {
+		media.Data, err = addStickerPack(media.Data, &stickerPack{Name: t.PackName, Author: t.PackAuthor, Emojis: t.Emojis})
+		if err != nil {
+			return nil, badRequest(fmt.Sprintf("Could not add sticker pack metadata: %v", err))
+		}
+	}
+	width, height, animated, err := webpInfo(media.Data)
+	if err != nil {
+		return nil, badRequest("Could not decode WebP sticker")
+	}
+	uploaded, err := ctx.upload("Sticker", media)
+	if err != nil {
+		return nil, err
+	}
+	return &waProto.Message{StickerMessage: &waProto.StickerMessage{
+		Url:           proto.String(uploaded.URL),
+		DirectPath:    proto.String(uploaded.DirectPath),
+		MediaKey:      uploaded.MediaKey,
+		Mimetype:      proto.String(media.Mimetype),
+		FileEncSha256: uploaded.FileEncSHA256,
+		FileSha256:    uploaded.FileSHA256,
+		FileLength:    proto.Uint64(uint64(len(media.Data))),
+		Width:         proto.Uint32(uint32(width)),
+		Height:        proto.Uint32(uint32(height)),
+		IsAnimated:    proto.Bool(animated),
+		PngThumbnail:  t.PngThumbnail,
+	}}, nil
+}
+
+type locationContent struct {
+	Name      string
+	Latitude  float64
+	Longitude float64
+}
+
+func buildLocationMessage(ctx *sendContext, content json.RawMessage) (*waProto.Message, error) {
+	var t locationContent
+	if err := decodeContent(content, &t); err != nil {
+		return nil, err
+	}
+	if t.Latitude == 0 {
+		return nil, badRequest("Missing Latitude in Payload")
+	}
+	if t.Longitude == 0 {
+		return nil, badRequest("Missing Longitude in Payload")
+	}
+	return &waProto.Message{LocationMessage: &waProto.LocationMessage{
+		DegreesLatitude:  &t.Latitude,
+		DegreesLongitude: &t.Longitude,
+		Name:             &t.Name,
+	}}, nil
+}
+
+type contactContent struct {
+	Name  string
+	Vcard string
+}
+
+func buildContactMessage(ctx *sendContext, content json.RawMessage) (*waProto.Message, error) {
+	var t contactContent
+	if err := decodeContent(content, &t); err != nil {
+		return nil, err
+	}
+	if t.Name == "" {
+		return nil, badRequest("Missing Name in Payload")
+	}
+	if t.Vcard == "" {
+		return nil, badRequest("Missing Vcard in Payload")
+	}
+	return &waProto.Message{ContactMessage: &waProto.ContactMessage{
+		DisplayName: &t.Name,
+		Vcard:       &t.Vcard,
+	}}, nil
+}
+
+type buttonsContent struct {
+	Title   string
+	Buttons []struct {
+		ButtonId   string
+		ButtonText string
+	}
+}
+
+// Buttons (not implemented by WhatsApp clients, does not work)
+func buildButtonsMessage(ctx *sendContext, content json.RawMessage) (*waProto.Message, error) {
+	var t buttonsContent
+	if err := decodeContent(content, &t); err != nil {
+		return nil, err
+	}
+	if t.Title == "" {
+		return nil, badRequest("Missing Title in Payload")
+	}
+	if len(t.Buttons) < 1 {
+		return nil, badRequest("missing Buttons in Payload")
+	}
+	if len(t.Buttons) > 3 {
+		return nil, badRequest("buttons cant more than 3")
+	}
+
+	var buttons []*waProto.ButtonsMessage_Button
+	for _, item := range t.Buttons {
+		buttons = append(buttons, &waProto.ButtonsMessage_Button{
+			ButtonId:       proto.String(item.ButtonId),
+			ButtonText:     &waProto.ButtonsMessage_Button_ButtonText{DisplayText: proto.String(item.ButtonText)},
+			Type:           waProto.ButtonsMessage_Button_RESPONSE.Enum(),
+			NativeFlowInfo: &waProto.ButtonsMessage_Button_NativeFlowInfo{},
+		})
+	}
+
+	return &waProto.Message{ViewOnceMessage: &waProto.FutureProofMessage{
+		Message: &waProto.Message{
+			ButtonsMessage: &waProto.ButtonsMessage{
+				ContentText: proto.String(t.Title),
+				HeaderType:  waProto.ButtonsMessage_EMPTY.Enum(),
+				Buttons:     buttons,
+			},
+		},
+	}}, nil
+}
+
+type listContent struct {
+	Title       string
+	Description string
+	ButtonText  string
+	FooterText  string
+	Sections    []struct {
+		Title string
+		Rows  []struct {
+			RowId       string
+			Title       string
+			Description string
+		}
+	}
+}
+
+// List messages, see https://github.com/tulir/whatsmeow/issues/305
+func buildListMessage(ctx *sendContext, content json.RawMessage) (*waProto.Message, error) {
+	var t listContent
+	if err := decodeContent(content, &t); err != nil {
+		return nil, err
+	}
+	if t.Title == "" {
+		return nil, badRequest("missing Title in Payload")
+	}
+	if t.Description == "" {
+		return nil, badRequest("missing Description in Payload")
+	}
+	if t.ButtonText == "" {
+		return nil, badRequest("missing ButtonText in Payload")
+	}
+	if len(t.Sections) < 1 {
+		return nil, badRequest("missing Sections in Payload")
+	}
+
+	var sections []*waProto.ListMessage_Section
+	for _, item := range t.Sections {
+		var rows []*waProto.ListMessage_Row
+		for i, row := range item.Rows {
+			idtext := row.RowId
+			if idtext == "" {
+				idtext = strconv.Itoa(i + 1)
+			}
+			rows = append(rows, &waProto.ListMessage_Row{
+				RowId:       proto.String(idtext),
+				Title:       proto.String(row.Title),
+				Description: proto.String(row.Description),
+			})
+		}
+		sections = append(sections, &waProto.ListMessage_Section{
+			Title: proto.String(item.Title),
+			Rows:  rows,
+		})
+	}
+
+	return &waProto.Message{ViewOnceMessage: &waProto.FutureProofMessage{
+		Message: &waProto.Message{
+			ListMessage: &waProto.ListMessage{
+				Title:       proto.String(t.Title),
+				Description: proto.String(t.Description),
+				ButtonText:  proto.String(t.ButtonText),
+				ListType:    waProto.ListMessage_SINGLE_SELECT.Enum(),
+				Sections:    sections,
+				FooterText:  proto.String(t.FooterText),
+			},
+		},
+	}}, nil
+}
+
+// Builds the context info of a reply. The participant can be omitted and the quoted
+// message is embedded so the quote renders, when the message store knows the message
+func replyContext(db *sql.DB, userid int, ctxinfo *waProto.ContextInfo) (*waProto.ContextInfo, error) {
+	if ctxinfo == nil {
+		return nil, nil
+	}
+	if ctxinfo.StanzaId == nil {
+		if ctxinfo.Participant != nil {
+			return nil, badRequest("Missing StanzaId in ContextInfo")
+		}
+		return nil, nil
+	}
+
+	reply := &waProto.ContextInfo{
+		StanzaId:      proto.String(*ctxinfo.StanzaId),
+		Participant:   ctxinfo.Participant,
+		QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+	}
+	quoted, err := getStoredMessage(db, userid, *ctxinfo.StanzaId)
+	if err == nil {
+		reply.QuotedMessage = quotedMessage(quoted.Message)
+		if reply.Participant == nil {
+			reply.Participant = proto.String(quoted.Sender.ToNonAD().String())
+		}
+	} else if err != sql.ErrNoRows {
+		log.Warn().Err(err).Str("id", *ctxinfo.StanzaId).Msg("Could not load quoted message")
+	}
+	if reply.Participant == nil {
+		return nil, badRequest("Missing Participant in ContextInfo")
+	}
+	return reply, nil
+}
+
+// Copy of a message suitable for embedding as a quote, without its own context
+func quotedMessage(msg *waProto.Message) *waProto.Message {
+	quoted := proto.Clone(msg).(*waProto.Message)
+	if quoted.Conversation == nil {
+		applyContextInfo(quoted, nil)
+	}
+	return quoted
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMediaCacheLoad(t *testing.T) {
+	hits := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write(pngHeader)
+	}))
+	defer server.Close()
+	defer func(allowed bool) { *allowPrivate = allowed }(*allowPrivate)
+	*allowPrivate = true
+
+	ctx := &sendContext{media: newMediaCache()}
+	tests := []struct {
+		name string
+		url  string
+		hits int
+	}{
+		{"first download", server.URL + "/photo.png", 1},
+		{"same url reused", server.URL + "/photo.png", 1},
+		{"per recipient url", server.URL + "/photo.png?to=5491155554444", 2},
+		{"previous url replaced", server.URL + "/photo.png", 3},
+	}
+	for _, tt := range tests {
+		media, err := ctx.loadMedia("Image", "", tt.url, "")
+		if err != nil {
+			t.Fatalf("%s: loadMedia: %v", tt.name, err)
+		}
+		if hits != tt.hits {
+			t.Errorf("%s: %d downloads, want %d", tt.name, hits, tt.hits)
+		}
+		// Builders replace the data of the media they get, which must not change the cached copy
+		media.Data = nil
+	}
+	media, _ := ctx.loadMedia("Image", "", server.URL+"/photo.png", "")
+	if string(media.Data) != string(pngHeader) || media.Mimetype != "image/png" {
+		t.Errorf("cached media changed: %+v", media)
+	}
+}
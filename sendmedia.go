@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/vincent-petithory/dataurl"
+)
+
+// Maximum size of the non file fields of a multipart request
+const maxFormFieldSize = 1 << 20
+
+// Media file received in a multipart request, spooled to a temporary file until the request is done
+type uploadedFile struct {
+	Path     string
+	Size     int64
+	Sha256   []byte // hash of the content, computed while spooling
+	FileName string
+	Mimetype string // as declared by the client
+}
+
+// Removes the temporary file of an upload
+func (f *uploadedFile) remove() {
+	if f == nil {
+		return
+	}
+	if err := os.Remove(f.Path); err != nil && !os.IsNotExist(err) {
+		log.Warn().Err(err).Str("path", f.Path).Msg("Could not remove uploaded file")
+	}
+}
+
+// Media to be sent, loaded from a data URL, a remote URL or an uploaded file
+type outgoingMedia struct {
+	Data     []byte
+	Mimetype string
+	FileName string
+}
+
+var mediaFetchClient = resty.New().SetTransport(publicTransport())
+
+// Dialer refusing connections to loopback, private and link-local addresses, so URLs given by
+// API users can't reach services on the server network. Addresses are checked after DNS
+// resolution, on every connection including redirects
+func publicDialer() *net.Dialer {
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			if *allowPrivate {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("%s is not a public address", host)
+			}
+			return nil
+		},
+	}
+}
+
+// HTTP transport for URLs given by API users. No proxy is used, the addresses checked must be the ones connected to
+func publicTransport() *http.Transport {
+	return &http.Transport{
+		DialContext:           publicDialer().DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// Whether an address is reachable on the internet, rather than on the local host or network
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	// 0.0.0.0/8 and the carrier-grade NAT range 100.64.0.0/10
+	if ip4 := ip.To4(); ip4 != nil && (ip4[0] == 0 || ip4[0] == 100 && ip4[1]&0xc0 == 64) {
+		return false
+	}
+	return true
+}
+
+func maxMediaBytes() int64 {
+	return *maxMediaSize * 1024 * 1024
+}
+
+// Fields of send payloads that are not strings. Multipart requests carry every field as text,
+// the values of these fields are JSON
+var jsonFields = nonStringFields(sendRequest{}, sendOptions{}, textContent{}, imageContent{}, audioContent{}, documentContent{}, videoContent{},
+	stickerContent{}, locationContent{}, contactContent{}, buttonsContent{}, listContent{}, pollContent{})
+
+// Names of the exported fields of structs that are not JSON strings
+func nonStringFields(values ...interface{}) map[string]bool {
+	rawMessage := reflect.TypeOf(json.RawMessage{})
+	fields := make(map[string]bool)
+	for _, v := range values {
+		t := reflect.TypeOf(v)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			// []byte is encoded as a base64 string, unless it holds raw JSON
+			kind := field.Type.Kind()
+			bytes := kind == reflect.Slice && field.Type.Elem().Kind() == reflect.Uint8 && field.Type != rawMessage
+			if kind != reflect.String && !bytes {
+				fields[field.Name] = true
+			}
+		}
+	}
+	return fields
+}
+
+// Reads a multipart request, returning the file part and the other fields. The caller removes the file once done
+func readMultipart(r *http.Request) (map[string]string, *uploadedFile, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := make(map[string]string)
+	var file *uploadedFile
+	fail := func(err error) (map[string]string, *uploadedFile, error) {
+		file.remove()
+		return nil, nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize+1))
+			if err != nil {
+				return fail(err)
+			}
+			if len(value) > maxFormFieldSize {
+				return fail(badRequest(fmt.Sprintf("Field %s is larger than %d KB", part.FormName(), maxFormFieldSize>>10)))
+			}
+			fields[part.FormName()] = string(value)
+			continue
+		}
+		if file != nil {
+			return fail(errors.New("Only one file can be sent per message"))
+		}
+		file, err = spoolUpload(part)
+		if err != nil {
+			return fail(err)
+		}
+	}
+	return fields, file, nil
+}
+
+// Copies a multipart file part to a temporary file, so uploads are not held in memory while the request is read
+func spoolUpload(part *multipart.Part) (*uploadedFile, error) {
+	tmp, err := os.CreateTemp("", "wuzapi-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	file := &uploadedFile{Path: tmp.Name(), FileName: filepath.Base(part.FileName()), Mimetype: part.Header.Get("Content-Type")}
+	h := sha256.New()
+	file.Size, err = io.Copy(io.MultiWriter(tmp, h), io.LimitReader(part, maxMediaBytes()+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && file.Size > maxMediaBytes() {
+		err = badRequest(fmt.Sprintf("File is larger than %d MB", *maxMediaSize))
+	}
+	if err != nil {
+		file.remove()
+		return nil, err
+	}
+	file.Sha256 = h.Sum(nil)
+	return file, nil
+}
+
+// Loads the media of a send request from whichever source was given. kind is the type of message
+// the media is sent as, it settles the MIME type of formats shared by several kinds
+func loadMedia(file *uploadedFile, data string, link string, mimetype string, kind string) (*outgoingMedia, error) {
+	var media *outgoingMedia
+	var declared string
+	switch {
+	case file != nil:
+		content, err := os.ReadFile(file.Path)
+		if err != nil {
+			return nil, err
+		}
+		media = &outgoingMedia{Data: content, FileName: file.FileName}
+		declared = file.Mimetype
+	case data != "":
+		dataURL, err := dataurl.DecodeString(data)
+		if err != nil {
+			return nil, badRequest("Could not decode base64 encoded data from payload")
+		}
+		media = &outgoingMedia{Data: dataURL.Data}
+		declared = dataURL.MediaType.ContentType()
+	case link != "":
+		var err error
+		media, declared, err = fetchMedia(link)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+
+	if int64(len(media.Data)) > maxMediaBytes() {
+		return nil, badRequest(fmt.Sprintf("Media is larger than %d MB", *maxMediaSize))
+	}
+	media.Mimetype = detectMimetype(media.Data, declared, media.FileName, mimetype, kind)
+	return media, nil
+}
+
+// Downloads media from a remote URL, within the configured size and time limits
+func fetchMedia(link string) (*outgoingMedia, string, error) {
+	return fetchLimitedMedia(link, maxMediaBytes(), *mediaTimeout)
+}
+
+// Downloads media from a remote URL, refusing bodies over maxBytes. The body is never read past the limit
+func fetchLimitedMedia(link string, maxBytes int64, timeout time.Duration) (*outgoingMedia, string, error) {
+	parsed, err := url.Parse(link)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return nil, "", badRequest("Url must be an http or https URL")
+	}
+	tooLarge := badRequest(fmt.Sprintf("Media is larger than %d MB", maxBytes>>20))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	resp, err := mediaFetchClient.R().SetContext(ctx).SetDoNotParseResponse(true).Get(link)
+	if err != nil {
+		return nil, "", &sendError{Status: http.StatusBadGateway, Err: fmt.Errorf("Could not fetch media: %v", err)}
+	}
+	body := resp.RawBody()
+	defer body.Close()
+	if resp.IsError() {
+		return nil, "", &sendError{Status: http.StatusBadGateway, Err: fmt.Errorf("Could not fetch media: status %d", resp.StatusCode())}
+	}
+	if resp.RawResponse.ContentLength > maxBytes {
+		return nil, "", tooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxBytes+1))
+	if err != nil {
+		return nil, "", &sendError{Status: http.StatusBadGateway, Err: fmt.Errorf("Could not fetch media: %v", err)}
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, "", tooLarge
+	}
+	media := &outgoingMedia{Data: data, FileName: path.Base(parsed.Path)}
+	if media.FileName == "/" || media.FileName == "." {
+		media.FileName = ""
+	}
+	if _, params, err := mime.ParseMediaType(resp.Header().Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		media.FileName = filepath.Base(params["filename"])
+	}
+	return media, resp.Header().Get("Content-Type"), nil
+}
+
+// Types sniffed from containers shared by several formats, such as m4a audio in mp4 or docx in zip.
+// The declared type or the extension tells them apart
+var containerMimetypes = map[string]bool{
+	"application/octet-stream":  true,
+	"text/plain; charset=utf-8": true,
+	"application/zip":           true,
+	"video/mp4":                 true,
+	"video/webm":                true,
+}
+
+// Audio in a container sniffed as video
+var audioContainers = map[string]string{
+	"video/mp4":  "audio/mp4",
+	"video/webm": "audio/webm",
+}
+
+// Types of common media extensions, which the system MIME tables may lack
+var extensionMimetypes = map[string]string{
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".mp3":  "audio/mpeg",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".amr":  "audio/amr",
+	".mp4":  "video/mp4",
+	".3gp":  "video/3gpp",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".epub": "application/epub+zip",
+}
+
+// Picks the MIME type of media sent as kind: the explicit override, else sniffed from content.
+// The declared type, or the file extension, is kept when sniffing only finds a container or a
+// type that can not be sent as kind
+func detectMimetype(data []byte, declared string, filename string, override string, kind string) string {
+	if override != "" {
+		return override
+	}
+	hint := declared
+	if hint == "" || strings.HasPrefix(hint, "application/octet-stream") {
+		ext := strings.ToLower(filepath.Ext(filename))
+		hint = extensionMimetypes[ext]
+		if hint == "" {
+			hint = mime.TypeByExtension(ext)
+		}
+	}
+	sniffed := http.DetectContentType(data)
+	if hint != "" && (containerMimetypes[sniffed] || kind != "" && checkMediaKind(kind, sniffed) != nil && checkMediaKind(kind, hint) == nil) {
+		return hint
+	}
+	if audio, ok := audioContainers[sniffed]; ok && kind == "audio" {
+		return audio
+	}
+	return sniffed
+}
+
+// Checks media matches the kind of message it is sent as
+func checkMediaKind(kind string, mimetype string) error {
+	base, _, err := mime.ParseMediaType(mimetype)
+	if err != nil {
+		base = mimetype
+	}
+	ok := true
+	switch kind {
+	case "image":
+		ok = strings.HasPrefix(base, "image/")
+	case "sticker":
+		// Videos are converted to animated stickers
+		ok = strings.HasPrefix(base, "image/") || strings.HasPrefix(base, "video/")
+	case "video":
+		ok = strings.HasPrefix(base, "video/")
+	case "audio":
+		ok = strings.HasPrefix(base, "audio/") || base == "application/ogg"
+	}
+	if !ok {
+		return badRequest(fmt.Sprintf("Media type %s can not be sent as %s", mimetype, kind))
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"mime/multipart"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+var (
+	pngHeader  = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	jpegHeader = []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+	oggHeader  = []byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00")
+	pdfHeader  = []byte("%PDF-1.4\n")
+)
+
+func TestDetectMimetype(t *testing.T) {
+	m4aHeader := []byte("\x00\x00\x00\x1cftypM4A \x00\x00\x00\x00M4A mp42isom")
+	mp4Header := []byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom")
+	zipHeader := []byte("PK\x03\x04\x14\x00\x06\x00")
+	docx := "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	tests := []struct {
+		name     string
+		data     []byte
+		declared string
+		filename string
+		override string
+		kind     string
+		want     string
+	}{
+		{"sniffed png", pngHeader, "", "", "", "", "image/png"},
+		{"sniffed over declared of the same kind", jpegHeader, "image/png", "photo.png", "", "image", "image/jpeg"},
+		{"sniffed ogg", oggHeader, "", "", "", "", "application/ogg"},
+		{"sniffed pdf", pdfHeader, "", "", "", "", "application/pdf"},
+		{"override wins", pngHeader, "", "", "image/x-custom", "", "image/x-custom"},
+		{"declared when unknown", []byte{0x01, 0x02, 0x03}, "audio/mpeg", "", "", "", "audio/mpeg"},
+		{"declared octet-stream ignored", []byte{0x01, 0x02, 0x03}, "application/octet-stream", "scan.pdf", "", "", "application/pdf"},
+		{"extension for plain text", []byte(`{"name":"John"}`), "", "contact.json", "", "", "application/json"},
+		{"plain text without hints", []byte("hello"), "", "", "", "", "text/plain; charset=utf-8"},
+		{"unknown", []byte{0x01, 0x02, 0x03}, "", "", "", "", "application/octet-stream"},
+		{"declared m4a", m4aHeader, "audio/mp4", "", "", "audio", "audio/mp4"},
+		{"m4a by extension", m4aHeader, "", "voice.M4A", "", "audio", "audio/mp4"},
+		{"m4a without hints sent as audio", m4aHeader, "", "", "", "audio", "audio/mp4"},
+		{"mp4 without hints sent as video", mp4Header, "", "", "", "video", "video/mp4"},
+		{"docx by extension", zipHeader, "", "report.docx", "", "document", docx},
+		{"declared docx", zipHeader, docx, "", "", "document", docx},
+		{"zip without hints", zipHeader, "", "", "", "document", "application/zip"},
+		{"declared type of the kind kept", oggHeader, "video/ogg", "", "", "video", "video/ogg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectMimetype(tt.data, tt.declared, tt.filename, tt.override, tt.kind); got != tt.want {
+				t.Errorf("detectMimetype() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckMediaKind(t *testing.T) {
+	tests := []struct {
+		kind     string
+		mimetype string
+		ok       bool
+	}{
+		{"image", "image/jpeg", true},
+		{"image", "video/mp4", false},
+		{"image", "application/pdf", false},
+		{"sticker", "image/webp", true},
+		{"sticker", "image/gif", true},
+		{"sticker", "video/mp4", true},
+		{"sticker", "audio/ogg", false},
+		{"video", "video/mp4", true},
+		{"video", "image/gif", false},
+		{"audio", "audio/ogg; codecs=opus", true},
+		{"audio", "application/ogg", true},
+		{"audio", "video/mp4", false},
+		{"document", "application/pdf", true},
+		{"document", "image/png", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind+" "+tt.mimetype, func(t *testing.T) {
+			err := checkMediaKind(tt.kind, tt.mimetype)
+			if (err == nil) != tt.ok {
+				t.Errorf("checkMediaKind(%q, %q) = %v, want ok %v", tt.kind, tt.mimetype, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestJsonFields(t *testing.T) {
+	for _, name := range []string{"Content", "Options", "ContextInfo", "Simulate", "Mentions", "MentionAll", "ViewOnce", "Queue", "QueueExpiry", "Ptt", "Emojis", "LinkPreview", "Preview", "Latitude", "Longitude", "Buttons", "Sections", "SelectableCount"} {
+		if !jsonFields[name] {
+			t.Errorf("%s should be decoded as JSON", name)
+		}
+	}
+	for _, name := range []string{"Type", "To", "Phone", "Id", "OnLimit", "Body", "Caption", "Url", "Mimetype", "FileName", "JpegThumbnail", "PngThumbnail", "Name"} {
+		if jsonFields[name] {
+			t.Errorf("%s should be kept as text", name)
+		}
+	}
+}
+
+func TestReadSendPayloadMultipart(t *testing.T) {
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	form.WriteField("Phone", "5491155554444")
+	form.WriteField("Caption", "true")
+	form.WriteField("ViewOnce", "true")
+	form.WriteField("Mentions", `["5491155553333"]`)
+	file, _ := form.CreateFormFile("Image", "photo.png")
+	file.Write(pngHeader)
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/chat/send/image", &buf)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	body, upload, err := readSendPayload(r)
+	if err != nil {
+		t.Fatalf("readSendPayload: %v", err)
+	}
+	var payload struct {
+		Phone    string
+		Caption  string
+		ViewOnce bool
+		Mentions []string
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("decoding %s: %v", body, err)
+	}
+	if payload.Phone != "5491155554444" || payload.Caption != "true" || !payload.ViewOnce || len(payload.Mentions) != 1 {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+	if upload == nil {
+		t.Fatal("missing upload")
+	}
+	defer upload.remove()
+	data, err := os.ReadFile(upload.Path)
+	if err != nil {
+		t.Fatalf("reading spooled upload: %v", err)
+	}
+	sum := sha256.Sum256(pngHeader)
+	if upload.FileName != "photo.png" || !bytes.Equal(data, pngHeader) || upload.Size != int64(len(pngHeader)) || !bytes.Equal(upload.Sha256, sum[:]) {
+		t.Errorf("unexpected upload %+v", upload)
+	}
+}
+
+func TestReadSendPayloadFieldTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	file, _ := form.CreateFormFile("Image", "photo.png")
+	file.Write(pngHeader)
+	form.WriteField("Caption", strings.Repeat("a", maxFormFieldSize+1))
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/chat/send/image", &buf)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	_, upload, err := readSendPayload(r)
+	if err == nil || upload != nil {
+		t.Errorf("readSendPayload() = %v, %v, want an error", upload, err)
+	}
+}
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"100.128.0.1", true},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"224.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := publicIP(net.ParseIP(tt.ip)); got != tt.public {
+			t.Errorf("publicIP(%s) = %v, want %v", tt.ip, got, tt.public)
+		}
+	}
+}
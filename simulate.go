@@ -0,0 +1,121 @@
+package main
+
+import (
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Typing speed used to derive how long to show typing for a text
+const typingCharsPerSecond = 4
+
+// Bounds of the derived typing time, and the longest Duration accepted
+const minSimulateDuration = time.Second
+const maxDerivedDuration = 15 * time.Second
+const maxSimulateDuration = time.Minute
+
+// WhatsApp clears the typing indicator after about 25 seconds unless it is sent again
+const presenceRefresh = 10 * time.Second
+
+// Typing simulation before a message is sent
+type simulateOptions struct {
+	Duration float64 // seconds to show typing or recording, derived from the message if 0
+	MarkRead bool    // mark the last received message of the chat as read first
+	Wait     bool    // answer once the message is sent instead of right away
+}
+
+// Shows typing, or recording for voice notes, for the simulated duration
+func (p *preparedMessage) simulate() {
+	options := p.req.Options.Simulate
+	if options.MarkRead {
+		p.markChatRead()
+	}
+
+	media := p.presenceMedia()
+	duration := simulateDuration(p, options)
+
+	deadline := time.Now().Add(duration)
+	for {
+		err := p.client.SendChatPresence(p.recipient, types.ChatPresenceComposing, media)
+		if err != nil {
+			log.Warn().Err(err).Str("to", p.recipient.String()).Msg("Could not send chat presence")
+			return
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return
+		}
+		if remaining > presenceRefresh {
+			remaining = presenceRefresh
+		}
+		time.Sleep(remaining)
+		if time.Now().After(deadline) {
+			return
+		}
+	}
+}
+
+// Voice notes show recording, anything else typing
+func (p *preparedMessage) presenceMedia() types.ChatPresenceMedia {
+	if p.msg.GetAudioMessage().GetPtt() {
+		return types.ChatPresenceMediaAudio
+	}
+	return types.ChatPresenceMediaText
+}
+
+// Duration from the options, else the length of a voice note or the time to type its text
+func simulateDuration(p *preparedMessage, options *simulateOptions) time.Duration {
+	if options.Duration > 0 {
+		duration := time.Duration(options.Duration * float64(time.Second))
+		if duration > maxSimulateDuration {
+			duration = maxSimulateDuration
+		}
+		return duration
+	}
+	var duration time.Duration
+	if audio := p.msg.GetAudioMessage(); audio.GetPtt() {
+		duration = time.Duration(audio.GetSeconds()) * time.Second
+	} else {
+		duration = time.Duration(len([]rune(messageText(p.msg)))) * time.Second / typingCharsPerSecond
+	}
+	if duration < minSimulateDuration {
+		duration = minSimulateDuration
+	}
+	if duration > maxDerivedDuration {
+		duration = maxDerivedDuration
+	}
+	return duration
+}
+
+// Marks the last message received in the chat as read
+func (p *preparedMessage) markChatRead() {
+	var id, sender string
+	err := p.db.QueryRow("SELECT id, sender FROM messages WHERE user_id=? AND chat=? AND fromme=0 ORDER BY timestamp DESC LIMIT 1", p.userid, p.recipient.String()).Scan(&id, &sender)
+	if err != nil {
+		return
+	}
+	senderjid, _ := types.ParseJID(sender)
+	err = p.client.MarkRead([]types.MessageID{id}, time.Now(), p.recipient, senderjid)
+	if err != nil {
+		log.Warn().Err(err).Str("id", id).Msg("Could not mark chat as read")
+	}
+}
+
+// Sends a prepared message in the background, reporting the outcome as a SendStatus webhook
+func sendInBackground(p *preparedMessage) {
+	// Nobody is waiting for the answer, so a rate limited message waits for its turn
+	p.req.Options.OnLimit = "wait"
+	go func() {
+		postmap := map[string]interface{}{"type": "SendStatus", "id": p.id, "to": p.recipient.String(), "messageType": p.req.Type}
+		result, err := p.send()
+		if err != nil {
+			log.Warn().Err(err).Str("id", p.id).Msg("Background send failed")
+			postmap["state"] = "Failed"
+			postmap["error"] = err.Error()
+		} else {
+			postmap["state"] = "Sent"
+			postmap["timestamp"] = result.Timestamp.Unix()
+		}
+		serverEvent(p.db, p.userid, p.recipient.String(), postmap)
+	}()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Message types that can be posted as status
+var statusTypes = map[string]bool{"text": true, "image": true, "video": true}
+
+// Parses a #RRGGBB or #AARRGGBB color into ARGB
+func parseColor(color string) (uint32, error) {
+	hex := strings.TrimPrefix(color, "#")
+	if len(hex) != 6 && len(hex) != 8 {
+		return 0, fmt.Errorf("Invalid color %q, use #RRGGBB or #AARRGGBB", color)
+	}
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid color %q, use #RRGGBB or #AARRGGBB", color)
+	}
+	if len(hex) == 6 {
+		value |= 0xFF000000
+	}
+	return uint32(value), nil
+}
+
+// Sets the background color, text color and font of a text status
+func applyStatusStyle(msg *waProto.Message, content json.RawMessage) error {
+	var t struct {
+		BackgroundColor string
+		TextColor       string
+		Font            string // SANS_SERIF, SERIF, NORICAN_REGULAR, BRYNDAN_WRITE, BEBASNEUE_REGULAR or OSWALD_HEAVY
+	}
+	if err := decodeContent(content, &t); err != nil {
+		return err
+	}
+	text := msg.ExtendedTextMessage
+	if t.BackgroundColor != "" {
+		color, err := parseColor(t.BackgroundColor)
+		if err != nil {
+			return badRequest(err.Error())
+		}
+		text.BackgroundArgb = proto.Uint32(color)
+	}
+	if t.TextColor != "" {
+		color, err := parseColor(t.TextColor)
+		if err != nil {
+			return badRequest(err.Error())
+		}
+		text.TextArgb = proto.Uint32(color)
+	}
+	if t.Font != "" {
+		font, ok := waProto.ExtendedTextMessage_FontType_value[strings.ToUpper(t.Font)]
+		if !ok {
+			return badRequest(fmt.Sprintf("Invalid Font %q", t.Font))
+		}
+		text.Font = waProto.ExtendedTextMessage_FontType(font).Enum()
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/png"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Stickers are 512x512 WebP images, animated ones at most a few seconds long
+const stickerSize = 512
+const maxStickerSeconds = "8"
+
+// WhatsApp rejects animated stickers over 500 KB, they are encoded with lower quality until they fit
+const maxAnimatedSticker = 500 << 10
+
+var animatedStickerQualities = []string{"75", "50", "25"}
+
+// Flags of the VP8X chunk of extended WebP files
+const (
+	webpFlagAnimation = 0x02
+	webpFlagExif      = 0x08
+	webpFlagAlpha     = 0x10
+)
+
+// Sticker pack metadata, stored in the EXIF of the sticker
+type stickerPack struct {
+	Name   string
+	Author string
+	Emojis []string
+}
+
+// Chunk of a WebP RIFF container
+type webpChunk struct {
+	fourcc string
+	data   []byte
+}
+
+// Converts an image, GIF or short video to a 512x512 WebP sticker, padded with transparency.
+// WebP images already 512x512 or animated are kept as they are, animated ones over the size limit are re-encoded
+func convertSticker(data []byte, mimetype string) ([]byte, error) {
+	if strings.HasPrefix(mimetype, "image/webp") {
+		width, height, animated, err := webpInfo(data)
+		if err != nil {
+			return nil, badRequest("Could not decode WebP sticker")
+		}
+		if animated && len(data) > maxAnimatedSticker {
+			return shrinkAnimatedSticker(data)
+		}
+		if animated || (width == stickerSize && height == stickerSize) || *ffmpegPath == "" {
+			return data, nil
+		}
+	}
+	if strings.HasPrefix(mimetype, "video/") {
+		return animatedSticker(data)
+	}
+	if strings.HasPrefix(mimetype, "image/gif") {
+		config, err := gif.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, badRequest("Could not decode sticker image")
+		}
+		if err := checkImageSize(config.Width, config.Height); err != nil {
+			return nil, badRequest(fmt.Sprintf("Could not convert sticker: %v", err))
+		}
+		// Frames are counted without decoding them, ffmpeg converts the animation
+		if frames, err := gifFrames(data, 2); err == nil && frames > 1 {
+			return animatedSticker(data)
+		}
+	}
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, badRequest("Could not decode sticker image")
+	}
+	return staticSticker(img)
+}
+
+// Scales an image to fit the sticker size, centered on a transparent square
+func padSticker(img image.Image) image.Image {
+	bounds := img.Bounds()
+	width, height := stickerSize, stickerSize
+	if bounds.Dx() > bounds.Dy() {
+		height = bounds.Dy() * stickerSize / bounds.Dx()
+	} else {
+		width = bounds.Dx() * stickerSize / bounds.Dy()
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, stickerSize, stickerSize))
+	offset := image.Pt((stickerSize-width)/2, (stickerSize-height)/2)
+	draw.CatmullRom.Scale(canvas, image.Rect(0, 0, width, height).Add(offset), img, bounds, draw.Src, nil)
+	return canvas
+}
+
+// Encodes a static sticker with ffmpeg, there is no WebP encoder in the Go libraries
+func staticSticker(img image.Image) ([]byte, error) {
+	if *ffmpegPath == "" {
+		return nil, badRequest("Stickers must be WebP, converting other formats requires the server to run with -ffmpeg")
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, padSticker(img)); err != nil {
+		return nil, err
+	}
+	webp, err := runFFmpeg(buf.Bytes(), "-c:v", "libwebp", "-pix_fmt", "yuva420p", "-q:v", "80", "-f", "webp", "pipe:1")
+	if err != nil {
+		return nil, fmt.Errorf("Could not convert sticker to WebP: %v", err)
+	}
+	return webp, nil
+}
+
+// Encodes an animated GIF or video as an animated sticker with ffmpeg
+func animatedSticker(data []byte) ([]byte, error) {
+	if *ffmpegPath == "" {
+		return nil, badRequest("Animated stickers must be WebP, converting GIFs and videos requires the server to run with -ffmpeg")
+	}
+	filter := "scale=512:512:force_original_aspect_ratio=decrease,fps=15,format=rgba,pad=512:512:(ow-iw)/2:(oh-ih)/2:color=0x00000000"
+	var webp []byte
+	for _, quality := range animatedStickerQualities {
+		var err error
+		webp, err = runFFmpeg(data, "-t", maxStickerSeconds, "-an", "-vf", filter, "-c:v", "libwebp", "-pix_fmt", "yuva420p", "-loop", "0", "-q:v", quality, "-f", "webp", "pipe:1")
+		if err != nil {
+			return nil, fmt.Errorf("Could not convert animated sticker to WebP: %v", err)
+		}
+		if len(webp) <= maxAnimatedSticker {
+			return webp, nil
+		}
+	}
+	return nil, badRequest(fmt.Sprintf("Animated sticker is larger than %d KB even at the lowest quality, send a shorter or simpler animation", maxAnimatedSticker>>10))
+}
+
+// Re-encodes an animated WebP sticker over the size limit, WhatsApp drops larger ones. ffmpeg builds
+// that can't decode animated WebP fail, the sticker is rejected then
+func shrinkAnimatedSticker(data []byte) ([]byte, error) {
+	tooLarge := fmt.Sprintf("Animated sticker is larger than %d KB", maxAnimatedSticker>>10)
+	if *ffmpegPath == "" {
+		return nil, badRequest(tooLarge + ", re-encoding it requires the server to run with -ffmpeg")
+	}
+	webp, err := animatedSticker(data)
+	var serr *sendError
+	if err != nil && !errors.As(err, &serr) {
+		return nil, badRequest(fmt.Sprintf("%s and could not be re-encoded: %v", tooLarge, err))
+	}
+	return webp, err
+}
+
+// Counts the frames of a GIF by walking its blocks, without decoding them. Stops counting at limit
+func gifFrames(data []byte, limit int) (int, error) {
+	truncated := errors.New("truncated GIF")
+	if len(data) < 13 || string(data[:3]) != "GIF" {
+		return 0, errors.New("not a GIF file")
+	}
+	pos := 13
+	// Global color table
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&0x07 + 1)
+	}
+	// Skips a sequence of data sub-blocks, ended by an empty one
+	skipBlocks := func() error {
+		for {
+			if pos >= len(data) {
+				return truncated
+			}
+			size := int(data[pos])
+			pos += 1 + size
+			if size == 0 {
+				return nil
+			}
+		}
+	}
+	frames := 0
+	for frames < limit {
+		if pos >= len(data) {
+			return frames, truncated
+		}
+		switch data[pos] {
+		case 0x21: // extension: label and sub-blocks
+			pos += 2
+			if err := skipBlocks(); err != nil {
+				return frames, err
+			}
+		case 0x2c: // image descriptor, optional local color table, LZW code size and image data
+			if pos+10 > len(data) {
+				return frames, truncated
+			}
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			pos++
+			if err := skipBlocks(); err != nil {
+				return frames, err
+			}
+			frames++
+		case 0x3b: // trailer
+			return frames, nil
+		default:
+			return frames, errors.New("invalid GIF block")
+		}
+	}
+	return frames, nil
+}
+
+// Splits a WebP file in its chunks
+func webpChunks(data []byte) ([]webpChunk, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a WebP file")
+	}
+	var chunks []webpChunk
+	data = data[12:]
+	for len(data) >= 8 {
+		size := int(binary.LittleEndian.Uint32(data[4:]))
+		if size > len(data)-8 {
+			return nil, errors.New("truncated WebP chunk")
+		}
+		chunks = append(chunks, webpChunk{fourcc: string(data[:4]), data: data[8 : 8+size]})
+		// Chunks are padded to an even size
+		size += size & 1
+		if size > len(data)-8 {
+			break
+		}
+		data = data[8+size:]
+	}
+	if len(chunks) == 0 {
+		return nil, errors.New("empty WebP file")
+	}
+	return chunks, nil
+}
+
+// Joins chunks in a WebP file
+func webpFile(chunks []webpChunk) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("RIFF\x00\x00\x00\x00WEBP")
+	for _, chunk := range chunks {
+		buf.WriteString(chunk.fourcc)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(chunk.data)))
+		buf.Write(chunk.data)
+		if len(chunk.data)&1 == 1 {
+			buf.WriteByte(0)
+		}
+	}
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+	return data
+}
+
+// Reads the dimensions of a WebP image, whether it is animated and whether it has transparency
+func webpImageInfo(chunks []webpChunk) (width int, height int, animated bool, alpha bool, err error) {
+	chunk := chunks[0]
+	switch {
+	case chunk.fourcc == "VP8X" && len(chunk.data) >= 10:
+		width = (int(chunk.data[4]) | int(chunk.data[5])<<8 | int(chunk.data[6])<<16) + 1
+		height = (int(chunk.data[7]) | int(chunk.data[8])<<8 | int(chunk.data[9])<<16) + 1
+		return width, height, chunk.data[0]&webpFlagAnimation != 0, chunk.data[0]&webpFlagAlpha != 0, nil
+	case chunk.fourcc == "VP8 " && len(chunk.data) >= 10:
+		width = int(binary.LittleEndian.Uint16(chunk.data[6:]) & 0x3fff)
+		height = int(binary.LittleEndian.Uint16(chunk.data[8:]) & 0x3fff)
+		return width, height, false, false, nil
+	case chunk.fourcc == "VP8L" && len(chunk.data) >= 5:
+		bits := binary.LittleEndian.Uint32(chunk.data[1:])
+		width = int(bits&0x3fff) + 1
+		height = int(bits>>14&0x3fff) + 1
+		return width, height, false, bits>>28&1 == 1, nil
+	}
+	return 0, 0, false, false, errors.New("unsupported WebP format")
+}
+
+// Reads the dimensions of a WebP file and whether it is animated
+func webpInfo(data []byte) (int, int, bool, error) {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	width, height, animated, _, err := webpImageInfo(chunks)
+	return width, height, animated, err
+}
+
+// EXIF with the sticker pack metadata, in the custom tag read by WhatsApp
+func stickerExif(pack *stickerPack) ([]byte, error) {
+	// Stickers with the same pack name and author are grouped in the same pack
+	id := sha256.Sum256([]byte(pack.Name + "\x00" + pack.Author))
+	emojis := pack.Emojis
+	if emojis == nil {
+		emojis = []string{}
+	}
+	metadata, err := json.Marshal(map[string]interface{}{
+		"sticker-pack-id":        hex.EncodeToString(id[:16]),
+		"sticker-pack-name":      pack.Name,
+		"sticker-pack-publisher": pack.Author,
+		"emojis":                 emojis,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Little endian TIFF header with a single IFD entry: tag 0x5741, type undefined, data after the IFD
+	exif := []byte{0x49, 0x49, 0x2a, 0x00, 0x08, 0x00, 0x00, 0x00, 0x01, 0x00, 0x41, 0x57, 0x07, 0x00, 0, 0, 0, 0, 0x16, 0x00, 0x00, 0x00}
+	binary.LittleEndian.PutUint32(exif[14:], uint32(len(metadata)))
+	return append(exif, metadata...), nil
+}
+
+// Stores sticker pack metadata in the EXIF chunk of a WebP file, converting simple files to the extended format
+func addStickerPack(data []byte, pack *stickerPack) ([]byte, error) {
+	chunks, err := webpChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	exif, err := stickerExif(pack)
+	if err != nil {
+		return nil, err
+	}
+	if chunks[0].fourcc != "VP8X" {
+		width, height, _, alpha, err := webpImageInfo(chunks)
+		if err != nil {
+			return nil, err
+		}
+		vp8x := make([]byte, 10)
+		if alpha {
+			vp8x[0] = webpFlagAlpha
+		}
+		vp8x[4], vp8x[5], vp8x[6] = byte(width-1), byte((width-1)>>8), byte((width-1)>>16)
+		vp8x[7], vp8x[8], vp8x[9] = byte(height-1), byte((height-1)>>8), byte((height-1)>>16)
+		chunks = append([]webpChunk{{fourcc: "VP8X", data: vp8x}}, chunks...)
+	}
+	if len(chunks[0].data) < 10 {
+		return nil, errors.New("invalid VP8X chunk")
+	}
+	vp8x := append([]byte(nil), chunks[0].data...)
+	vp8x[0] |= webpFlagExif
+	withExif := []webpChunk{{fourcc: "VP8X", data: vp8x}}
+	added := false
+	for _, chunk := range chunks[1:] {
+		switch chunk.fourcc {
+		case "EXIF":
+			continue
+		case "XMP ":
+			if added {
+				break
+			}
+			// EXIF goes before XMP metadata
+			withExif = append(withExif, webpChunk{fourcc: "EXIF", data: exif})
+			added = true
+		}
+		withExif = append(withExif, chunk)
+	}
+	if !added {
+		withExif = append(withExif, webpChunk{fourcc: "EXIF", data: exif})
+	}
+	return webpFile(withExif), nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Lossless WebP chunk of the given dimensions, with no image data
+func vp8lChunk(width int, height int, alpha bool) webpChunk {
+	bits := uint32(width-1) | uint32(height-1)<<14
+	if alpha {
+		bits |= 1 << 28
+	}
+	return webpChunk{fourcc: "VP8L", data: []byte{0x2f, byte(bits), byte(bits >> 8), byte(bits >> 16), byte(bits >> 24)}}
+}
+
+func vp8xChunk(width int, height int, flags byte) webpChunk {
+	data := make([]byte, 10)
+	data[0] = flags
+	data[4], data[5], data[6] = byte(width-1), byte((width-1)>>8), byte((width-1)>>16)
+	data[7], data[8], data[9] = byte(height-1), byte((height-1)>>8), byte((height-1)>>16)
+	return webpChunk{fourcc: "VP8X", data: data}
+}
+
+func fourccs(chunks []webpChunk) string {
+	names := []string{}
+	for _, chunk := range chunks {
+		names = append(names, chunk.fourcc)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestWebpChunks(t *testing.T) {
+	odd := webpChunk{fourcc: "XMP ", data: []byte("abc")}
+	valid := webpFile([]webpChunk{vp8xChunk(512, 512, 0), vp8lChunk(512, 512, true), odd})
+	tests := []struct {
+		name   string
+		data   []byte
+		chunks string
+		ok     bool
+	}{
+		{"chunks with padding", valid, "VP8X,VP8L,XMP ", true},
+		{"single chunk", webpFile([]webpChunk{vp8lChunk(10, 20, false)}), "VP8L", true},
+		{"not riff", append([]byte("RIFX"), valid[4:]...), "", false},
+		{"not webp", append(append([]byte(nil), valid[:8]...), append([]byte("WAVE"), valid[12:]...)...), "", false},
+		{"truncated chunk", valid[:len(valid)-4], "", false},
+		{"empty", valid[:12], "", false},
+		{"too short", []byte("RIFF"), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks, err := webpChunks(tt.data)
+			if (err == nil) != tt.ok {
+				t.Fatalf("webpChunks() error = %v, want ok %v", err, tt.ok)
+			}
+			if got := fourccs(chunks); got != tt.chunks {
+				t.Errorf("chunks = %q, want %q", got, tt.chunks)
+			}
+		})
+	}
+	chunks, _ := webpChunks(valid)
+	if !bytes.Equal(chunks[2].data, odd.data) {
+		t.Errorf("odd chunk data = %q, want %q", chunks[2].data, odd.data)
+	}
+}
+
+func TestAddStickerPack(t *testing.T) {
+	pack := &stickerPack{Name: "Pack", Author: "Author", Emojis: []string{"😀"}}
+	tests := []struct {
+		name   string
+		data   []byte
+		chunks string
+		alpha  bool
+		ok     bool
+	}{
+		{"simple lossless", webpFile([]webpChunk{vp8lChunk(512, 512, true)}), "VP8X,VP8L,EXIF", true, true},
+		{"extended", webpFile([]webpChunk{vp8xChunk(512, 512, webpFlagAlpha), vp8lChunk(512, 512, true)}), "VP8X,VP8L,EXIF", true, true},
+		{"exif replaced", webpFile([]webpChunk{vp8xChunk(512, 512, webpFlagExif), vp8lChunk(512, 512, false), {fourcc: "EXIF", data: []byte("old")}}), "VP8X,VP8L,EXIF", false, true},
+		{"exif before xmp", webpFile([]webpChunk{vp8xChunk(512, 512, 0), vp8lChunk(512, 512, false), {fourcc: "XMP ", data: []byte("<x/>")}}), "VP8X,VP8L,EXIF,XMP ", false, true},
+		{"invalid vp8x", webpFile([]webpChunk{{fourcc: "VP8X", data: []byte{0}}}), "", false, false},
+		{"not webp", []byte("GIF89a"), "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := addStickerPack(tt.data, pack)
+			if (err == nil) != tt.ok {
+				t.Fatalf("addStickerPack() error = %v, want ok %v", err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+			chunks, err := webpChunks(data)
+			if err != nil {
+				t.Fatalf("webpChunks: %v", err)
+			}
+			if got := fourccs(chunks); got != tt.chunks {
+				t.Errorf("chunks = %q, want %q", got, tt.chunks)
+			}
+			width, height, _, alpha, err := webpImageInfo(chunks)
+			if err != nil || width != 512 || height != 512 || alpha != tt.alpha {
+				t.Errorf("got %dx%d alpha %v (%v), want 512x512 alpha %v", width, height, alpha, err, tt.alpha)
+			}
+			if chunks[0].data[0]&webpFlagExif == 0 {
+				t.Error("EXIF flag not set")
+			}
+			for _, chunk := range chunks {
+				if chunk.fourcc != "EXIF" {
+					continue
+				}
+				var metadata map[string]interface{}
+				if err := json.Unmarshal(chunk.data[22:], &metadata); err != nil {
+					t.Fatalf("EXIF metadata: %v", err)
+				}
+				if metadata["sticker-pack-name"] != "Pack" || metadata["sticker-pack-publisher"] != "Author" {
+					t.Errorf("unexpected metadata %v", metadata)
+				}
+			}
+		})
+	}
+}
+
+func encodeGIF(frames int) []byte {
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 16, 16), palette))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	gif.EncodeAll(&buf, anim)
+	return buf.Bytes()
+}
+
+func TestGifFrames(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		limit  int
+		frames int
+		ok     bool
+	}{
+		{"static", encodeGIF(1), 10, 1, true},
+		{"animated", encodeGIF(5), 10, 5, true},
+		{"stops at limit", encodeGIF(5), 2, 2, true},
+		{"truncated", encodeGIF(5)[:60], 10, 0, false},
+		{"not a gif", pngHeader, 10, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames, err := gifFrames(tt.data, tt.limit)
+			if (err == nil) != tt.ok {
+				t.Fatalf("gifFrames() error = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && frames != tt.frames {
+				t.Errorf("gifFrames() = %d, want %d", frames, tt.frames)
+			}
+		})
+	}
+}
+
+func TestConvertStickerGifBomb(t *testing.T) {
+	// Logical screen of 65535x65535, over the pixel limit
+	data := encodeGIF(1)
+	data[6], data[7], data[8], data[9] = 0xff, 0xff, 0xff, 0xff
+	if _, err := convertSticker(data, "image/gif"); err == nil || !strings.Contains(err.Error(), "exceed") {
+		t.Errorf("convertSticker() = %v, want a dimensions error", err)
+	}
+}
+
+func TestConvertStickerAnimatedWebp(t *testing.T) {
+	defer func(path string) { *ffmpegPath = path }(*ffmpegPath)
+	*ffmpegPath = ""
+	animation := webpChunk{fourcc: "ANIM", data: make([]byte, 6)}
+	tests := []struct {
+		name  string
+		frame int // size of the frame data
+		ok    bool
+	}{
+		{"within the limit kept", 100 << 10, true},
+		{"over the limit without ffmpeg", maxAnimatedSticker, false},
+	}
+	for _, tt := range tests {
+		data := webpFile([]webpChunk{vp8xChunk(512, 512, webpFlagAnimation), animation, {fourcc: "ANMF", data: make([]byte, tt.frame)}})
+		sticker, err := convertSticker(data, "image/webp")
+		if tt.ok && (err != nil || !bytes.Equal(sticker, data)) {
+			t.Errorf("%s: convertSticker() = %v, want the sticker unchanged", tt.name, err)
+		}
+		var serr *sendError
+		if !tt.ok && (!errors.As(err, &serr) || serr.Status != http.StatusBadRequest) {
+			t.Errorf("%s: convertSticker() = %v, want a 400 error", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Message types a template can hold
+var templateTypes = map[string]bool{"text": true, "image": true, "video": true, "document": true, "buttons": true, "list": true}
+
+var templateNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// {{name}} placeholders, the same syntax as campaign variables
+var placeholderPattern = regexp.MustCompile(`\{\{([A-Za-z0-9_.-]+)\}\}`)
+
+// Named message stored by a user, sent with its {{name}} placeholders replaced by variables
+type messageTemplate struct {
+	Name      string
+	Type      string
+	Content   json.RawMessage
+	Variables []string
+	Created   time.Time
+	Updated   time.Time
+}
+
+// Checks a template can be stored, and lists its variables
+func validateTemplate(t *messageTemplate) error {
+	if !templateNamePattern.MatchString(t.Name) {
+		return errors.New("Invalid Name, must be up to 64 letters, digits, dots, dashes or underscores")
+	}
+	if !templateTypes[t.Type] {
+		return fmt.Errorf("Invalid Type %q, use text, image, video, document, buttons or list", t.Type)
+	}
+	var content map[string]interface{}
+	if len(t.Content) == 0 || json.Unmarshal(t.Content, &content) != nil {
+		return errors.New("Content must be a JSON object")
+	}
+	t.Variables = templateVariables(t.Content)
+	// Check the content as it will be sent, each placeholder filled with its name
+	vars := make(map[string]string)
+	for _, name := range t.Variables {
+		vars[name] = name
+	}
+	filled, err := substituteVariables(t.Content, vars)
+	if err != nil {
+		return err
+	}
+	return validateContent(t.Type, filled)
+}
+
+// Lists the distinct placeholders of a template content
+func templateVariables(content json.RawMessage) []string {
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, match := range placeholderPattern.FindAllSubmatch(content, -1) {
+		name := string(match[1])
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Fills the placeholders of a template, all its variables must be given
+func renderTemplate(t *messageTemplate, vars map[string]string) (json.RawMessage, error) {
+	missing := []string{}
+	for _, name := range templateVariables(t.Content) {
+		if _, ok := vars[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, badRequest("Missing Variables: " + strings.Join(missing, ", "))
+	}
+	content, err := substituteVariables(t.Content, vars)
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// Creates or replaces a template, returns whether it was created
+func saveTemplate(db *sql.DB, userid int, t *messageTemplate) (bool, error) {
+	var created int64
+	err := db.QueryRow("SELECT created FROM message_templates WHERE user_id=? AND name=?", userid, t.Name).Scan(&created)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	isNew := err == sql.ErrNoRows
+	now := time.Now()
+	if isNew {
+		created = now.Unix()
+	}
+	sqlStmt := `INSERT OR REPLACE INTO message_templates (user_id, name, type, content, created, updated) VALUES (?, ?, ?, ?, ?, ?)`
+	_, err = db.Exec(sqlStmt, userid, t.Name, t.Type, string(t.Content), created, now.Unix())
+	if err != nil {
+		return false, err
+	}
+	t.Created = time.Unix(created, 0)
+	t.Updated = time.Unix(now.Unix(), 0)
+	return isNew, nil
+}
+
+const templateColumns = "name, type, content, created, updated"
+
+func scanTemplate(row interface{ Scan(...interface{}) error }) (*messageTemplate, error) {
+	var content string
+	var created, updated int64
+	t := &messageTemplate{}
+	if err := row.Scan(&t.Name, &t.Type, &content, &created, &updated); err != nil {
+		return nil, err
+	}
+	t.Content = json.RawMessage(content)
+	t.Variables = templateVariables(t.Content)
+	t.Created = time.Unix(created, 0)
+	t.Updated = time.Unix(updated, 0)
+	return t, nil
+}
+
+// Gets a template by name, returns sql.ErrNoRows if it does not exist
+func getTemplate(db *sql.DB, userid int, name string) (*messageTemplate, error) {
+	return scanTemplate(db.QueryRow("SELECT "+templateColumns+" FROM message_templates WHERE user_id=? AND name=?", userid, name))
+}
+
+func listTemplates(db *sql.DB, userid int) ([]*messageTemplate, error) {
+	rows, err := db.Query("SELECT "+templateColumns+" FROM message_templates WHERE user_id=? ORDER BY name", userid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*messageTemplate{}
+	for rows.Next() {
+		t, err := scanTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+// Deletes a template, returns whether it existed
+func deleteTemplate(db *sql.DB, userid int, name string) (bool, error) {
+	res, err := db.Exec("DELETE FROM message_templates WHERE user_id=? AND name=?", userid, name)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
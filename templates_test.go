@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestValidateTemplate(t *testing.T) {
+	tests := []struct {
+		name      string
+		tmpl      messageTemplate
+		variables []string
+		ok        bool
+	}{
+		{"text", messageTemplate{Name: "order_shipped", Type: "text", Content: json.RawMessage(`{"Body":"Hi {{name}}, order {{order}} shipped. Bye {{name}}"}`)}, []string{"name", "order"}, true},
+		{"image", messageTemplate{Name: "promo.v2", Type: "image", Content: json.RawMessage(`{"Url":"https://example.com/{{code}}.jpg","Caption":"Code {{code}}"}`)}, []string{"code"}, true},
+		{"no variables", messageTemplate{Name: "hello", Type: "text", Content: json.RawMessage(`{"Body":"Hello"}`)}, []string{}, true},
+		{"invalid name", messageTemplate{Name: "bad name", Type: "text", Content: json.RawMessage(`{"Body":"Hello"}`)}, nil, false},
+		{"unsupported type", messageTemplate{Name: "poll", Type: "poll", Content: json.RawMessage(`{"Name":"Poll"}`)}, nil, false},
+		{"content not an object", messageTemplate{Name: "list", Type: "text", Content: json.RawMessage(`["Hello"]`)}, nil, false},
+		{"missing content", messageTemplate{Name: "empty", Type: "text"}, nil, false},
+		{"field of the wrong type", messageTemplate{Name: "caption", Type: "image", Content: json.RawMessage(`{"Url":"https://example.com/a.jpg","Caption":12}`)}, nil, false},
+		{"buttons of the wrong type", messageTemplate{Name: "buttons", Type: "buttons", Content: json.RawMessage(`{"Title":"{{title}}","Buttons":"yes,no"}`)}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := tt.tmpl
+			err := validateTemplate(&tmpl)
+			if (err == nil) != tt.ok {
+				t.Fatalf("validateTemplate() = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && !reflect.DeepEqual(tmpl.Variables, tt.variables) {
+				t.Errorf("Variables = %v, want %v", tmpl.Variables, tt.variables)
+			}
+		})
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	tmpl := &messageTemplate{Name: "order", Type: "text", Content: json.RawMessage(`{"Body":"Hi {{name}}, order {{order}} shipped"}`)}
+	tests := []struct {
+		name    string
+		vars    map[string]string
+		want    string
+		missing string
+	}{
+		{"all variables", map[string]string{"name": "Ana", "order": "#1042"}, `{"Body":"Hi Ana, order #1042 shipped"}`, ""},
+		{"extra variables ignored", map[string]string{"name": "Ana", "order": "#1042", "other": "x"}, `{"Body":"Hi Ana, order #1042 shipped"}`, ""},
+		{"values are not parsed as placeholders", map[string]string{"name": "{{order}}", "order": "1"}, `{"Body":"Hi {{order}}, order 1 shipped"}`, ""},
+		{"one missing", map[string]string{"name": "Ana"}, "", "Missing Variables: order"},
+		{"all missing", nil, "", "Missing Variables: name, order"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := renderTemplate(tmpl, tt.vars)
+			if tt.missing != "" {
+				var serr *sendError
+				if !errors.As(err, &serr) || serr.Status != http.StatusBadRequest || err.Error() != tt.missing {
+					t.Errorf("renderTemplate() error = %v, want 400 %q", err, tt.missing)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("renderTemplate: %v", err)
+			}
+			if string(content) != tt.want {
+				t.Errorf("renderTemplate() = %s, want %s", content, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Number of bars of a voice note waveform, and their maximum height
+const waveformBars = 64
+const waveformMax = 100
+
+// Sample rate of the audio decoded to compute waveforms
+const waveformRate = 8000
+
+// Whether audio is an ogg file encoded with opus, which WhatsApp plays as a voice note
+func isOpus(data []byte) bool {
+	if !bytes.HasPrefix(data, []byte("OggS")) || len(data) < 27 || len(data) < 27+int(data[26]) {
+		return false
+	}
+	return bytes.HasPrefix(data[27+int(data[26]):], []byte("OpusHead"))
+}
+
+// Converts audio to mono ogg/opus with ffmpeg, the format of WhatsApp voice notes
+func encodeVoiceNote(data []byte) ([]byte, error) {
+	if *ffmpegPath == "" {
+		return nil, badRequest("Audio must be ogg/opus to be sent as a voice note, converting it requires the server to run with -ffmpeg")
+	}
+	encoded, err := runFFmpeg(data, "-vn", "-ac", "1", "-ar", "48000", "-c:a", "libopus", "-b:a", "32k", "-application", "voip", "-f", "ogg", "pipe:1")
+	if err != nil {
+		return nil, badRequest(fmt.Sprintf("Could not convert audio to a voice note: %v", err))
+	}
+	return encoded, nil
+}
+
+// Computes the waveform shown on a voice note: the average loudness of 64 slices of the audio,
+// scaled from 0 to 100. Decoding opus needs ffmpeg, without it the voice note is sent without waveform
+func voiceWaveform(data []byte) []byte {
+	if *ffmpegPath == "" {
+		return nil
+	}
+	pcm, err := runFFmpeg(data, "-vn", "-ac", "1", "-ar", fmt.Sprint(waveformRate), "-f", "s16le", "pipe:1")
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not decode audio for waveform")
+		return nil
+	}
+	return pcmWaveform(pcm)
+}
+
+// Waveform of 16 bit little endian mono samples, nil if there are fewer samples than bars
+func pcmWaveform(pcm []byte) []byte {
+	samples := len(pcm) / 2
+	if samples < waveformBars {
+		return nil
+	}
+	levels := make([]float64, waveformBars)
+	var loudest float64
+	for bar := range levels {
+		from, to := bar*samples/waveformBars, (bar+1)*samples/waveformBars
+		var sum float64
+		for i := from; i < to; i++ {
+			sample := float64(int16(binary.LittleEndian.Uint16(pcm[i*2:])))
+			if sample < 0 {
+				sample = -sample
+			}
+			sum += sample
+		}
+		levels[bar] = sum / float64(to-from)
+		if levels[bar] > loudest {
+			loudest = levels[bar]
+		}
+	}
+	waveform := make([]byte, waveformBars)
+	if loudest == 0 {
+		return waveform
+	}
+	for bar, level := range levels {
+		waveform[bar] = byte(level / loudest * waveformMax)
+	}
+	return waveform
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// Mono 16 bit PCM with each bar of the waveform holding samples of the given amplitude, alternating sign
+func pcmBars(amplitudes []int16, perBar int) []byte {
+	pcm := make([]byte, len(amplitudes)*perBar*2)
+	for bar, amplitude := range amplitudes {
+		for i := 0; i < perBar; i++ {
+			sample := amplitude
+			if i%2 == 1 {
+				sample = -amplitude
+			}
+			binary.LittleEndian.PutUint16(pcm[(bar*perBar+i)*2:], uint16(sample))
+		}
+	}
+	return pcm
+}
+
+func repeatLevel(amplitude int16) []int16 {
+	amplitudes := make([]int16, waveformBars)
+	for i := range amplitudes {
+		amplitudes[i] = amplitude
+	}
+	return amplitudes
+}
+
+func TestPcmWaveform(t *testing.T) {
+	ramp := make([]int16, waveformBars)
+	for i := range ramp {
+		ramp[i] = int16(i * 512)
+	}
+	tests := []struct {
+		name string
+		pcm  []byte
+		want func(bar int) byte
+	}{
+		{"silence", pcmBars(repeatLevel(0), 10), func(int) byte { return 0 }},
+		{"constant level is full scale", pcmBars(repeatLevel(1000), 10), func(int) byte { return waveformMax }},
+		{"negative samples count as loud", pcmBars(repeatLevel(-32768), 10), func(int) byte { return waveformMax }},
+		{"scaled to the loudest bar", pcmBars(ramp, 10), func(bar int) byte { return byte(float64(bar) / float64(waveformBars-1) * waveformMax) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waveform := pcmWaveform(tt.pcm)
+			if len(waveform) != waveformBars {
+				t.Fatalf("got %d bars, want %d", len(waveform), waveformBars)
+			}
+			for bar, level := range waveform {
+				if level != tt.want(bar) {
+					t.Errorf("bar %d = %d, want %d", bar, level, tt.want(bar))
+				}
+			}
+		})
+	}
+	if waveform := pcmWaveform(pcmBars([]int16{1000}, waveformBars-1)); waveform != nil {
+		t.Errorf("audio shorter than the bars got waveform %v", waveform)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Custom webhook request rendered from each event, configured per user
+type webhookTemplate struct {
+	Enabled     bool
+	Method      string            // HTTP method, defaults to POST
+	ContentType string            // defaults to application/json
+	Headers     map[string]string // header values are rendered as templates too
+	Body        string            // text/template rendered with the event
+}
+
+// Webhook request produced by a template
+type renderedWebhook struct {
+	Method  string
+	Url     string
+	Headers map[string]string
+	Body    string
+}
+
+var webhookTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"replace": strings.ReplaceAll,
+	"default": func(def interface{}, v interface{}) interface{} {
+		if v == nil || v == "" {
+			return def
+		}
+		return v
+	},
+	// Appended to every printed pipeline, see parseWebhookTemplate
+	"orempty": func(v interface{}) interface{} {
+		if v == nil {
+			return ""
+		}
+		return v
+	},
+}
+
+// Parses a webhook template. Fields missing from the event print as "<no value>" in text/template,
+// even with missingkey=zero on map data, so every printed pipeline is piped to orempty instead
+func parseWebhookTemplate(name string, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(webhookTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			emptyMissingValues(t.Tree, t.Tree.Root)
+		}
+	}
+	return tmpl, nil
+}
+
+func emptyMissingValues(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			emptyMissingValues(tree, child)
+		}
+	case *parse.ActionNode:
+		// Variable declarations print nothing
+		if len(n.Pipe.Decl) > 0 {
+			return
+		}
+		orempty := parse.NewIdentifier("orempty").SetTree(tree).SetPos(n.Pos)
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos, Args: []parse.Node{orempty}})
+	case *parse.IfNode:
+		emptyMissingValues(tree, n.List)
+		emptyMissingValues(tree, n.ElseList)
+	case *parse.RangeNode:
+		emptyMissingValues(tree, n.List)
+		emptyMissingValues(tree, n.ElseList)
+	case *parse.WithNode:
+		emptyMissingValues(tree, n.List)
+		emptyMissingValues(tree, n.ElseList)
+	}
+}
+
+// Sample events used to preview templates
+var sampleWebhookEvents = map[string]string{
+	"Message":          `{"type":"Message","event":{"Info":{"Chat":"5491155554444@s.whatsapp.net","Sender":"5491155554444@s.whatsapp.net","IsFromMe":false,"IsGroup":false,"ID":"3EB06F9067F80BAB89FF","Type":"text","PushName":"John","Timestamp":"2023-06-01T12:00:00Z","Category":""},"Message":{"conversation":"Hello from WuzAPI"},"IsEphemeral":false,"IsViewOnce":false}}`,
+	"MessageEdit":      `{"type":"MessageEdit","edited":{"id":"3EB06F9067F80BAB89FF","chat":"5491155554444@s.whatsapp.net","text":"Hello again from WuzAPI","timestamp":1685620800},"event":{"Info":{"Chat":"5491155554444@s.whatsapp.net","Sender":"5491155554444@s.whatsapp.net","IsFromMe":false,"IsGroup":false,"ID":"3EB0A1B2C3D4E5F60718","Type":"text","PushName":"John","Timestamp":"2023-06-01T12:00:00Z","Category":""},"IsEdit":true}}`,
+	"MessageRevoke":    `{"type":"MessageRevoke","revoked":{"id":"3EB06F9067F80BAB89FF","chat":"5491155554444@s.whatsapp.net","sender":"5491155554444@s.whatsapp.net","revokedBy":"5491155554444@s.whatsapp.net","byAdmin":false},"event":{"Info":{"Chat":"5491155554444@s.whatsapp.net","Sender":"5491155554444@s.whatsapp.net","IsFromMe":false,"IsGroup":false,"ID":"3EB0A1B2C3D4E5F60719","Type":"text","PushName":"John","Timestamp":"2023-06-01T12:00:00Z","Category":""}}}`,
+	"PollVote":         `{"type":"PollVote","vote":{"pollId":"3EB06F9067F80BAB89FF","pollName":"Lunch?","chat":"5491155554444@s.whatsapp.net","voter":"5491155554444@s.whatsapp.net","options":["Pizza"],"timestamp":1685620800},"event":{"Info":{"Chat":"5491155554444@s.whatsapp.net","Sender":"5491155554444@s.whatsapp.net","IsFromMe":false,"IsGroup":false,"ID":"3EB0A1B2C3D4E5F60720","Type":"poll","PushName":"John","Timestamp":"2023-06-01T12:00:00Z","Category":""}}}`,
+	"Status":           `{"type":"Status","event":{"Info":{"Chat":"status@broadcast","Sender":"5491155554444@s.whatsapp.net","IsFromMe":false,"IsGroup":false,"ID":"3EB0D1E2F3A4B5C6D7E8","Type":"text","PushName":"John","Timestamp":"2023-06-01T12:00:00Z","Category":""},"Message":{"extendedTextMessage":{"text":"Out of office until Monday","backgroundArgb":4280902815,"font":1}},"IsEphemeral":false,"IsViewOnce":false}}`,
+	"ScheduledMessage": `{"type":"ScheduledMessage","state":"Sent","event":{"Id":12,"SendAt":"2023-06-01T09:00:00-03:00","Timezone":"America/Argentina/Buenos_Aires","Status":"sent","MessageId":"3EB06F9067F80BAB89FF","SentAt":"2023-06-01T09:00:03-03:00","Created":"2023-05-31T18:20:00-03:00","Request":{"Type":"text","To":"5491155554444","Content":{"Body":"Good morning"},"Options":{"Id":"3EB06F9067F80BAB89FF","ContextInfo":null}}}}`,
+	"SendStatus":       `{"type":"SendStatus","state":"Sent","id":"3EB06F9067F80BAB89FF","to":"5491155554444@s.whatsapp.net","messageType":"text","timestamp":1685620800}`,
+	"ReadReceipt":      `{"type":"ReadReceipt","state":"Read","event":{"Chat":"5491155554444@s.whatsapp.net","Sender":"5491155554444@s.whatsapp.net","IsFromMe":false,"IsGroup":false,"MessageIDs":["3EB06F9067F80BAB89FF"],"Timestamp":"2023-06-01T12:00:05Z","Type":"read"}}`,
+	"Presence":         `{"type":"Presence","state":"online","event":{"From":"5491155554444@s.whatsapp.net","Unavailable":false,"LastSeen":"0001-01-01T00:00:00Z"}}`,
+	"ChatPresence":     `{"type":"ChatPresence","event":{"Chat":"5491155554444@s.whatsapp.net","Sender":"5491155554444@s.whatsapp.net","IsFromMe":false,"IsGroup":false,"State":"composing","Media":""}}`,
+	"SessionStatus":    `{"type":"SessionStatus","state":"Connected","event":{}}`,
+}
+
+// Gets the webhook template for a user
+func getWebhookTemplate(db *sql.DB, userid int) webhookTemplate {
+	var tmpl webhookTemplate
+	err := getUserSetting(db, userid, "webhooktemplate", &tmpl)
+	if err != nil {
+		log.Warn().Err(err).Int("userid", userid).Msg("Could not load webhook template")
+	}
+	return tmpl
+}
+
+// Checks the method and parses every template
+func (t webhookTemplate) validate() error {
+	switch strings.ToUpper(t.Method) {
+	case "", http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodGet, http.MethodDelete:
+	default:
+		return fmt.Errorf("Invalid Method %q", t.Method)
+	}
+	_, err := parseWebhookTemplate("body", t.Body)
+	if err != nil {
+		return fmt.Errorf("Invalid Body template: %v", err)
+	}
+	for name, value := range t.Headers {
+		_, err := parseWebhookTemplate(name, value)
+		if err != nil {
+			return fmt.Errorf("Invalid template for header %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Renders the webhook request for an event
+func (t webhookTemplate) render(webhookurl string, postmap map[string]interface{}, token string) (*renderedWebhook, error) {
+	// Work on the JSON representation so templates see the same field names as the default webhook payload
+	encoded, err := json.Marshal(postmap)
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]interface{})
+	err = json.Unmarshal(encoded, &data)
+	if err != nil {
+		return nil, err
+	}
+	data["token"] = token
+
+	execute := func(name string, text string) (string, error) {
+		tmpl, err := parseWebhookTemplate(name, text)
+		if err != nil {
+			return "", err
+		}
+		var out bytes.Buffer
+		err = tmpl.Execute(&out, data)
+		return out.String(), err
+	}
+
+	rendered := &renderedWebhook{Method: strings.ToUpper(t.Method), Url: webhookurl, Headers: make(map[string]string)}
+	if rendered.Method == "" {
+		rendered.Method = http.MethodPost
+	}
+	rendered.Headers["Content-Type"] = t.ContentType
+	if t.ContentType == "" {
+		rendered.Headers["Content-Type"] = "application/json"
+	}
+	for name, value := range t.Headers {
+		rendered.Headers[name], err = execute(name, value)
+		if err != nil {
+			return nil, fmt.Errorf("Could not render header %s: %v", name, err)
+		}
+	}
+	rendered.Body, err = execute("body", t.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not render body: %v", err)
+	}
+	return rendered, nil
+}
+
+// webhook rendered from a template. With a file attached the request is multipart, the rendered body
+// is sent in the body field, with the template content type, next to the file field
+func callHookTemplate(rendered *renderedWebhook, id int, file string) (*resty.Response, error) {
+	log.Info().Str("url", rendered.Url).Str("method", rendered.Method).Str("file", file).Msg("Sending templated webhook")
+	req := webhookClient(id).R()
+	if file == "" {
+		req.SetHeaders(rendered.Headers).SetBody(rendered.Body)
+	} else {
+		contentType := ""
+		for name, value := range rendered.Headers {
+			if strings.EqualFold(name, "Content-Type") {
+				contentType = value
+			} else {
+				req.SetHeader(name, value)
+			}
+		}
+		req.SetMultipartField("body", "", contentType, strings.NewReader(rendered.Body)).SetFile("file", file)
+	}
+	resp, err := req.Execute(rendered.Method, rendered.Url)
+	return resp, webhookError(resp, err)
+}
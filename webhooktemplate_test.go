@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWebhookTemplateRender(t *testing.T) {
+	postmap := map[string]interface{}{
+		"type":  "Message",
+		"state": "",
+		"event": map[string]interface{}{
+			"Info":    map[string]interface{}{"Chat": "5491155554444@s.whatsapp.net", "PushName": "John"},
+			"Message": map[string]interface{}{"conversation": "<no value> is a valid text"},
+		},
+		"list": []string{"a", "b"},
+	}
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"field", `{{.event.Info.Chat}}`, "5491155554444@s.whatsapp.net"},
+		{"token", `{{.token}}`, "1234ABCD"},
+		{"missing field", `[{{.missing}}]`, "[]"},
+		{"missing nested field", `[{{.event.Info.Missing}}][{{.missing.deeper}}]`, "[][]"},
+		{"content kept as is", `{{.event.Message.conversation}}`, "<no value> is a valid text"},
+		{"json", `{"from":{{json .event.Info.PushName}}}`, `{"from":"John"}`},
+		{"json of missing field", `{{json .missing}}`, "null"},
+		{"default", `{{default "none" .state}}/{{default "none" .missing}}/{{default "none" .type}}`, "none/none/Message"},
+		{"functions", `{{upper .type}} {{lower .type}} {{replace .type "M" "m"}}`, "MESSAGE message message"},
+		{"if", `{{if .missing}}yes{{else}}no {{.missing}}{{end}}`, "no "},
+		{"range", `{{range .list}}{{.}}{{end}}`, "ab"},
+		{"with", `{{with .event.Info}}{{.PushName}}{{.Missing}}{{end}}`, "John"},
+		{"variable", `{{$chat := .event.Info.Chat}}{{$chat}}`, "5491155554444@s.whatsapp.net"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := webhookTemplate{Body: tt.body, Headers: map[string]string{"X-Missing": "{{.missing}}"}}
+			rendered, err := tmpl.render("http://localhost/hook", postmap, "1234ABCD")
+			if err != nil {
+				t.Fatalf("render: %v", err)
+			}
+			if rendered.Body != tt.want {
+				t.Errorf("Body = %q, want %q", rendered.Body, tt.want)
+			}
+			if rendered.Headers["X-Missing"] != "" {
+				t.Errorf("X-Missing header = %q, want empty", rendered.Headers["X-Missing"])
+			}
+		})
+	}
+}
+
+func TestWebhookTemplateDefaults(t *testing.T) {
+	rendered, err := webhookTemplate{Body: "{}"}.render("http://localhost/hook", map[string]interface{}{"type": "Test"}, "")
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if rendered.Method != "POST" || rendered.Headers["Content-Type"] != "application/json" || rendered.Url != "http://localhost/hook" {
+		t.Errorf("unexpected defaults: %+v", rendered)
+	}
+}
+
+func TestWebhookTemplateValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		tmpl  webhookTemplate
+		valid bool
+	}{
+		{"valid", webhookTemplate{Method: "put", Body: `{{json .}}`, Headers: map[string]string{"X-Type": "{{.type}}"}}, true},
+		{"invalid method", webhookTemplate{Method: "CONNECT", Body: "{}"}, false},
+		{"invalid body", webhookTemplate{Body: "{{.type"}, false},
+		{"unknown function", webhookTemplate{Body: "{{nope .type}}"}, false},
+		{"invalid header", webhookTemplate{Body: "{}", Headers: map[string]string{"X-Type": "{{end}}"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.tmpl.validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestCallHookTemplate(t *testing.T) {
+	// Parts of multipart requests by field name, with their content type, or the whole body under ""
+	type part struct {
+		contentType string
+		data        string
+	}
+	var token string
+	var parts map[string]part
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("X-Token")
+		parts = make(map[string]part)
+		reader, err := r.MultipartReader()
+		if err != nil {
+			data, _ := io.ReadAll(r.Body)
+			parts[""] = part{r.Header.Get("Content-Type"), string(data)}
+			return
+		}
+		for {
+			p, err := reader.NextPart()
+			if err != nil {
+				return
+			}
+			data, _ := io.ReadAll(p)
+			parts[p.FormName()] = part{p.Header.Get("Content-Type"), string(data)}
+		}
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "photo.jpg")
+	os.WriteFile(path, []byte("photo"), 0600)
+	rendered := &renderedWebhook{Method: http.MethodPost, Url: server.URL, Headers: map[string]string{"Content-Type": "application/json", "X-Token": "1234ABCD"}, Body: `{"type":"Message"}`}
+
+	tests := []struct {
+		name  string
+		file  string
+		parts map[string]part
+	}{
+		{"without file", "", map[string]part{"": {"application/json", rendered.Body}}},
+		{"with file", path, map[string]part{"body": {"application/json", rendered.Body}, "file": {"application/octet-stream", "photo"}}},
+	}
+	for _, tt := range tests {
+		if _, err := callHookTemplate(rendered, 1, tt.file); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if token != "1234ABCD" || !reflect.DeepEqual(parts, tt.parts) {
+			t.Errorf("%s: got token %q and %+v, want %+v", tt.name, token, parts, tt.parts)
+		}
+	}
+}
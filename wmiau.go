@@ -8,11 +8,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"mime"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -35,9 +34,63 @@ import (
 
 // var wlog waLog.Logger
 var clientPointer = make(map[int]*whatsmeow.Client)
+var clientPointerMutex sync.RWMutex
+var myClients = make(map[int]*MyClient)
+var myClientsMutex sync.RWMutex
 var clientHttp = make(map[int]*resty.Client)
 var historySyncID int32
 
+// Gets the event handler of a running session, nil if it is not running
+func getMyClient(userid int) *MyClient {
+	myClientsMutex.RLock()
+	defer myClientsMutex.RUnlock()
+	return myClients[userid]
+}
+
+func setMyClient(userid int, mycli *MyClient) {
+	myClientsMutex.Lock()
+	defer myClientsMutex.Unlock()
+	myClients[userid] = mycli
+}
+
+func deleteMyClient(userid int) {
+	myClientsMutex.Lock()
+	defer myClientsMutex.Unlock()
+	delete(myClients, userid)
+}
+
+// Gets the whatsmeow client of a running session, nil if it is not running
+func getClient(userid int) *whatsmeow.Client {
+	clientPointerMutex.RLock()
+	defer clientPointerMutex.RUnlock()
+	return clientPointer[userid]
+}
+
+// Lists the sessions that are connected and logged in
+func connectedUsers() []int {
+	clientPointerMutex.RLock()
+	defer clientPointerMutex.RUnlock()
+	users := []int{}
+	for userid, client := range clientPointer {
+		if client != nil && client.IsConnected() && client.IsLoggedIn() {
+			users = append(users, userid)
+		}
+	}
+	return users
+}
+
+func setClient(userid int, client *whatsmeow.Client) {
+	clientPointerMutex.Lock()
+	defer clientPointerMutex.Unlock()
+	clientPointer[userid] = client
+}
+
+func deleteClient(userid int) {
+	clientPointerMutex.Lock()
+	defer clientPointerMutex.Unlock()
+	delete(clientPointer, userid)
+}
+
 type MyClient struct {
 	WAClient       *whatsmeow.Client
 	eventHandlerID uint32
@@ -45,6 +98,7 @@ type MyClient struct {
 	token          string
 	subscriptions  []string
 	db             *sql.DB
+	exPath         string
 }
 
 // Connects to Whatsapp Websocket on server startup if last state was connected
@@ -154,8 +208,8 @@ func (s *server) startClient(userID int, textjid string, token string, subscript
 	var deviceStore *store.Device
 	var err error
 
-	if clientPointer[userID] != nil {
-		isConnected := clientPointer[userID].IsConnected()
+	if client := getClient(userID); client != nil {
+		isConnected := client.IsConnected()
 		if isConnected == true {
 			return
 		}
@@ -217,9 +271,10 @@ func (s *server) startClient(userID int, textjid string, token string, subscript
 	} else {
 		client = whatsmeow.NewClient(deviceStore, nil)
 	}
-	clientPointer[userID] = client
-	mycli := MyClient{client, 1, userID, token, subscriptions, s.db}
+	setClient(userID, client)
+	mycli := MyClient{client, 1, userID, token, subscriptions, s.db, s.exPath}
 	mycli.eventHandlerID = mycli.WAClient.AddEventHandler(mycli.myEventHandler)
+	setMyClient(userID, &mycli)
 	clientHttp[userID] = resty.New()
 	clientHttp[userID].SetRedirectPolicy(resty.FlexibleRedirectPolicy(15))
 	if *waDebug == "DEBUG" {
@@ -265,7 +320,8 @@ func (s *server) startClient(userID int, textjid string, token string, subscript
 						log.Error().Err(err).Msg(sqlStmt)
 					}
 					log.Warn().Msg("QR timeout killing channel")
-					delete(clientPointer, userID)
+					deleteClient(userID)
+					deleteMyClient(userID)
 					killchannel[userID] <- true
 				} else if evt.Event == "success" {
 					log.Info().Msg("QR pairing ok!")
@@ -296,7 +352,8 @@ func (s *server) startClient(userID int, textjid string, token string, subscript
 		case <-killchannel[userID]:
 			log.Info().Str("userid", strconv.Itoa(userID)).Msg("Received kill signal")
 			client.Disconnect()
-			delete(clientPointer, userID)
+			deleteClient(userID)
+			deleteMyClient(userID)
 			sqlStmt := `UPDATE users SET connected=0 WHERE id=?`
 			_, err := s.db.Exec(sqlStmt, userID)
 			if err != nil {
@@ -315,13 +372,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	postmap := make(map[string]interface{})
 	postmap["event"] = rawEvt
 	dowebhook := 0
-	path := ""
-
-	ex, err := os.Executable()
-	if err != nil {
-		panic(err)
-	}
-	exPath := filepath.Dir(ex)
+	delivery := &webhookDelivery{mycli: mycli, postmap: postmap}
 
 	switch evt := rawEvt.(type) {
 	case *events.AppStateSyncComplete:
@@ -383,6 +434,17 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	case *events.Message:
 		postmap["type"] = "Message"
 		dowebhook = 1
+		delivery.key = evt.Info.Chat.String()
+
+		mycli.trackDisappearingTimer(evt)
+		if mycli.protocolEvent(evt, postmap) || mycli.pollVoteEvent(evt, postmap) {
+			break
+		}
+		// Status updates of contacts are sent to status@broadcast
+		if evt.Info.Chat == types.StatusBroadcastJID {
+			postmap["type"] = "Status"
+		}
+
 		metaParts := []string{fmt.Sprintf("pushname: %s", evt.Info.PushName), fmt.Sprintf("timestamp: %s", evt.Info.Timestamp)}
 		if evt.Info.Type != "" {
 			metaParts = append(metaParts, fmt.Sprintf("type: %s", evt.Info.Type))
@@ -393,121 +455,71 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		if evt.IsViewOnce {
 			metaParts = append(metaParts, "view once")
 		}
-		if evt.IsViewOnce {
+		if evt.IsEphemeral {
 			metaParts = append(metaParts, "ephemeral")
 		}
 
 		log.Info().Str("id", evt.Info.ID).Str("source", evt.Info.SourceString()).Str("parts", strings.Join(metaParts, ", ")).Msg("Message Received")
 
-		// try to get Image if any
-		img := evt.Message.GetImageMessage()
-		if img != nil {
-
-			// check/creates user directory for files
-			userDirectory := fmt.Sprintf("%s/files/user_%s", exPath, txtid)
-			_, err := os.Stat(userDirectory)
-			if os.IsNotExist(err) {
-				errDir := os.MkdirAll(userDirectory, 0751)
-				if errDir != nil {
-					log.Error().Err(errDir).Msg("Could not create user directory")
-					return
-				}
-			}
-
-			data, err := mycli.WAClient.Download(img)
-			if err != nil {
-				log.Error().Err(err).Msg("Failed to download image")
-				return
-			}
-			exts, _ := mime.ExtensionsByType(img.GetMimetype())
-			path = fmt.Sprintf("%s/%s%s", userDirectory, evt.Info.ID, exts[0])
-			err = os.WriteFile(path, data, 0600)
-			if err != nil {
-				log.Error().Err(err).Msg("Failed to save image")
-				return
-			}
-			log.Info().Str("path", path).Msg("Image saved")
+		if evt.IsViewOnce {
+			postmap["viewOnce"] = true
 		}
-
-		// try to get Audio if any
-		audio := evt.Message.GetAudioMessage()
-		if audio != nil {
-
-			// check/creates user directory for files
-			userDirectory := fmt.Sprintf("%s/files/user_%s", exPath, txtid)
-			_, err := os.Stat(userDirectory)
-			if os.IsNotExist(err) {
-				errDir := os.MkdirAll(userDirectory, 0751)
-				if errDir != nil {
-					log.Error().Err(errDir).Msg("Could not create user directory")
-					return
-				}
-			}
-
-			data, err := mycli.WAClient.Download(audio)
-			if err != nil {
-				log.Error().Err(err).Msg("Failed to download audio")
-				return
-			}
-			exts, _ := mime.ExtensionsByType(audio.GetMimetype())
-			path = fmt.Sprintf("%s/%s%s", userDirectory, evt.Info.ID, exts[0])
-			err = os.WriteFile(path, data, 0600)
-			if err != nil {
-				log.Error().Err(err).Msg("Failed to save audio")
-				return
-			}
-			log.Info().Str("path", path).Msg("Audio saved")
+		if evt.IsEphemeral {
+			postmap["ephemeralExpiration"] = messageContextInfo(evt.Message).GetExpiration()
 		}
 
-		// try to get Document if any
-		document := evt.Message.GetDocumentMessage()
-		if document != nil {
+		storeMessage(mycli.db, mycli.userID, &evt.Info, evt.Message)
 
-			// check/creates user directory for files
-			userDirectory := fmt.Sprintf("%s/files/user_%s", exPath, txtid)
-			_, err := os.Stat(userDirectory)
-			if os.IsNotExist(err) {
-				errDir := os.MkdirAll(userDirectory, 0751)
-				if errDir != nil {
-					log.Error().Err(errDir).Msg("Could not create user directory")
-					return
-				}
-			}
-
-			data, err := mycli.WAClient.Download(document)
-			if err != nil {
-				log.Error().Err(err).Msg("Failed to download document")
-				return
+		media := getMediaInfo(evt.Message)
+		if media != nil {
+			mediadata := media.webhookData()
+			mode := getMediaPolicy(mycli.db, mycli.userID).modeFor(media)
+			if mode != "off" {
+				mediadata["url"] = mediaLink(mycli.userID, evt.Info.ID)
 			}
-			extension := ""
-			exts, err := mime.ExtensionsByType(document.GetMimetype())
-			if err != nil {
-				extension = exts[0]
-			} else {
-				filename := document.FileName
-				extension = filepath.Ext(*filename)
+			mediadata["mode"] = mode
+			postmap["media"] = mediadata
+			if mode == "eager" && mycli.subscribed(postmap["type"].(string)) {
+				// Download off the event loop, the delivery keeps its place in the queue until the file is saved
+				delivery.ready = make(chan struct{})
+				if !queueMediaDownload(mediaJob{mycli: mycli, id: evt.Info.ID, media: media, delivery: delivery}) {
+					log.Warn().Str("id", evt.Info.ID).Msg("Media download queue full, sending link instead")
+					mediadata["mode"] = "lazy"
+					delivery.ready = nil
+				}
 			}
-			path = fmt.Sprintf("%s/%s%s", userDirectory, evt.Info.ID, extension)
-			err = os.WriteFile(path, data, 0600)
-			if err != nil {
-				log.Error().Err(err).Msg("Failed to save document")
-				return
+		}
+	case *events.GroupInfo:
+		if len(evt.Join) > 0 || len(evt.Leave) > 0 || len(evt.Promote) > 0 || len(evt.Demote) > 0 {
+			forgetGroupInfo(mycli.userID, evt.JID)
+		}
+		if evt.Ephemeral != nil {
+			timer := uint32(0)
+			if evt.Ephemeral.IsEphemeral {
+				timer = evt.Ephemeral.DisappearingTimer
 			}
-			log.Info().Str("path", path).Msg("Document saved")
+			setDisappearingTimer(mycli.db, mycli.userID, evt.JID, timer)
 		}
 	case *events.Receipt:
 		postmap["type"] = "ReadReceipt"
 		dowebhook = 1
+		delivery.key = evt.Chat.String()
+		mycli.recordReceipt(evt)
 		if evt.Type == events.ReceiptTypeRead || evt.Type == events.ReceiptTypeReadSelf {
-			log.Info().Strs("id", evt.MessageIDs).Str("source", evt.SourceString()).Str("timestamp", fmt.Sprintf("%d", evt.Timestamp)).Msg("Message was read")
+			log.Info().Strs("id", evt.MessageIDs).Str("source", evt.SourceString()).Str("timestamp", fmt.Sprintf("%d", evt.Timestamp.Unix())).Msg("Message was read")
 			if evt.Type == events.ReceiptTypeRead {
 				postmap["state"] = "Read"
+				updateCampaignReceipts(mycli.db, evt.MessageIDs, "read")
 			} else {
 				postmap["state"] = "ReadSelf"
 			}
 		} else if evt.Type == events.ReceiptTypeDelivered {
 			postmap["state"] = "Delivered"
-			log.Info().Str("id", evt.MessageIDs[0]).Str("source", evt.SourceString()).Str("timestamp", fmt.Sprintf("%d", evt.Timestamp)).Msg("Message delivered")
+			updateCampaignReceipts(mycli.db, evt.MessageIDs, "delivered")
+			log.Info().Str("id", evt.MessageIDs[0]).Str("source", evt.SourceString()).Str("timestamp", fmt.Sprintf("%d", evt.Timestamp.Unix())).Msg("Message delivered")
+		} else if evt.Type == events.ReceiptTypePlayed {
+			postmap["state"] = "Played"
+			log.Info().Strs("id", evt.MessageIDs).Str("source", evt.SourceString()).Str("timestamp", fmt.Sprintf("%d", evt.Timestamp.Unix())).Msg("Message was played")
 		} else {
 			// Discard webhooks for inactive or other delivery types
 			return
@@ -515,12 +527,13 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	case *events.Presence:
 		postmap["type"] = "Presence"
 		dowebhook = 1
+		delivery.key = evt.From.String()
 		if evt.Unavailable {
 			postmap["state"] = "offline"
 			if evt.LastSeen.IsZero() {
 				log.Info().Str("from", evt.From.String()).Msg("User is now offline")
 			} else {
-				log.Info().Str("from", evt.From.String()).Str("lastSeen", fmt.Sprintf("%d", evt.LastSeen)).Msg("User is now offline")
+				log.Info().Str("from", evt.From.String()).Str("lastSeen", fmt.Sprintf("%d", evt.LastSeen.Unix())).Msg("User is now offline")
 			}
 		} else {
 			postmap["state"] = "online"
@@ -530,15 +543,10 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		postmap["type"] = "HistorySync"
 		dowebhook = 1
 
-		// check/creates user directory for files
-		userDirectory := fmt.Sprintf("%s/files/user_%s", exPath, txtid)
-		_, err := os.Stat(userDirectory)
-		if os.IsNotExist(err) {
-			errDir := os.MkdirAll(userDirectory, 0751)
-			if errDir != nil {
-				log.Error().Err(errDir).Msg("Could not create user directory")
-				return
-			}
+		userDirectory, err := userDirectory(mycli.exPath, txtid)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not create user directory")
+			return
 		}
 
 		id := atomic.AddInt32(&historySyncID, 1)
@@ -575,6 +583,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	case *events.ChatPresence:
 		postmap["type"] = "ChatPresence"
 		dowebhook = 1
+		delivery.key = evt.MessageSource.Chat.String()
 		log.Info().Str("state", fmt.Sprintf("%s", evt.State)).Str("media", fmt.Sprintf("%s", evt.Media)).Str("chat", evt.MessageSource.Chat.String()).Str("sender", evt.MessageSource.Sender.String()).Msg("Chat Presence received")
 	case *events.CallOffer:
 		log.Info().Str("event", fmt.Sprintf("%+v", evt)).Msg("Got call offer")
@@ -602,36 +611,131 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	}
 
 	if dowebhook == 1 {
-		// call webhook
-		webhookurl := ""
-		myuserinfo, found := userinfocache.Get(mycli.token)
-		if !found {
-			log.Warn().Str("token", mycli.token).Msg("Could not call webhook as there is no user for this token")
-		} else {
-			webhookurl = myuserinfo.(Values).Get("Webhook")
-		}
+		mycli.callWebhook(delivery)
+	}
+}
+
+// Turns edit and revoke protocol messages into MessageEdit and MessageRevoke events, returns false for other messages
+func (mycli *MyClient) protocolEvent(evt *events.Message, postmap map[string]interface{}) bool {
+	protocol := evt.Message.GetProtocolMessage()
+	if protocol == nil {
+		return false
+	}
+	key := protocol.GetKey()
+	switch protocol.GetType() {
+	case waProto.ProtocolMessage_REVOKE:
+		postmap["type"] = "MessageRevoke"
+		// Group admins revoking messages from other participants send the original sender in the key
+		sender := evt.Info.Sender.ToNonAD()
+		if key.GetParticipant() != "" {
+			sender, _ = types.ParseJID(key.GetParticipant())
+		}
+		postmap["revoked"] = map[string]interface{}{
+			"id":        key.GetId(),
+			"chat":      evt.Info.Chat.String(),
+			"sender":    sender.String(),
+			"revokedBy": evt.Info.Sender.ToNonAD().String(),
+			"byAdmin":   sender.User != evt.Info.Sender.User,
+		}
+		log.Info().Str("id", key.GetId()).Str("source", evt.Info.SourceString()).Msg("Message revoked")
+		return true
+	case waProto.ProtocolMessage_MESSAGE_EDIT:
+		postmap["type"] = "MessageEdit"
+		text := ""
+		if edited := protocol.GetEditedMessage(); edited != nil {
+			text = messageText(edited)
+			updateStoredText(mycli.db, mycli.userID, key.GetId(), text)
+		}
+		postmap["edited"] = map[string]interface{}{
+			"id":        key.GetId(),
+			"chat":      evt.Info.Chat.String(),
+			"text":      text,
+			"timestamp": protocol.GetTimestampMs() / 1000,
+		}
+		log.Info().Str("id", key.GetId()).Str("source", evt.Info.SourceString()).Msg("Message edited")
+		return true
+	}
+	return false
+}
+
+// Message subscribers also get edits and revokes, which were sent as Message events before they had their own types
+var messageSubtypes = map[string]bool{"MessageEdit": true, "MessageRevoke": true}
+
+// Checks whether the session subscribed to an event type
+func (mycli *MyClient) subscribed(eventtype string) bool {
+	return Find(mycli.subscriptions, eventtype) || Find(mycli.subscriptions, "All") ||
+		(messageSubtypes[eventtype] && Find(mycli.subscriptions, "Message"))
+}
+
+// Queues an event for delivery to the user webhook
+func (mycli *MyClient) callWebhook(delivery *webhookDelivery) {
+	eventtype := delivery.postmap["type"].(string)
+	if !mycli.subscribed(eventtype) {
+		log.Warn().Str("type", eventtype).Msg("Skipping webhook. Not subscribed for this type")
+		return
+	}
+	getDispatcher(mycli.db, mycli.userID).enqueue(delivery)
+}
 
-		if !Find(mycli.subscriptions, postmap["type"].(string)) && !Find(mycli.subscriptions, "All") {
-			log.Warn().Str("type", postmap["type"].(string)).Msg("Skipping webhook. Not subscribed for this type")
+// Queues a webhook for an event produced by the server itself rather than by WhatsApp. Events of
+// sessions no longer running, such as a background send finishing after a logout, are still delivered
+func serverEvent(db *sql.DB, userid int, key string, postmap map[string]interface{}) {
+	mycli := getMyClient(userid)
+	if mycli == nil {
+		var err error
+		mycli, err = offlineClient(db, userid)
+		if err != nil {
+			log.Warn().Err(err).Int("userid", userid).Str("type", postmap["type"].(string)).Msg("Skipping webhook. No user")
 			return
 		}
+	}
+	mycli.callWebhook(&webhookDelivery{mycli: mycli, postmap: postmap, key: key})
+}
 
-		if webhookurl != "" {
-			log.Info().Str("url", webhookurl).Msg("Calling webhook")
-			values, _ := json.Marshal(postmap)
-			if path == "" {
-				data := make(map[string]string)
-				data["data"] = string(values)
-				data["token"] = mycli.token
-				go callHook(webhookurl, data, mycli.userID)
-			} else {
-				data := make(map[string]string)
-				data["data"] = string(values)
-				data["token"] = mycli.token
-				go callHookFile(webhookurl, data, mycli.userID, path)
-			}
-		} else {
-			log.Warn().Str("userid", strconv.Itoa(mycli.userID)).Msg("No webhook set for user")
+// Stand-in for a session that is not running, with what is needed to deliver webhooks
+func offlineClient(db *sql.DB, userid int) (*MyClient, error) {
+	var token, events string
+	err := db.QueryRow("SELECT token, events FROM users WHERE id=?", userid).Scan(&token, &events)
+	if err != nil {
+		return nil, err
+	}
+	return &MyClient{userID: userid, token: token, subscriptions: strings.Split(events, ","), db: db}, nil
+}
+
+// Posts an event to the user webhook, attaching the file in path if set
+func (mycli *MyClient) sendWebhook(postmap map[string]interface{}, path string) (string, *resty.Response, error) {
+	webhookurl := ""
+	myuserinfo, found := userinfocache.Get(mycli.token)
+	if !found {
+		log.Warn().Str("token", mycli.token).Msg("Could not call webhook as there is no user for this token")
+	} else {
+		webhookurl = myuserinfo.(Values).Get("Webhook")
+	}
+
+	if webhookurl == "" {
+		log.Warn().Str("userid", strconv.Itoa(mycli.userID)).Msg("No webhook set for user")
+		return "", nil, nil
+	}
+
+	resp, err := postWebhook(mycli.db, mycli.userID, mycli.token, webhookurl, postmap, path)
+	return webhookurl, resp, err
+}
+
+// Posts an event to a webhook url, rendering the user template if enabled
+func postWebhook(db *sql.DB, userid int, token string, webhookurl string, postmap map[string]interface{}, path string) (*resty.Response, error) {
+	tmpl := getWebhookTemplate(db, userid)
+	if tmpl.Enabled {
+		rendered, err := tmpl.render(webhookurl, postmap, token)
+		if err != nil {
+			return nil, err
 		}
+		return callHookTemplate(rendered, userid, path)
+	}
+
+	log.Info().Str("url", webhookurl).Msg("Calling webhook")
+	data := webhookFormData(postmap, token)
+	if path == "" {
+		return callHook(webhookurl, data, userid)
 	}
+	return callHookFile(webhookurl, data, userid, path)
 }